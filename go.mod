@@ -4,16 +4,15 @@ go 1.24.0
 
 require (
 	github.com/BurntSushi/xgb v0.0.0-20210121224620-deaf085860bc
+	github.com/ebitengine/purego v0.8.2
 	github.com/godbus/dbus/v5 v5.1.0
 	github.com/msteinert/pam v1.2.0
 	github.com/neurlang/wayland v0.2.1
 	github.com/tuxx/wayland-ext-session-lock-go v0.0.0-20250328013740-430eff7f7869
+	golang.org/x/crypto v0.24.0
 	golang.org/x/image v0.25.0
 	golang.org/x/sys v0.21.0
+	golang.org/x/text v0.23.0
 )
 
-require (
-	github.com/ebitengine/purego v0.8.2 // indirect
-	github.com/yalue/native_endian v1.0.2 // indirect
-	golang.org/x/text v0.23.0 // indirect
-)
+require github.com/yalue/native_endian v1.0.2 // indirect
@@ -0,0 +1,377 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AuditEntry is a single record in the audit log. It never contains passwords.
+type AuditEntry struct {
+	Time           time.Time `json:"time"`
+	Event          string    `json:"event"`
+	User           string    `json:"user,omitempty"`
+	SessionUser    string    `json:"session_user,omitempty"`
+	PamError       string    `json:"pam_error,omitempty"`
+	LockoutSeconds int       `json:"lockout_seconds,omitempty"`
+	LockedSeconds  int       `json:"locked_seconds,omitempty"`
+	Message        string    `json:"message,omitempty"`
+}
+
+// Audit event names
+const (
+	AuditEventLockStart      = "lock_start"
+	AuditEventLockEnd        = "lock_end"
+	AuditEventAuthFailure    = "auth_failure"
+	AuditEventLockout        = "lockout"
+	AuditEventUnlockByOther  = "unlock_by_other_user"
+	AuditEventTampering      = "tampering"
+	AuditEventInputUnchecked = "input_unchecked"
+)
+
+// Audit log destinations
+const (
+	AuditLogFile    = "file"
+	AuditLogJournal = "journal"
+	AuditLogBoth    = "both"
+	AuditLogNone    = "none"
+)
+
+// journalSocketPath is the native protocol socket of systemd-journald
+const journalSocketPath = "/run/systemd/journal/socket"
+
+// AuditLogger writes audit entries to an append-only file and/or the journal
+type AuditLogger struct {
+	destination string
+	path        string
+}
+
+// stateDir returns the per-user directory for fancylock's persistent state
+func stateDir() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			homeDir = "/tmp"
+		}
+		dir = filepath.Join(homeDir, ".local", "state")
+	}
+	return filepath.Join(dir, "fancylock")
+}
+
+// defaultAuditLogPath returns the default location of the audit log
+func defaultAuditLogPath() string {
+	return filepath.Join(stateDir(), "audit.log")
+}
+
+// auditLogPath returns the configured audit log path or the default one
+func auditLogPath(config Configuration) string {
+	if config.AuditLogPath != "" {
+		return config.AuditLogPath
+	}
+	return defaultAuditLogPath()
+}
+
+// NewAuditLogger creates an audit logger for the configured destination
+func NewAuditLogger(config Configuration) *AuditLogger {
+	destination := config.AuditLog
+	if destination == "" {
+		destination = AuditLogFile
+	}
+	return &AuditLogger{
+		destination: destination,
+		path:        auditLogPath(config),
+	}
+}
+
+// Log records an audit entry, errors are logged but otherwise ignored
+func (a *AuditLogger) Log(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	if a.destination == AuditLogFile || a.destination == AuditLogBoth {
+		if err := a.writeFile(entry); err != nil {
+			Error("Failed to write audit log: %v", err)
+		}
+	}
+
+	if a.destination == AuditLogJournal || a.destination == AuditLogBoth {
+		if err := writeJournal(entry); err != nil {
+			Error("Failed to write audit entry to the journal: %v", err)
+		}
+	}
+}
+
+// writeFile appends an entry to the audit log as a JSON line
+func (a *AuditLogger) writeFile(entry AuditEntry) error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %v", err)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %v", err)
+	}
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+
+	return nil
+}
+
+// auditMessage returns a human readable summary of an entry
+func auditMessage(entry AuditEntry) string {
+	switch entry.Event {
+	case AuditEventLockStart:
+		return "Session locked"
+	case AuditEventLockEnd:
+		return fmt.Sprintf("Session unlocked by %s after %ds", entry.User, entry.LockedSeconds)
+	case AuditEventAuthFailure:
+		return fmt.Sprintf("Failed unlock attempt for %s: %s", entry.User, entry.PamError)
+	case AuditEventLockout:
+		return fmt.Sprintf("Locked out for %ds", entry.LockoutSeconds)
+	case AuditEventUnlockByOther:
+		return fmt.Sprintf("Session of %s unlocked by %s", entry.SessionUser, entry.User)
+	}
+	if entry.Message != "" {
+		return entry.Message
+	}
+	return entry.Event
+}
+
+// appendJournalField adds a field in the journal native protocol format
+func appendJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+
+	// Values with newlines are sent as a little endian length and raw data
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// writeJournal sends an entry to systemd-journald over its native socket
+func writeJournal(entry AuditEntry) error {
+	var buf bytes.Buffer
+	appendJournalField(&buf, "MESSAGE", auditMessage(entry))
+	appendJournalField(&buf, "PRIORITY", "5") // LOG_NOTICE
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", "fancylock")
+	appendJournalField(&buf, "FANCYLOCK_EVENT", entry.Event)
+	if entry.User != "" {
+		appendJournalField(&buf, "FANCYLOCK_USER", entry.User)
+	}
+	if entry.SessionUser != "" {
+		appendJournalField(&buf, "FANCYLOCK_SESSION_USER", entry.SessionUser)
+	}
+	if entry.PamError != "" {
+		appendJournalField(&buf, "FANCYLOCK_PAM_ERROR", entry.PamError)
+	}
+	if entry.LockoutSeconds != 0 {
+		appendJournalField(&buf, "FANCYLOCK_LOCKOUT_SECONDS", fmt.Sprint(entry.LockoutSeconds))
+	}
+	if entry.LockedSeconds != 0 {
+		appendJournalField(&buf, "FANCYLOCK_LOCKED_SECONDS", fmt.Sprint(entry.LockedSeconds))
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to journald: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to send to journald: %v", err)
+	}
+
+	return nil
+}
+
+// ReadAuditLog reads all entries from a JSON-lines audit log
+func ReadAuditLog(path string) ([]AuditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			Warn("Skipping malformed audit log line %d: %v", line, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+
+	return entries, nil
+}
+
+// RunAuditCommand implements "fancylock audit", which queries the audit log
+func RunAuditCommand(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	configPath := flags.String("c", "", "Path to configuration file")
+	flags.StringVar(configPath, "config", "", "Path to configuration file")
+	since := flags.Duration("since", 0, "Only show entries newer than this, e.g. 24h")
+	event := flags.String("event", "", "Only show entries of this event type")
+	username := flags.String("user", "", "Only show entries for this user")
+	asJSON := flags.Bool("json", false, "Print entries as JSON lines")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: fancylock audit [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fmt.Fprintf(os.Stderr, "  -c, --config string\n    	Path to configuration file\n")
+		fmt.Fprintf(os.Stderr, "  --since duration\n    	Only show entries newer than this, e.g. 24h\n")
+		fmt.Fprintf(os.Stderr, "  --event string\n    	Only show entries of this event type\n")
+		fmt.Fprintf(os.Stderr, "  --user string\n    	Only show entries for this user\n")
+		fmt.Fprintf(os.Stderr, "  --json\n    	Print entries as JSON lines\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config := DefaultConfig()
+	if *configPath == "" {
+		*configPath = DefaultConfigPath()
+	}
+	if *configPath != "" {
+		// Only the audit log settings matter here, so don't validate the rest
+		if err := readConfig(*configPath, &config); err != nil {
+			return err
+		}
+	}
+
+	if config.AuditLog == AuditLogJournal || config.AuditLog == AuditLogNone {
+		return fmt.Errorf("audit log file is disabled, try: journalctl SYSLOG_IDENTIFIER=fancylock")
+	}
+
+	entries, err := ReadAuditLog(auditLogPath(config))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if *since > 0 && time.Since(entry.Time) > *since {
+			continue
+		}
+		if *event != "" && entry.Event != *event {
+			continue
+		}
+		if *username != "" && entry.User != *username && entry.SessionUser != *username {
+			continue
+		}
+
+		if *asJSON {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return fmt.Errorf("failed to marshal audit entry: %v", err)
+			}
+			fmt.Println(string(data))
+			continue
+		}
+
+		fmt.Printf("%s  %-20s %s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Event, auditMessage(entry))
+	}
+
+	return nil
+}
+
+// AuditLockStart records the start of a lock session
+func (h *LockHelper) AuditLockStart() {
+	h.lockedAt = time.Now()
+	h.away.Reset()
+	h.audit.Log(AuditEntry{
+		Event:       AuditEventLockStart,
+		SessionUser: h.authenticator.username,
+	})
+}
+
+// LockedAt returns when the current lock session started
+func (h *LockHelper) LockedAt() time.Time {
+	return h.lockedAt
+}
+
+// AuditLockEnd records the end of a lock session and who unlocked it. An
+// empty username means the session owner.
+func (h *LockHelper) AuditLockEnd(username string) {
+	if username == "" {
+		username = h.authenticator.username
+	}
+	h.audit.Log(AuditEntry{
+		Event:         AuditEventLockEnd,
+		User:          username,
+		SessionUser:   h.authenticator.username,
+		LockedSeconds: int(time.Since(h.lockedAt).Seconds()),
+	})
+}
+
+// AuditAuthFailure records a failed unlock attempt
+func (h *LockHelper) AuditAuthFailure(username string, result AuthResult) {
+	if username == "" {
+		username = h.authenticator.username
+	}
+	h.away.RecordFailure(time.Now())
+	h.audit.Log(AuditEntry{
+		Event:       AuditEventAuthFailure,
+		User:        username,
+		SessionUser: h.authenticator.username,
+		PamError:    result.ErrorClass,
+	})
+}
+
+// AuditTampering records an attempt to get around the lock screen, like
+// input injected by another client
+func (h *LockHelper) AuditTampering(message string) {
+	h.audit.Log(AuditEntry{
+		Event:       AuditEventTampering,
+		SessionUser: h.authenticator.username,
+		Message:     message,
+	})
+}
+
+// AuditInputUnchecked records that injected input can't be told apart
+// during this lock session
+func (h *LockHelper) AuditInputUnchecked(message string) {
+	h.audit.Log(AuditEntry{
+		Event:       AuditEventInputUnchecked,
+		SessionUser: h.authenticator.username,
+		Message:     message,
+	})
+}
+
+// AuditLockout records a lockout started by the lockout manager
+func (h *LockHelper) AuditLockout(duration time.Duration, reason string) {
+	h.away.RecordLockout(time.Now())
+	h.audit.Log(AuditEntry{
+		Event:          AuditEventLockout,
+		SessionUser:    h.authenticator.username,
+		LockoutSeconds: int(duration.Round(time.Second).Seconds()),
+		Message:        reason,
+	})
+}
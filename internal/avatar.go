@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	accountsBusName   = "org.freedesktop.Accounts"
+	accountsPath      = "/org/freedesktop/Accounts"
+	accountsIface     = "org.freedesktop.Accounts"
+	accountsUserIface = "org.freedesktop.Accounts.User"
+)
+
+// UserProfile is whose session is locked, as shown on the lock screen
+type UserProfile struct {
+	Name   string      // Real name, or the username if there's none
+	Avatar image.Image // nil without a picture
+}
+
+// LoadUserProfile looks up the real name of username in the GECOS field
+// and its picture in AccountsService, or ~/.face if it has none
+func LoadUserProfile(username string) UserProfile {
+	profile := UserProfile{Name: username}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		Warn("Failed to look up user %s: %v", username, err)
+		return profile
+	}
+	if u.Name != "" {
+		profile.Name = u.Name
+	}
+
+	paths := []string{filepath.Join(u.HomeDir, ".face")}
+	if icon, err := accountsIconFile(username); err != nil {
+		Debug("No AccountsService picture: %v", err)
+	} else if icon != "" {
+		paths = append([]string{icon}, paths...)
+	}
+
+	for _, path := range paths {
+		img, err := loadAvatarImage(path)
+		if err != nil {
+			Debug("Skipping avatar: %v", err)
+			continue
+		}
+		Debug("Using avatar %s", path)
+		profile.Avatar = img
+		break
+	}
+	return profile
+}
+
+// SessionUserProfile loads the profile of the session owner
+func (h *LockHelper) SessionUserProfile() UserProfile {
+	return LoadUserProfile(h.authenticator.username)
+}
+
+// accountsIconFile asks AccountsService for the picture of username
+func accountsIconFile(username string) (string, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to system bus: %v", err)
+	}
+	defer conn.Close()
+
+	var userPath dbus.ObjectPath
+	accounts := conn.Object(accountsBusName, accountsPath)
+	if err := accounts.Call(accountsIface+".FindUserByName", 0, username).Store(&userPath); err != nil {
+		return "", fmt.Errorf("failed to find user %s: %v", username, err)
+	}
+
+	icon, err := conn.Object(accountsBusName, userPath).GetProperty(accountsUserIface + ".IconFile")
+	if err != nil {
+		return "", fmt.Errorf("failed to get picture of %s: %v", username, err)
+	}
+	path, _ := icon.Value().(string)
+	return path, nil
+}
+
+// loadAvatarImage decodes a PNG, JPEG, GIF or WebP picture
+func loadAvatarImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open avatar: %v", err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode avatar %s: %v", path, err)
+	}
+	return img, nil
+}
+
+// circleAvatar scales src to cover a square of the given diameter and cuts
+// it into a circle with smooth edges, ringed by border pixels of color ring
+func circleAvatar(src image.Image, diameter, border int, ring color.NRGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, diameter, diameter))
+	drawCover(img, src)
+
+	radius := float64(diameter) / 2
+	r, g, b, a := ring.RGBA()
+	for y := 0; y < diameter; y++ {
+		for x := 0; x < diameter; x++ {
+			distance := math.Hypot(float64(x)+0.5-radius, float64(y)+0.5-radius)
+			i := img.PixOffset(x, y)
+			px := img.Pix[i : i+4 : i+4]
+
+			// Blend the ring over the picture where they meet
+			if border > 0 {
+				inner := clamp01(distance - (radius - float64(border)) + 0.5)
+				ringAlpha := inner * float64(a) / 0xffff
+				for c, value := range []uint32{r, g, b, a} {
+					px[c] = uint8(float64(px[c])*(1-ringAlpha) + float64(value>>8)*inner)
+				}
+			}
+
+			// Then cut the circle, all channels as the image is premultiplied
+			coverage := clamp01(radius - distance + 0.5)
+			for c := range px {
+				px[c] = uint8(float64(px[c]) * coverage)
+			}
+		}
+	}
+	return img
+}
+
+// clamp01 limits v to the range 0 to 1
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// defaultBackgroundColor is used when no background is configured
+const defaultBackgroundColor = "#000000"
+
+// Background is what fills the Wayland lock surfaces behind the prompt.
+// It's opaque unless transparency was asked for.
+type Background struct {
+	transparent bool
+	color       color.RGBA
+	image       image.Image
+
+	mu    sync.Mutex
+	cache map[image.Point]*image.RGBA // Rendered background per surface size
+}
+
+// parseHexColor parses a color in the form #rrggbb
+func parseHexColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb", s)
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb", s)
+	}
+	return color.RGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 0xff}, nil
+}
+
+// loadBackgroundImage decodes a PNG, JPEG, GIF or WebP file
+func loadBackgroundImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open background image: %v", err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode background image: %v", err)
+	}
+	return img, nil
+}
+
+// NewBackground prepares the background described by config, or by theme
+// where config doesn't set one. An image that can't be loaded falls back to
+// the color, so the lock stays opaque.
+func NewBackground(config Configuration, theme Theme) *Background {
+	backgroundColor := config.BackgroundColor
+	if backgroundColor == "" {
+		backgroundColor = theme.Background.Color
+	}
+	backgroundImage := config.BackgroundImage
+	if backgroundImage == "" {
+		backgroundImage = theme.Background.Image
+	}
+
+	b := &Background{
+		transparent: config.TransparentBackground,
+		color:       color.RGBA{A: 0xff},
+		cache:       make(map[image.Point]*image.RGBA),
+	}
+
+	if c, err := parseHexColor(backgroundColor); err == nil {
+		b.color = c
+	} else if backgroundColor != "" {
+		Warn("Using black background: %v", err)
+	}
+
+	if backgroundImage != "" && !b.transparent {
+		img, err := loadBackgroundImage(backgroundImage)
+		if err != nil {
+			Error("Using background color instead: %v", err)
+		} else {
+			b.image = img
+		}
+	}
+
+	return b
+}
+
+// RGBA returns the background for a surface of the given size. The image is
+// scaled to cover the surface and centered. Callers must not modify it.
+func (b *Background) RGBA(width, height int) *image.RGBA {
+	size := image.Pt(width, height)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if img, ok := b.cache[size]; ok {
+		return img
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if !b.transparent {
+		draw.Draw(img, img.Bounds(), &image.Uniform{b.color}, image.Point{}, draw.Src)
+		if b.image != nil {
+			drawCover(img, b.image)
+		}
+	}
+
+	b.cache[size] = img
+	return img
+}
+
+// drawCover scales src to cover dst, keeping its aspect ratio and cutting off
+// what sticks out
+func drawCover(dst *image.RGBA, src image.Image) {
+	sb := src.Bounds()
+	db := dst.Bounds()
+	if sb.Empty() || db.Empty() {
+		return
+	}
+
+	scale := float64(db.Dx()) / float64(sb.Dx())
+	if s := float64(db.Dy()) / float64(sb.Dy()); s > scale {
+		scale = s
+	}
+
+	w := int(float64(sb.Dx())*scale + 0.5)
+	h := int(float64(sb.Dy())*scale + 0.5)
+	x := (db.Dx() - w) / 2
+	y := (db.Dy() - h) / 2
+
+	xdraw.ApproxBiLinear.Scale(dst, image.Rect(x, y, x+w, y+h), src, sb, draw.Over, nil)
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localeTime holds the names and formats of the LC_TIME locale
+type localeTime struct {
+	abday    []string // Sunday first
+	day      []string
+	abmon    []string // January first
+	mon      []string
+	amPm     []string
+	dFmt     string // %x
+	tFmt     string // %X
+	dtFmt    string // %c
+	tFmtAmPm string // %r
+}
+
+// cLocaleTime is the C locale, used when the locale can't be read
+var cLocaleTime = localeTime{
+	abday:    strings.Split("Sun;Mon;Tue;Wed;Thu;Fri;Sat", ";"),
+	day:      strings.Split("Sunday;Monday;Tuesday;Wednesday;Thursday;Friday;Saturday", ";"),
+	abmon:    strings.Split("Jan;Feb;Mar;Apr;May;Jun;Jul;Aug;Sep;Oct;Nov;Dec", ";"),
+	mon:      strings.Split("January;February;March;April;May;June;July;August;September;October;November;December", ";"),
+	amPm:     []string{"AM", "PM"},
+	dFmt:     "%m/%d/%y",
+	tFmt:     "%H:%M:%S",
+	dtFmt:    "%a %b %e %H:%M:%S %Y",
+	tFmtAmPm: "%I:%M:%S %p",
+}
+
+var (
+	currentLocaleTime     localeTime
+	currentLocaleTimeOnce sync.Once
+)
+
+// loadLocaleTime returns the LC_TIME locale of the session, which the
+// locale command reads from LC_ALL, LC_TIME and LANG
+func loadLocaleTime() localeTime {
+	currentLocaleTimeOnce.Do(func() {
+		currentLocaleTime = cLocaleTime
+
+		out, err := exec.Command("locale", "-k", "LC_TIME").Output()
+		if err != nil {
+			Debug("Using C locale names for the clock: %v", err)
+			return
+		}
+		currentLocaleTime = parseLocaleTime(out)
+	})
+	return currentLocaleTime
+}
+
+// parseLocaleTime parses the key="value" lines of locale -k LC_TIME, keeping
+// the C locale for anything missing
+func parseLocaleTime(out []byte) localeTime {
+	lt := cLocaleTime
+
+	list := func(value string, n int, dst *[]string) {
+		if names := strings.Split(value, ";"); len(names) == n && names[0] != "" {
+			*dst = names
+		}
+	}
+	text := func(value string, dst *string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+
+		switch key {
+		case "abday":
+			list(value, 7, &lt.abday)
+		case "day":
+			list(value, 7, &lt.day)
+		case "abmon":
+			list(value, 12, &lt.abmon)
+		case "mon":
+			list(value, 12, &lt.mon)
+		case "am_pm":
+			list(value, 2, &lt.amPm)
+		case "d_fmt":
+			text(value, &lt.dFmt)
+		case "t_fmt":
+			text(value, &lt.tFmt)
+		case "d_t_fmt":
+			text(value, &lt.dtFmt)
+		case "t_fmt_ampm":
+			text(value, &lt.tFmtAmPm)
+		}
+	}
+	return lt
+}
+
+// strftime formats t like strftime(3) in the session's locale. It knows the
+// conversions a clock needs, others are kept as they are.
+func strftime(format string, t time.Time) string {
+	return loadLocaleTime().format(format, t, 0)
+}
+
+// format formats t. Locale formats may refer to each other, depth keeps a
+// broken locale from recursing forever.
+func (lt localeTime) format(format string, t time.Time, depth int) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+
+		// Of glibc's flags only - for no padding matters, the defaults of
+		// the others are fine
+		noPad := false
+		for i+1 < len(format) && strings.IndexByte("-_0^#EO", format[i]) >= 0 {
+			noPad = noPad || format[i] == '-'
+			i++
+		}
+		start := b.Len()
+
+		hour12 := t.Hour() % 12
+		if hour12 == 0 {
+			hour12 = 12
+		}
+
+		switch format[i] {
+		case 'a':
+			b.WriteString(lt.abday[t.Weekday()])
+		case 'A':
+			b.WriteString(lt.day[t.Weekday()])
+		case 'b', 'h':
+			b.WriteString(lt.abmon[t.Month()-1])
+		case 'B':
+			b.WriteString(lt.mon[t.Month()-1])
+		case 'c', 'x', 'X', 'r':
+			if depth > 2 {
+				continue
+			}
+			sub := map[byte]string{'c': lt.dtFmt, 'x': lt.dFmt, 'X': lt.tFmt, 'r': lt.tFmtAmPm}[format[i]]
+			b.WriteString(lt.format(sub, t, depth+1))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'e':
+			fmt.Fprintf(&b, "%2d", t.Day())
+		case 'F':
+			fmt.Fprintf(&b, "%04d-%02d-%02d", t.Year(), t.Month(), t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&b, "%02d", hour12)
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'k':
+			fmt.Fprintf(&b, "%2d", t.Hour())
+		case 'l':
+			fmt.Fprintf(&b, "%2d", hour12)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", t.Month())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'n':
+			b.WriteByte('\n')
+		case 'p':
+			b.WriteString(lt.amPm[t.Hour()/12])
+		case 'P':
+			b.WriteString(strings.ToLower(lt.amPm[t.Hour()/12]))
+		case 'R':
+			fmt.Fprintf(&b, "%02d:%02d", t.Hour(), t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 't':
+			b.WriteByte('\t')
+		case 'T':
+			fmt.Fprintf(&b, "%02d:%02d:%02d", t.Hour(), t.Minute(), t.Second())
+		case 'u':
+			fmt.Fprintf(&b, "%d", (int(t.Weekday())+6)%7+1)
+		case 'w':
+			fmt.Fprintf(&b, "%d", t.Weekday())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'Y':
+			fmt.Fprintf(&b, "%d", t.Year())
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+
+		if noPad {
+			converted := b.String()[start:]
+			if trimmed := strings.TrimLeft(converted, "0 "); trimmed != converted {
+				if trimmed == "" {
+					trimmed = "0"
+				}
+				rest := b.String()[:start]
+				b.Reset()
+				b.WriteString(rest + trimmed)
+			}
+		}
+	}
+	return b.String()
+}
+
+// showsSeconds reports whether a strftime format changes every second
+func showsSeconds(format string) bool {
+	format = strings.NewReplacer("%-", "%", "%_", "%", "%0", "%", "%^", "%", "%#", "%", "%E", "%", "%O", "%").Replace(format)
+	for _, conversion := range []string{"%S", "%T", "%c", "%X", "%r"} {
+		if strings.Contains(format, conversion) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatLockedFor describes how long the screen has been locked, like
+// "1h 12m", to the minute
+func formatLockedFor(d time.Duration) string {
+	minutes := int(d / time.Minute)
+	switch {
+	case minutes < 1:
+		return "less than a minute"
+	case minutes < 60:
+		return fmt.Sprintf("%dm", minutes)
+	case minutes < 24*60:
+		return fmt.Sprintf("%dh %dm", minutes/60, minutes%60)
+	default:
+		return fmt.Sprintf("%dd %dh", minutes/(24*60), minutes/60%24)
+	}
+}
+
+// untilNextTick returns how long it is from now until the next full second
+// or, for clocks that don't show seconds, the next full minute
+func untilNextTick(now time.Time, seconds bool) time.Duration {
+	step := time.Minute
+	if seconds {
+		step = time.Second
+	}
+	return now.Truncate(step).Add(step).Sub(now)
+}
@@ -21,22 +21,74 @@ func DefaultConfig() Configuration {
 	}
 
 	return Configuration{
-		MediaDir:           filepath.Join(homeDir, "Videos"),
-		LockScreen:         false,
-		SupportedExt:       []string{".mov", ".mkv", ".mp4", ".avi", ".webm"},
-		PamService:         PamService,
-		IncludeImages:      true,
-		ImageDisplayTime:   30,
-		DebugExit:          false, // Disabled by default for security
-		PreLockCommand:     "",    // No default pre-lock command
-		PostLockCommand:    "",    // No default post-lock command
-		LockPauseMedia:     false, // Disabled by default
-		UnlockUnpauseMedia: false, // Disabled by default
+		MediaDir:               filepath.Join(homeDir, "Videos"),
+		LockScreen:             false,
+		SupportedExt:           []string{".mov", ".mkv", ".mp4", ".avi", ".webm"},
+		PamService:             PamService,
+		IncludeImages:          true,
+		ImageDisplayTime:       30,
+		DebugExit:              false, // Disabled by default for security
+		PreLockCommand:         "",    // No default pre-lock command
+		PostLockCommand:        "",    // No default post-lock command
+		Hooks:                  map[string][]HookConfig{},
+		IdleSeconds:            60,
+		DuressPasswordHash:     "",
+		TOTPEnabled:            false,
+		TOTPSecretFile:         "",
+		FingerprintEnabled:     false,
+		UnlockDevices:          []USBDeviceRule{},
+		LockOnRemove:           []USBDeviceRule{},
+		LockOnRemoveDebounceMs: 500,
+		SysfsRoot:              defaultSysfsRoot,
+		Theme:                  defaultThemeName,
+		BackgroundColor:        "", // Use the theme's
+		BackgroundImage:        "",
+		TransparentBackground:  false,
+		LockPauseMedia:         false, // Disabled by default
+		UnlockUnpauseMedia:     false, // Disabled by default
+		UnlockUsers:            []string{},
+		UnlockGroups:           []string{},
+		Lockout:                DefaultLockoutPolicy(),
+		FaillockEnabled:        true,
+		FaillockDir:            "",
+		AuditLog:               AuditLogFile,
+		AuditLogPath:           "",
+		AwaySummary:            false, // Disabled by default
 	}
 }
 
+// DefaultConfigPath returns ~/.config/fancylock/config.json if it exists, or ""
+func DefaultConfigPath() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	path := filepath.Join(homeDir, ".config", "fancylock", "config.json")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+
+	return path
+}
+
 // LoadConfig loads configuration from the specified file path
 func LoadConfig(path string, config *Configuration) error {
+	if err := readConfig(path, config); err != nil {
+		return err
+	}
+
+	// Validate the configuration
+	if err := validateConfig(config); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	return nil
+}
+
+// readConfig parses the config file over config without validating it, for
+// commands that only need a few settings and must not fail on the others
+func readConfig(path string, config *Configuration) error {
 	// Read the config file
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -49,11 +101,6 @@ func LoadConfig(path string, config *Configuration) error {
 		return fmt.Errorf("failed to parse config file: %v", err)
 	}
 
-	// Validate the configuration
-	if err := validateConfig(config); err != nil {
-		return fmt.Errorf("invalid configuration: %v", err)
-	}
-
 	return nil
 }
 
@@ -79,6 +126,49 @@ func SaveConfig(path string, config Configuration) error {
 	return nil
 }
 
+// redacted returns a copy of config that's safe to write to the log. The
+// duress hash, the commands hooks run and the serials of the trusted USB
+// devices would tell anyone reading the log how to get past the lock or
+// what the duress password sets off.
+func (config Configuration) redacted() Configuration {
+	const hidden = "<redacted>"
+
+	if config.DuressPasswordHash != "" {
+		config.DuressPasswordHash = hidden
+	}
+	if config.PreLockCommand != "" {
+		config.PreLockCommand = hidden
+	}
+	if config.PostLockCommand != "" {
+		config.PostLockCommand = hidden
+	}
+
+	hooks := make(map[string][]HookConfig, len(config.Hooks))
+	for name, list := range config.Hooks {
+		hooks[name] = make([]HookConfig, len(list))
+		for i, hook := range list {
+			hook.Command = hidden
+			hooks[name][i] = hook
+		}
+	}
+	config.Hooks = hooks
+
+	redactSerials := func(rules []USBDeviceRule) []USBDeviceRule {
+		out := make([]USBDeviceRule, len(rules))
+		for i, rule := range rules {
+			if rule.Serial != "" {
+				rule.Serial = hidden
+			}
+			out[i] = rule
+		}
+		return out
+	}
+	config.UnlockDevices = redactSerials(config.UnlockDevices)
+	config.LockOnRemove = redactSerials(config.LockOnRemove)
+
+	return config
+}
+
 // validateConfig checks if the configuration is valid
 func validateConfig(config *Configuration) error {
 	// Check if media directory exists
@@ -105,6 +195,62 @@ func validateConfig(config *Configuration) error {
 		return fmt.Errorf("image display time must be positive")
 	}
 
+	// Ensure the audit log destination is known
+	switch config.AuditLog {
+	case AuditLogFile, AuditLogJournal, AuditLogBoth, AuditLogNone:
+	default:
+		return fmt.Errorf("unknown audit_log destination %q", config.AuditLog)
+	}
+
+	// Ensure the lockout policy makes sense
+	if err := validateLockoutPolicy(config.Lockout); err != nil {
+		return err
+	}
+
+	// Ensure every hook is known and has a command
+	if err := validateHooks(config.Hooks); err != nil {
+		return err
+	}
+
+	if config.IdleSeconds < 0 {
+		return fmt.Errorf("idle_seconds must not be negative")
+	}
+
+	// Ensure the trusted USB devices can be matched
+	if err := validateUSBDeviceRules("unlock_devices", config.UnlockDevices, true); err != nil {
+		return err
+	}
+
+	if err := validateUSBDeviceRules("lock_on_remove", config.LockOnRemove, false); err != nil {
+		return err
+	}
+
+	if config.LockOnRemoveDebounceMs < 0 {
+		return fmt.Errorf("lock_on_remove_debounce_ms must not be negative")
+	}
+
+	// Ensure the theme and background can be drawn
+	if _, err := LoadTheme(config.Theme); err != nil {
+		return err
+	}
+	if config.BackgroundColor != "" {
+		if _, err := parseHexColor(config.BackgroundColor); err != nil {
+			return fmt.Errorf("background_color: %v", err)
+		}
+	}
+	if config.BackgroundImage != "" {
+		if _, err := os.Stat(config.BackgroundImage); err != nil {
+			return fmt.Errorf("background_image: %v", err)
+		}
+	}
+
+	// Ensure the duress password hash can be used
+	if config.DuressPasswordHash != "" {
+		if _, err := ParseDuressHash(config.DuressPasswordHash); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Daemon stays in the background and locks the screen when a trigger fires
+type Daemon struct {
+	config    Configuration
+	newLocker func() ScreenLocker
+	locked    atomic.Bool
+}
+
+// NewDaemon creates a daemon that builds a fresh locker for every lock
+func NewDaemon(config Configuration, newLocker func() ScreenLocker) *Daemon {
+	return &Daemon{
+		config:    config,
+		newLocker: newLocker,
+	}
+}
+
+// lock locks the screen unless it's already locked. It returns right away,
+// the lock runs until the session is unlocked.
+func (d *Daemon) lock(reason string) {
+	if !d.locked.CompareAndSwap(false, true) {
+		Debug("Ignoring %s, the screen is already locked", reason)
+		return
+	}
+
+	Info("Locking screen: %s", reason)
+	go func() {
+		defer d.locked.Store(false)
+		if err := d.newLocker().Lock(); err != nil {
+			Error("Failed to lock screen: %v", err)
+		}
+	}()
+}
+
+// Run watches the configured triggers until the process exits
+func (d *Daemon) Run() error {
+	if len(d.config.LockOnRemove) == 0 {
+		return fmt.Errorf("daemon mode has nothing to watch, configure lock_on_remove")
+	}
+
+	if d.config.LockScreen {
+		d.lock("started with --lock")
+	}
+
+	monitor := NewUSBMonitor(d.config.SysfsRoot, d.config.LockOnRemove)
+	defer monitor.Stop()
+
+	for _, rule := range d.config.LockOnRemove {
+		Info("Locking when USB device %s is removed", rule)
+	}
+	if !monitor.Present() {
+		Warn("None of the lock_on_remove devices is plugged in")
+	}
+
+	// A device that drops off the bus and comes straight back, e.g. a
+	// security key switching modes, doesn't lock the screen
+	debounce := time.Duration(d.config.LockOnRemoveDebounceMs) * time.Millisecond
+	d.watchRemovals(monitor.Changes(), monitor.Present, debounce, nil)
+	return nil
+}
+
+// watchRemovals locks the screen once no device has been present for
+// debounce after a change, until stop is closed
+func (d *Daemon) watchRemovals(changes <-chan bool, present func() bool, debounce time.Duration, stop <-chan struct{}) {
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case isPresent := <-changes:
+			if isPresent {
+				timer.Stop()
+				continue
+			}
+			timer.Reset(debounce)
+		case <-timer.C:
+			if !present() {
+				d.lock("USB device removed")
+			}
+		}
+	}
+}
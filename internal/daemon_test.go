@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingLocker counts locks and returns right away
+type countingLocker struct {
+	locks *atomic.Int32
+}
+
+func (l countingLocker) Lock() error {
+	l.locks.Add(1)
+	return nil
+}
+
+func TestDaemonDebouncesRemoval(t *testing.T) {
+	const debounce = 50 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		changes   []bool // Presence changes, sent right after each other
+		backAfter bool   // Whether the device is present when the timer fires
+		wantLocks int32
+	}{
+		{"removed", []bool{false}, false, 1},
+		{"replugged in time", []bool{false, true}, true, 0},
+		{"back without a change", []bool{false}, true, 0},
+		{"plugged in", []bool{true}, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var locks atomic.Int32
+			var present atomic.Bool
+			present.Store(true)
+
+			d := NewDaemon(Configuration{}, func() ScreenLocker { return countingLocker{&locks} })
+			changes := make(chan bool)
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				d.watchRemovals(changes, present.Load, debounce, stop)
+				close(done)
+			}()
+
+			for _, change := range tt.changes {
+				present.Store(change || tt.backAfter)
+				changes <- change
+			}
+			time.Sleep(4 * debounce)
+			close(stop)
+			<-done
+
+			// The lock runs on its own goroutine
+			deadline := time.Now().Add(time.Second)
+			for locks.Load() < tt.wantLocks && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := locks.Load(); got != tt.wantLocks {
+				t.Errorf("locked %d times, want %d", got, tt.wantLocks)
+			}
+		})
+	}
+}
+
+func TestDaemonLocksOnce(t *testing.T) {
+	var locks atomic.Int32
+	release := make(chan struct{})
+	d := NewDaemon(Configuration{}, func() ScreenLocker {
+		return lockerFunc(func() error {
+			locks.Add(1)
+			<-release
+			return nil
+		})
+	})
+
+	d.lock("first")
+	d.lock("second")
+	time.Sleep(20 * time.Millisecond)
+	if got := locks.Load(); got != 1 {
+		t.Errorf("locked %d times while locked, want 1", got)
+	}
+
+	// Once unlocked, the next trigger locks again
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for d.locked.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	d.lock("third")
+	for locks.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := locks.Load(); got != 2 {
+		t.Errorf("locked %d times after unlocking, want 2", got)
+	}
+}
+
+// lockerFunc is a ScreenLocker that calls itself
+type lockerFunc func() error
+
+func (f lockerFunc) Lock() error {
+	return f()
+}
+
+func TestLockHelperCloseStopsWatchers(t *testing.T) {
+	h := hookHelper(map[string][]HookConfig{HookOnIdle: {{Command: "true"}}})
+	h.config.IdleSeconds = 60
+	h.config.SysfsRoot = t.TempDir()
+	h.config.UnlockDevices = []USBDeviceRule{{Vendor: "1050", Product: "0407", Serial: "123456"}}
+	h.activity = make(chan struct{}, 1)
+
+	h.StartSessionWatchers()
+	h.StartUnlockDeviceWatch()
+	h.Close()
+	if h.stopWatchers != nil || h.unlockDevices != nil {
+		t.Error("Close left watchers running")
+	}
+
+	// The daemon's lockers may close a helper that never locked
+	h.Close()
+}
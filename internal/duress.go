@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// duressHashScheme prefixes hashes created by "fancylock duress-hash"
+	duressHashScheme = "pbkdf2-sha256"
+
+	// duressHashIterations is the PBKDF2 work factor for new hashes
+	duressHashIterations = 600000
+
+	// duressSaltSize and duressKeySize are the salt and derived key lengths in bytes
+	duressSaltSize = 16
+	duressKeySize  = 32
+)
+
+// DuressHash is a parsed duress password hash in the form
+// pbkdf2-sha256$<iterations>$<salt>$<key>, with base64 salt and key
+type DuressHash struct {
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+// ParseDuressHash parses a duress password hash from the configuration
+func ParseDuressHash(encoded string) (*DuressHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != duressHashScheme {
+		return nil, fmt.Errorf("duress password hash must look like %s$<iterations>$<salt>$<key>", duressHashScheme)
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("invalid duress password hash iterations %q", parts[1])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("invalid duress password hash salt")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("invalid duress password hash key")
+	}
+
+	return &DuressHash{iterations: iterations, salt: salt, key: key}, nil
+}
+
+// NewDuressHash hashes password with a fresh random salt
+func NewDuressHash(password []byte) (string, error) {
+	salt := make([]byte, duressSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	key := pbkdf2.Key(password, salt, duressHashIterations, duressKeySize, sha256.New)
+
+	return fmt.Sprintf("%s$%d$%s$%s", duressHashScheme, duressHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Matches reports whether password is the duress password, in constant time.
+// The password is hashed straight from the caller's buffer, so it's never
+// copied to a string.
+func (d *DuressHash) Matches(password []byte) bool {
+	key := pbkdf2.Key(password, d.salt, d.iterations, len(d.key), sha256.New)
+	return subtle.ConstantTimeCompare(key, d.key) == 1
+}
+
+// checkDuress is the authentication stage that runs before PAM. It returns
+// true if password is the duress password, which then never reaches PAM, so
+// it can't add to a pam_faillock tally. The caller treats the match like a
+// password PAM accepted, so the unlock device and code are still required
+// and nothing on screen tells the two apart.
+func (h *LockHelper) checkDuress(password []byte) bool {
+	if h.duress == nil || !h.duress.Matches(password) {
+		return false
+	}
+
+	Debug("Duress password entered")
+	return true
+}
+
+// startDuressHook runs the on_duress hooks once a duress unlock went through.
+// They run beside the unlock, so it takes no longer than a normal one, and
+// Lock waits for them before returning, so a wipe isn't cut short by exiting.
+func (h *LockHelper) startDuressHook() {
+	h.StartHook(HookOnDuress, HookEnv{User: h.authenticator.username, Attempts: h.away.Failures()})
+}
+
+// stdin is shared by the prompts of the subcommands, so a reader of piped
+// input doesn't swallow the lines meant for the next prompt
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassword prompts on the terminal and reads a line with echo turned off
+func readPassword(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	fmt.Fprint(os.Stderr, prompt)
+
+	if termios, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+		quiet := *termios
+		quiet.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, &quiet); err != nil {
+			return nil, fmt.Errorf("failed to turn off echo: %v", err)
+		}
+		defer func() {
+			unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+
+	line, err := stdin.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, fmt.Errorf("failed to read password: %v", err)
+	}
+	return []byte(strings.TrimRight(string(line), "\r\n")), nil
+}
+
+// RunDuressHashCommand implements "fancylock duress-hash", which prints the
+// hash to put in duress_password_hash
+func RunDuressHashCommand(args []string) error {
+	flags := flag.NewFlagSet("duress-hash", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: fancylock duress-hash\n\n")
+		fmt.Fprintf(os.Stderr, "Reads a duress password and prints the value for duress_password_hash.\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	password, err := readPassword("Duress password: ")
+	if err != nil {
+		return err
+	}
+	confirm, err := readPassword("Repeat duress password: ")
+	if err != nil {
+		return err
+	}
+	if len(password) == 0 {
+		return fmt.Errorf("the duress password must not be empty")
+	}
+	if subtle.ConstantTimeCompare(password, confirm) != 1 {
+		return fmt.Errorf("the passwords do not match")
+	}
+
+	hash, err := NewDuressHash(password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
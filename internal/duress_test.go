@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// testDuressHash hashes password with a single round to keep tests fast
+func testDuressHash(password string) *DuressHash {
+	salt := []byte("0123456789abcdef")
+	return &DuressHash{
+		iterations: 1,
+		salt:       salt,
+		key:        pbkdf2.Key([]byte(password), salt, 1, duressKeySize, sha256.New),
+	}
+}
+
+func TestDuressHashMatches(t *testing.T) {
+	encoded, err := NewDuressHash([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := ParseDuressHash(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !hash.Matches([]byte("correct horse")) {
+		t.Error("duress password didn't match its hash")
+	}
+	if hash.Matches([]byte("correct horse ")) {
+		t.Error("other password matched the duress hash")
+	}
+
+	for _, bad := range []string{"", "pbkdf2-sha256$0$c2FsdA$a2V5", "md5$1$c2FsdA$a2V5", "pbkdf2-sha256$1$$a2V5"} {
+		if _, err := ParseDuressHash(bad); err == nil {
+			t.Errorf("parsed invalid hash %q", bad)
+		}
+	}
+}
+
+func TestDuressPasswordNeedsEveryFactor(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	sysfs := t.TempDir()
+	marker := filepath.Join(t.TempDir(), "duress")
+
+	h := hookHelper(map[string][]HookConfig{
+		HookOnDuress: {{Command: "touch " + marker}},
+	})
+	h.duress = testDuressHash("duress")
+	h.config.SysfsRoot = sysfs
+	h.config.UnlockDevices = []USBDeviceRule{{Vendor: "1050", Product: "0407", Serial: "123456"}}
+	h.config.TOTPEnabled = true
+	h.config.TOTPSecretFile = writeTOTPFile(t, &totpFile{Secret: totpEncoding.EncodeToString(secret)})
+
+	hookRan := func() bool {
+		h.WaitHooks()
+		_, err := os.Stat(marker)
+		return err == nil
+	}
+
+	// Without the key, the duress password is refused like the real one
+	result := h.AuthenticateUser("", []byte("duress"))
+	if result.Success || result.SecondFactor || result.Message != "Insert security key" {
+		t.Fatalf("without the key: %+v", result)
+	}
+	if hookRan() {
+		t.Fatal("duress hook ran without the key")
+	}
+
+	// With it, the code is asked for as after the real password
+	addSysfsDevice(t, sysfs, "1-2", map[string]string{"idVendor": "1050", "idProduct": "0407", "serial": "123456"})
+	result = h.AuthenticateUser("", []byte("duress"))
+	if !result.SecondFactor {
+		t.Fatalf("with the key: %+v, want the code prompt", result)
+	}
+	if hookRan() {
+		t.Fatal("duress hook ran before the code")
+	}
+
+	if result := h.VerifySecondFactor([]byte("000000x")); result.Success {
+		t.Fatal("wrong code accepted")
+	}
+	if hookRan() {
+		t.Fatal("duress hook ran after a wrong code")
+	}
+
+	// A wrong code ends the attempt, the password has to come again
+	h.AuthenticateUser("", []byte("duress"))
+	code := totpCode(secret, totpCounter(time.Now()))
+	if result := h.VerifySecondFactor([]byte(code)); !result.Success {
+		t.Fatalf("code refused: %+v", result)
+	}
+	if !hookRan() {
+		t.Error("duress hook didn't run after the unlock")
+	}
+}
+
+func TestRedactedConfigHidesDuressSetup(t *testing.T) {
+	config := DefaultConfig()
+	config.DuressPasswordHash = "pbkdf2-sha256$600000$c2FsdA$a2V5"
+	config.Hooks = map[string][]HookConfig{HookOnDuress: {{Command: "rm -rf ~/secrets"}}}
+	config.UnlockDevices = []USBDeviceRule{{Vendor: "1050", Product: "0407", Serial: "123456"}}
+
+	logged := fmt.Sprintf("%+v", config.redacted())
+	for _, secret := range []string{"a2V5", "rm -rf", "123456"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("redacted config contains %q", secret)
+		}
+	}
+
+	// The config itself is left alone
+	if config.Hooks[HookOnDuress][0].Command != "rm -rf ~/secrets" || config.UnlockDevices[0].Serial != "123456" {
+		t.Error("redacting changed the original config")
+	}
+}
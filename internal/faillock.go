@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// faillockConfPath is where pam_faillock reads its options from
+	faillockConfPath = "/etc/security/faillock.conf"
+
+	// faillockRecordSize is the size of a struct tally record
+	faillockRecordSize = 64
+
+	// faillockStatusValid marks a tally record as in use
+	faillockStatusValid = 0x1
+)
+
+// FaillockConfig holds the pam_faillock options that decide a lockout
+type FaillockConfig struct {
+	Dir          string
+	Deny         int
+	FailInterval time.Duration
+	UnlockTime   time.Duration // Zero means the account stays locked until reset
+}
+
+// FaillockStatus describes the pam_faillock tally of a user
+type FaillockStatus struct {
+	Failures  int       // Failures counted within the fail interval
+	Remaining int       // Attempts left before pam_faillock locks the account
+	Locked    bool      // Whether pam_faillock currently denies the user
+	Until     time.Time // When the lock ends, zero if it never ends on its own
+}
+
+// defaultFaillockConfig returns pam_faillock's built-in defaults
+func defaultFaillockConfig() FaillockConfig {
+	return FaillockConfig{
+		Dir:          "/var/run/faillock",
+		Deny:         3,
+		FailInterval: 900 * time.Second,
+		UnlockTime:   600 * time.Second,
+	}
+}
+
+// loadFaillockConfig reads faillock.conf, keeping defaults for missing options
+func loadFaillockConfig(path string) FaillockConfig {
+	config := defaultFaillockConfig()
+
+	file, err := os.Open(path)
+	if err != nil {
+		Debug("Failed to open %s, using pam_faillock defaults: %v", path, err)
+		return config
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "dir":
+			config.Dir = value
+		case "deny":
+			if n, err := strconv.Atoi(value); err == nil {
+				config.Deny = n
+			}
+		case "fail_interval":
+			if n, err := strconv.Atoi(value); err == nil {
+				config.FailInterval = time.Duration(n) * time.Second
+			}
+		case "unlock_time":
+			if value == "never" {
+				config.UnlockTime = 0
+			} else if n, err := strconv.Atoi(value); err == nil {
+				config.UnlockTime = time.Duration(n) * time.Second
+			}
+		}
+	}
+
+	return config
+}
+
+// ReadFaillockStatus parses the tally file of username the way pam_faillock does
+func ReadFaillockStatus(config FaillockConfig, username string) (FaillockStatus, error) {
+	return readFaillockStatus(config, username, time.Now())
+}
+
+// readFaillockStatus is ReadFaillockStatus at the given time
+func readFaillockStatus(config FaillockConfig, username string, now time.Time) (FaillockStatus, error) {
+	status := FaillockStatus{Remaining: config.Deny}
+
+	data, err := os.ReadFile(filepath.Join(config.Dir, username))
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return status, fmt.Errorf("failed to read faillock tally: %v", err)
+	}
+
+	// struct tally { char source[52]; uint16_t reserved; uint16_t status; uint64_t time; }
+	var latest int64
+	var times []int64
+	for offset := 0; offset+faillockRecordSize <= len(data); offset += faillockRecordSize {
+		record := data[offset : offset+faillockRecordSize]
+		if binary.NativeEndian.Uint16(record[54:56])&faillockStatusValid == 0 {
+			continue
+		}
+		failedAt := int64(binary.NativeEndian.Uint64(record[56:64]))
+		times = append(times, failedAt)
+		latest = max(latest, failedAt)
+	}
+
+	// pam_faillock decides the lock from the failures within fail_interval
+	// of the latest one, however long ago that was
+	interval := int64(config.FailInterval / time.Second)
+	for _, failedAt := range times {
+		if failedAt > latest-interval {
+			status.Failures++
+		}
+	}
+
+	if config.Deny <= 0 {
+		return status, nil
+	}
+
+	if status.Failures >= config.Deny {
+		until := time.Unix(latest, 0).Add(config.UnlockTime)
+		if config.UnlockTime == 0 || now.Before(until) {
+			status.Locked = true
+			status.Remaining = 0
+			if config.UnlockTime != 0 {
+				status.Until = until
+			}
+			return status, nil
+		}
+
+		// Unlocked by time, the next failure starts a new tally
+		return status, nil
+	}
+
+	// The next failure drops the ones older than fail_interval from now
+	recent := 0
+	for _, failedAt := range times {
+		if failedAt >= now.Unix()-interval {
+			recent++
+		}
+	}
+	status.Remaining = max(config.Deny-recent, 0)
+
+	return status, nil
+}
+
+// faillockConfig returns the pam_faillock options, honouring the configured dir
+func (lm *LockoutManager) faillockConfig() FaillockConfig {
+	config := loadFaillockConfig(faillockConfPath)
+	if lm.config.FaillockDir != "" {
+		config.Dir = lm.config.FaillockDir
+	}
+	return config
+}
+
+// syncFaillock merges pam_faillock's view of the account into the lockout
+// state. It returns the faillock status, or nil if it isn't available.
+func (lm *LockoutManager) syncFaillock() *FaillockStatus {
+	if !lm.config.FaillockEnabled || lm.username == "" {
+		return nil
+	}
+
+	status, err := ReadFaillockStatus(lm.faillockConfig(), lm.username)
+	if err != nil {
+		Debug("Unable to read pam_faillock tally: %v", err)
+		return nil
+	}
+
+	lm.faillockLocked = status.Locked
+	lm.faillockUntil = status.Until
+	if !status.Locked {
+		return &status
+	}
+
+	// pam_faillock rejects every password until it unlocks, so we lock out too
+	until := status.Until
+	if until.IsZero() {
+		// Locked until an administrator resets it, check again later
+		until = time.Now().Add(time.Duration(lm.config.Lockout.MaxLockoutSeconds) * time.Second)
+	}
+	if until.After(lm.lockoutUntil) || !lm.lockoutActive {
+		lm.lockoutUntil = until
+	}
+	lm.lockoutActive = true
+
+	Info("pam_faillock has locked %s (%d failures), locked out until %v",
+		lm.username, status.Failures, lm.lockoutUntil)
+	return &status
+}
+
+// LockoutReason describes who imposed the current lockout, empty for our own policy
+func (lm *LockoutManager) LockoutReason() string {
+	if !lm.faillockLocked {
+		return ""
+	}
+	if lm.faillockUntil.IsZero() {
+		return "Account locked by pam_faillock until reset by an administrator"
+	}
+	return fmt.Sprintf("Account locked by pam_faillock until %s", lm.faillockUntil.Format("15:04:05"))
+}
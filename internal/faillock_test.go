@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTally writes a pam_faillock tally file with a valid record for each
+// failure and an invalid one for each cleared failure
+func writeTally(t *testing.T, dir, username string, failures, cleared []time.Time) {
+	t.Helper()
+	var data []byte
+	add := func(at time.Time, status uint16) {
+		record := make([]byte, faillockRecordSize)
+		copy(record, "tty1")
+		binary.NativeEndian.PutUint16(record[54:56], status)
+		binary.NativeEndian.PutUint64(record[56:64], uint64(at.Unix()))
+		data = append(data, record...)
+	}
+	for _, at := range failures {
+		add(at, faillockStatusValid)
+	}
+	for _, at := range cleared {
+		add(at, 0)
+	}
+	if err := os.WriteFile(filepath.Join(dir, username), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFaillockStatus(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	config := FaillockConfig{Deny: 3, FailInterval: 15 * time.Minute, UnlockTime: 10 * time.Minute}
+	never := config
+	never.UnlockTime = 0
+	hour := config
+	hour.UnlockTime = time.Hour
+
+	tests := []struct {
+		name     string
+		config   FaillockConfig
+		failures []time.Time
+		cleared  []time.Time
+		want     FaillockStatus
+	}{
+		{"no tally", config, nil, nil, FaillockStatus{Remaining: 3}},
+		{"one failure", config, []time.Time{ago(time.Minute)}, nil,
+			FaillockStatus{Failures: 1, Remaining: 2}},
+		{"cleared records don't count", config, []time.Time{ago(time.Minute)}, []time.Time{ago(time.Minute), ago(time.Minute)},
+			FaillockStatus{Failures: 1, Remaining: 2}},
+		{"locked", config, []time.Time{ago(3 * time.Minute), ago(2 * time.Minute), ago(time.Minute)}, nil,
+			FaillockStatus{Failures: 3, Locked: true, Until: ago(time.Minute).Add(10 * time.Minute)}},
+		{"unlocked by time", config, []time.Time{ago(13 * time.Minute), ago(12 * time.Minute), ago(11 * time.Minute)}, nil,
+			FaillockStatus{Failures: 3, Remaining: 3}},
+		{"failures spread wider than the interval", config, []time.Time{ago(20 * time.Minute), ago(4 * time.Minute), ago(time.Minute)}, nil,
+			FaillockStatus{Failures: 2, Remaining: 1}},
+		// Counted from the latest failure, not from now, like pam_faillock
+		{"never unlocks", never, []time.Time{ago(62 * time.Minute), ago(61 * time.Minute), ago(time.Hour)}, nil,
+			FaillockStatus{Failures: 3, Locked: true}},
+		{"long unlock time", hour, []time.Time{ago(32 * time.Minute), ago(31 * time.Minute), ago(30 * time.Minute)}, nil,
+			FaillockStatus{Failures: 3, Locked: true, Until: ago(30 * time.Minute).Add(time.Hour)}},
+		{"old failures are dropped by the next one", config, []time.Time{ago(40 * time.Minute), ago(30 * time.Minute)}, nil,
+			FaillockStatus{Failures: 2, Remaining: 3}},
+		{"deny disabled", FaillockConfig{FailInterval: 15 * time.Minute}, []time.Time{ago(time.Minute)}, nil,
+			FaillockStatus{Failures: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.failures != nil || tt.cleared != nil {
+				writeTally(t, dir, "alice", tt.failures, tt.cleared)
+			}
+			tt.config.Dir = dir
+
+			got, err := readFaillockStatus(tt.config, "alice", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("status = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFaillockConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faillock.conf")
+	conf := "# comment\ndir = /run/faillock\ndeny = 5 # trailing\nfail_interval=60\nunlock_time = never\nsilent\n"
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := FaillockConfig{Dir: "/run/faillock", Deny: 5, FailInterval: time.Minute, UnlockTime: 0}
+	if got := loadFaillockConfig(path); got != want {
+		t.Errorf("config = %+v, want %+v", got, want)
+	}
+	if got := loadFaillockConfig(filepath.Join(t.TempDir(), "missing")); got != defaultFaillockConfig() {
+		t.Errorf("missing file gave %+v, want the defaults", got)
+	}
+}
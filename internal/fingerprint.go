@@ -0,0 +1,359 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	fprintBusName      = "net.reactivated.Fprint"
+	fprintManagerPath  = "/net/reactivated/Fprint/Manager"
+	fprintManagerIface = "net.reactivated.Fprint.Manager"
+	fprintDeviceIface  = "net.reactivated.Fprint.Device"
+
+	// fingerprintMaxAttempts matches pam_fprintd's default max-tries
+	fingerprintMaxAttempts = 3
+)
+
+// FingerprintEvent is a verify result reported by fprintd
+type FingerprintEvent struct {
+	Result  string // fprintd result, e.g. "verify-match"
+	Matched bool   // Whether the finger belongs to the user
+	Failed  bool   // Whether the finger was read but didn't match
+	Message string // Text to show on the lock screen
+}
+
+// fprintStatus is a VerifyStatus signal of an fprintd device
+type fprintStatus struct {
+	Result string // fprintd result, e.g. "verify-match"
+	Done   bool   // Whether verification ended with this result
+}
+
+// fprintDevice is an fprintd fingerprint reader. fprintdDevice talks to the
+// real fprintd, tests use a fake.
+type fprintDevice interface {
+	Claim(username string) error
+	VerifyStart() error
+	VerifyStop() error
+	Release() error
+	Statuses() <-chan fprintStatus // VerifyStatus signals after Claim
+	Close() error                  // Releases the connection to fprintd
+}
+
+// fprintdDevice is the default fprintd device on the system bus
+type fprintdDevice struct {
+	conn     *dbus.Conn
+	device   dbus.BusObject
+	signals  chan *dbus.Signal
+	statuses chan fprintStatus
+	closed   chan struct{}
+}
+
+// openFprintd connects to fprintd on the system bus and looks up its
+// default device
+func openFprintd() (fprintDevice, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to system bus: %v", err)
+	}
+
+	var devicePath dbus.ObjectPath
+	manager := conn.Object(fprintBusName, fprintManagerPath)
+	if err := manager.Call(fprintManagerIface+".GetDefaultDevice", 0).Store(&devicePath); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no fingerprint reader: %v", err)
+	}
+
+	d := &fprintdDevice{
+		conn:     conn,
+		device:   conn.Object(fprintBusName, devicePath),
+		signals:  make(chan *dbus.Signal, 8),
+		statuses: make(chan fprintStatus, 8),
+		closed:   make(chan struct{}),
+	}
+
+	err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(devicePath),
+		dbus.WithMatchInterface(fprintDeviceIface),
+		dbus.WithMatchMember("VerifyStatus"),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to subscribe to fingerprint events: %v", err)
+	}
+	conn.Signal(d.signals)
+	go d.forward()
+
+	Debug("Using fingerprint reader %s", devicePath)
+	return d, nil
+}
+
+// forward turns VerifyStatus signals into statuses until the device is closed
+func (d *fprintdDevice) forward() {
+	for {
+		select {
+		case <-d.closed:
+			return
+		case signal, ok := <-d.signals:
+			if !ok {
+				return
+			}
+			if signal == nil || len(signal.Body) < 2 || signal.Path != d.device.Path() {
+				continue
+			}
+			result, _ := signal.Body[0].(string)
+			done, _ := signal.Body[1].(bool)
+
+			select {
+			case d.statuses <- fprintStatus{Result: result, Done: done}:
+			case <-d.closed:
+				return
+			}
+		}
+	}
+}
+
+func (d *fprintdDevice) Claim(username string) error {
+	return d.device.Call(fprintDeviceIface+".Claim", 0, username).Err
+}
+
+func (d *fprintdDevice) VerifyStart() error {
+	return d.device.Call(fprintDeviceIface+".VerifyStart", 0, "any").Err
+}
+
+func (d *fprintdDevice) VerifyStop() error {
+	return d.device.Call(fprintDeviceIface+".VerifyStop", 0).Err
+}
+
+func (d *fprintdDevice) Release() error {
+	return d.device.Call(fprintDeviceIface+".Release", 0).Err
+}
+
+func (d *fprintdDevice) Statuses() <-chan fprintStatus {
+	return d.statuses
+}
+
+func (d *fprintdDevice) Close() error {
+	close(d.closed)
+	return d.conn.Close()
+}
+
+// isFprintBusy reports whether fprintd turned down a claim because another
+// program is using the reader
+func isFprintBusy(err error) bool {
+	var dbusErr dbus.Error
+	return errors.As(err, &dbusErr) && dbusErr.Name == fprintBusName+".Error.AlreadyInUse"
+}
+
+// FingerprintVerifier runs fprintd verification in the background while the
+// password can still be typed
+type FingerprintVerifier struct {
+	device   fprintDevice
+	events   chan FingerprintEvent
+	stop     chan struct{}
+	stopOnce sync.Once
+	finished chan struct{} // Closed when run returns
+}
+
+// fingerprintMessage returns the on-screen text for an fprintd verify result
+func fingerprintMessage(result string) string {
+	switch result {
+	case "verify-match":
+		return "Fingerprint recognized"
+	case "verify-no-match":
+		return "Fingerprint not recognized"
+	case "verify-retry-scan":
+		return "Scan your finger again"
+	case "verify-swipe-too-short":
+		return "Swipe was too short, try again"
+	case "verify-finger-not-centered":
+		return "Center your finger on the reader"
+	case "verify-remove-and-retry":
+		return "Remove your finger and try again"
+	case "verify-disconnected":
+		return "Fingerprint reader disconnected"
+	}
+	return "Fingerprint reader error"
+}
+
+// NewFingerprintVerifier claims device for username and starts verifying.
+// The device is closed if that fails.
+func NewFingerprintVerifier(device fprintDevice, username string) (*FingerprintVerifier, error) {
+	if err := device.Claim(username); err != nil {
+		device.Close()
+		if isFprintBusy(err) {
+			return nil, fmt.Errorf("fingerprint reader is in use by another program")
+		}
+		return nil, fmt.Errorf("failed to claim fingerprint reader: %v", err)
+	}
+
+	v := &FingerprintVerifier{
+		device:   device,
+		events:   make(chan FingerprintEvent, 4),
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+
+	if err := device.VerifyStart(); err != nil {
+		v.release()
+		return nil, fmt.Errorf("failed to start fingerprint verification: %v", err)
+	}
+
+	go v.run()
+
+	Debug("Fingerprint verification started")
+	return v, nil
+}
+
+// Events returns the channel verify results are delivered on
+func (v *FingerprintVerifier) Events() <-chan FingerprintEvent {
+	return v.events
+}
+
+// run forwards verify results and restarts verification after each scan,
+// giving up after fingerprintMaxAttempts mismatches
+func (v *FingerprintVerifier) run() {
+	defer close(v.finished)
+	failures := 0
+	statuses := v.device.Statuses()
+	for {
+		select {
+		case <-v.stop:
+			return
+		case status, ok := <-statuses:
+			if !ok {
+				return
+			}
+
+			event := FingerprintEvent{
+				Result:  status.Result,
+				Matched: status.Result == "verify-match",
+				Failed:  status.Result == "verify-no-match",
+				Message: fingerprintMessage(status.Result),
+			}
+			if event.Failed {
+				failures++
+				if failures >= fingerprintMaxAttempts {
+					event.Message = "Too many fingerprint attempts, use your password"
+				}
+			}
+
+			select {
+			case v.events <- event:
+			case <-v.stop:
+				return
+			}
+
+			if !status.Done {
+				continue
+			}
+			if failures >= fingerprintMaxAttempts || status.Result == "verify-disconnected" {
+				Info("Stopping fingerprint verification: %s", status.Result)
+				v.halt()
+				return
+			}
+
+			// A finished scan ends verification, start over for the next one
+			v.device.VerifyStop()
+			if err := v.device.VerifyStart(); err != nil {
+				Error("Failed to restart fingerprint verification: %v", err)
+				v.halt()
+				return
+			}
+		}
+	}
+}
+
+// release gives the device back to fprintd and closes the connection
+func (v *FingerprintVerifier) release() {
+	v.device.Release()
+	v.device.Close()
+}
+
+// Stop ends verification and releases the reader, it's safe to call twice.
+// No result is delivered once it returns.
+func (v *FingerprintVerifier) Stop() {
+	v.halt()
+	<-v.finished
+}
+
+// halt ends verification and releases the reader without waiting for run
+func (v *FingerprintVerifier) halt() {
+	v.stopOnce.Do(func() {
+		close(v.stop)
+		v.device.VerifyStop()
+		v.release()
+		Debug("Fingerprint verification stopped")
+	})
+}
+
+// FingerprintEnabled returns whether fingerprint unlocking is configured
+func (h *LockHelper) FingerprintEnabled() bool {
+	return h.config.FingerprintEnabled
+}
+
+// StartFingerprint starts fingerprint verification for the session owner. It
+// returns nil if fingerprints are disabled or the reader can't be used.
+//
+// Claiming the reader takes D-Bus calls to fprintd, so lockers call it off
+// their event loop. If StopFingerprint is called meanwhile, the reader is
+// released again and nil is returned.
+func (h *LockHelper) StartFingerprint() <-chan FingerprintEvent {
+	h.fingerprintMu.Lock()
+	if !h.FingerprintEnabled() || h.fingerprint != nil {
+		h.fingerprintMu.Unlock()
+		return nil
+	}
+	run := h.fingerprintRun
+	h.fingerprintMu.Unlock()
+
+	device, err := h.openFingerprint()
+	if err != nil {
+		Warn("Fingerprint unlock unavailable: %v", err)
+		return nil
+	}
+	verifier, err := NewFingerprintVerifier(device, h.authenticator.username)
+	if err != nil {
+		Warn("Fingerprint unlock unavailable: %v", err)
+		return nil
+	}
+
+	h.fingerprintMu.Lock()
+	if run != h.fingerprintRun || h.fingerprint != nil {
+		h.fingerprintMu.Unlock()
+		Debug("Fingerprint verification stopped while starting")
+		verifier.Stop()
+		return nil
+	}
+	h.fingerprint = verifier
+	h.fingerprintMu.Unlock()
+	return verifier.Events()
+}
+
+// StopFingerprint stops fingerprint verification if it's running or starting
+func (h *LockHelper) StopFingerprint() {
+	h.fingerprintMu.Lock()
+	verifier := h.fingerprint
+	h.fingerprint = nil
+	h.fingerprintRun++
+	h.fingerprintMu.Unlock()
+
+	if verifier != nil {
+		verifier.Stop()
+	}
+}
+
+// FingerprintActive returns whether fingerprint verification is running
+func (h *LockHelper) FingerprintActive() bool {
+	h.fingerprintMu.Lock()
+	defer h.fingerprintMu.Unlock()
+	return h.fingerprint != nil
+}
+
+// AuditFingerprintFailure records a fingerprint that didn't match
+func (h *LockHelper) AuditFingerprintFailure(event FingerprintEvent) {
+	h.AuditAuthFailure("", AuthResult{ErrorClass: "fingerprint: " + event.Result})
+}
@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// fakeFprint is an fprintd device that records calls and reports the
+// statuses a test sends it
+type fakeFprint struct {
+	mu       sync.Mutex
+	calls    []string
+	claimErr error
+	statuses chan fprintStatus
+	closed   chan struct{}
+}
+
+func newFakeFprint() *fakeFprint {
+	return &fakeFprint{
+		statuses: make(chan fprintStatus),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (f *fakeFprint) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+// Calls returns the calls made so far
+func (f *fakeFprint) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+func (f *fakeFprint) Claim(username string) error {
+	f.record("Claim " + username)
+	return f.claimErr
+}
+
+func (f *fakeFprint) VerifyStart() error {
+	f.record("VerifyStart")
+	return nil
+}
+
+func (f *fakeFprint) VerifyStop() error {
+	f.record("VerifyStop")
+	return nil
+}
+
+func (f *fakeFprint) Release() error {
+	f.record("Release")
+	return nil
+}
+
+func (f *fakeFprint) Statuses() <-chan fprintStatus {
+	return f.statuses
+}
+
+func (f *fakeFprint) Close() error {
+	f.record("Close")
+	close(f.closed)
+	return nil
+}
+
+// send delivers a VerifyStatus signal, failing if nobody reads it
+func (f *fakeFprint) send(t *testing.T, result string, done bool) {
+	t.Helper()
+	select {
+	case f.statuses <- fprintStatus{Result: result, Done: done}:
+	case <-time.After(time.Second):
+		t.Fatalf("verifier didn't read status %s", result)
+	}
+}
+
+// waitClosed waits for the verifier to let go of the device
+func (f *fakeFprint) waitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-f.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("device wasn't closed, calls: %v", f.Calls())
+	}
+}
+
+// nextEvent returns the next event of the verifier
+func nextEvent(t *testing.T, v *FingerprintVerifier) FingerprintEvent {
+	t.Helper()
+	select {
+	case event := <-v.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no fingerprint event")
+	}
+	return FingerprintEvent{}
+}
+
+func TestFingerprintVerifyMatch(t *testing.T) {
+	device := newFakeFprint()
+	v, err := NewFingerprintVerifier(device, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Stop()
+
+	device.send(t, "verify-match", true)
+	event := nextEvent(t, v)
+	if !event.Matched || event.Failed {
+		t.Errorf("verify-match gave %+v", event)
+	}
+	if event.Message != "Fingerprint recognized" {
+		t.Errorf("message = %q", event.Message)
+	}
+
+	calls := device.Calls()
+	if len(calls) < 2 || calls[0] != "Claim alice" || calls[1] != "VerifyStart" {
+		t.Errorf("calls = %v, want Claim alice then VerifyStart", calls)
+	}
+}
+
+func TestFingerprintNoMatch(t *testing.T) {
+	device := newFakeFprint()
+	v, err := NewFingerprintVerifier(device, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Stop()
+
+	// A retry doesn't end the scan or count as a mismatch
+	device.send(t, "verify-retry-scan", false)
+	if event := nextEvent(t, v); event.Failed || event.Message != "Scan your finger again" {
+		t.Errorf("verify-retry-scan gave %+v", event)
+	}
+
+	for i := 1; i <= fingerprintMaxAttempts; i++ {
+		device.send(t, "verify-no-match", true)
+		event := nextEvent(t, v)
+		if !event.Failed || event.Matched {
+			t.Errorf("mismatch %d gave %+v", i, event)
+		}
+		last := i == fingerprintMaxAttempts
+		if tooMany := strings.HasPrefix(event.Message, "Too many"); tooMany != last {
+			t.Errorf("mismatch %d message = %q", i, event.Message)
+		}
+	}
+
+	// Verification restarts after each mismatch but the last, then stops
+	device.waitClosed(t)
+	want := []string{"Claim alice", "VerifyStart",
+		"VerifyStop", "VerifyStart",
+		"VerifyStop", "VerifyStart",
+		"VerifyStop", "Release", "Close"}
+	if calls := device.Calls(); !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestFingerprintDeviceBusy(t *testing.T) {
+	device := newFakeFprint()
+	device.claimErr = dbus.Error{Name: fprintBusName + ".Error.AlreadyInUse"}
+
+	v, err := NewFingerprintVerifier(device, "alice")
+	if err == nil {
+		v.Stop()
+		t.Fatal("claiming a busy reader succeeded")
+	}
+	if !strings.Contains(err.Error(), "in use") {
+		t.Errorf("error = %v, want the reader to be in use", err)
+	}
+
+	want := []string{"Claim alice", "Close"}
+	if calls := device.Calls(); !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestFingerprintCancelOnPassword(t *testing.T) {
+	device := newFakeFprint()
+	h := &LockHelper{
+		authenticator:   &PamAuthenticator{username: "alice"},
+		config:          Configuration{FingerprintEnabled: true},
+		openFingerprint: func() (fprintDevice, error) { return device, nil },
+	}
+
+	events := h.StartFingerprint()
+	if events == nil || !h.FingerprintActive() {
+		t.Fatal("fingerprint verification didn't start")
+	}
+
+	// The password unlocked the session first
+	h.StopFingerprint()
+	h.StopFingerprint()
+	if h.FingerprintActive() {
+		t.Error("fingerprint verification still active after stopping")
+	}
+	device.waitClosed(t)
+
+	want := []string{"Claim alice", "VerifyStart", "VerifyStop", "Release", "Close"}
+	if calls := device.Calls(); !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+
+	// A late scan is no longer read
+	select {
+	case device.statuses <- fprintStatus{Result: "verify-match", Done: true}:
+		t.Error("stopped verifier read a status")
+	case <-time.After(50 * time.Millisecond):
+	}
+	select {
+	case event := <-events:
+		t.Errorf("stopped verifier sent %+v", event)
+	default:
+	}
+}
+
+func TestFingerprintStopWhileStarting(t *testing.T) {
+	device := newFakeFprint()
+	opening := make(chan struct{})
+	proceed := make(chan struct{})
+	h := &LockHelper{
+		authenticator: &PamAuthenticator{username: "alice"},
+		config:        Configuration{FingerprintEnabled: true},
+		openFingerprint: func() (fprintDevice, error) {
+			close(opening)
+			<-proceed
+			return device, nil
+		},
+	}
+
+	started := make(chan (<-chan FingerprintEvent))
+	go func() { started <- h.StartFingerprint() }()
+
+	// The lock ended while fprintd was still being asked for the reader
+	<-opening
+	h.StopFingerprint()
+	close(proceed)
+
+	if events := <-started; events != nil {
+		t.Error("verification started after it was stopped")
+	}
+	if h.FingerprintActive() {
+		t.Error("fingerprint verification active after stopping")
+	}
+	device.waitClosed(t)
+
+	want := []string{"Claim alice", "VerifyStart", "VerifyStop", "Release", "Close"}
+	if calls := device.Calls(); !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
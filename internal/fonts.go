@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// fontChain is the list of fonts text is drawn with. Each character comes
+// from the first font that has a glyph for it, the embedded DejaVu Sans Bold
+// is always last.
+type fontChain struct {
+	fonts []*opentype.Font
+	buf   sfnt.Buffer
+	found map[rune]int // Font of each character looked up so far
+}
+
+// newFontChain loads the fonts named by specs, each a font file or a
+// fontconfig family name. Fonts that can't be loaded are skipped.
+func newFontChain(specs []string) *fontChain {
+	chain := &fontChain{found: make(map[rune]int)}
+	for _, spec := range specs {
+		if spec == "" {
+			continue
+		}
+		ttf, err := loadFont(spec)
+		if err != nil {
+			Warn("Skipping font: %v", err)
+			continue
+		}
+		chain.fonts = append(chain.fonts, ttf)
+	}
+
+	ttf, err := opentype.Parse(fontBytes)
+	if err != nil {
+		Error("Failed to parse embedded font: %v", err)
+	} else {
+		chain.fonts = append(chain.fonts, ttf)
+	}
+	if len(chain.fonts) == 0 {
+		Error("No font could be loaded, text will be missing")
+	}
+	return chain
+}
+
+// isFontFile reports whether spec names a font file rather than a family
+func isFontFile(spec string) bool {
+	switch strings.ToLower(filepath.Ext(spec)) {
+	case ".ttf", ".otf", ".ttc", ".otc":
+		return true
+	}
+	return strings.ContainsRune(spec, os.PathSeparator)
+}
+
+// loadFont loads a font file, or asks fc-match for the file of a family
+func loadFont(spec string) (*opentype.Font, error) {
+	if isFontFile(spec) {
+		path := spec
+		if !filepath.IsAbs(path) {
+			// Like background images, fonts may sit next to the themes
+			path = filepath.Join(userThemeDir(), path)
+		}
+		return loadFontFile(path, 0)
+	}
+
+	out, err := exec.Command("fc-match", "--format=%{file}\n%{index}", spec).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up font %q: %v", spec, err)
+	}
+	path, index, _ := strings.Cut(string(out), "\n")
+	if path == "" {
+		return nil, fmt.Errorf("no font found for %q", spec)
+	}
+	i, _ := strconv.Atoi(strings.TrimSpace(index))
+
+	ttf, err := loadFontFile(path, i)
+	if err != nil {
+		return nil, err
+	}
+	Debug("Using font %s for %q", path, spec)
+	return ttf, nil
+}
+
+// loadFontFile parses the font at index of a TrueType or OpenType file or
+// collection
+func loadFontFile(path string, index int) (*opentype.Font, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read font %q: %v", path, err)
+	}
+	collection, err := opentype.ParseCollection(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse font %q: %v", path, err)
+	}
+	ttf, err := collection.Font(index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse font %q: %v", path, err)
+	}
+	return ttf, nil
+}
+
+// fontFor returns the index of the first font with a glyph for r, or 0 if
+// none has one, so the first font's missing glyph box is drawn
+func (c *fontChain) fontFor(r rune) int {
+	if i, ok := c.found[r]; ok {
+		return i
+	}
+
+	found := 0
+	for i, f := range c.fonts {
+		if index, err := f.GlyphIndex(&c.buf, r); err == nil && index != 0 {
+			found = i
+			break
+		}
+	}
+	c.found[r] = found
+	return found
+}
+
+// glyphKey identifies a glyph of a chainFace: a character of one font
+type glyphKey struct {
+	font int
+	r    rune
+}
+
+// glyph is a rasterized glyph
+type glyph struct {
+	mask    *image.Alpha    // Coverage, nil for glyphs without ink like spaces
+	bounds  image.Rectangle // Where mask goes relative to the dot
+	advance fixed.Int26_6
+}
+
+// chainFace is a fontChain at one size. It rasterizes each glyph once and
+// draws it from the cache from then on.
+type chainFace struct {
+	chain  *fontChain
+	faces  []font.Face
+	glyphs map[glyphKey]*glyph
+}
+
+// newChainFace creates the faces of every font in chain at size
+func newChainFace(chain *fontChain, size float64) (*chainFace, error) {
+	if len(chain.fonts) == 0 {
+		return nil, fmt.Errorf("no fonts")
+	}
+
+	cf := &chainFace{chain: chain, glyphs: make(map[glyphKey]*glyph)}
+	for _, f := range chain.fonts {
+		face, err := opentype.NewFace(f, &opentype.FaceOptions{
+			Size:    size,
+			DPI:     72,
+			Hinting: font.HintingFull,
+		})
+		if err != nil {
+			return nil, err
+		}
+		cf.faces = append(cf.faces, face)
+	}
+	return cf, nil
+}
+
+// Metrics returns the metrics of the first font, which sets the line height
+func (cf *chainFace) Metrics() font.Metrics {
+	return cf.faces[0].Metrics()
+}
+
+// glyph returns the glyph of r in the font of the chain that has one
+func (cf *chainFace) glyph(r rune) (glyphKey, *glyph) {
+	key := glyphKey{font: cf.chain.fontFor(r), r: r}
+	if g, ok := cf.glyphs[key]; ok {
+		return key, g
+	}
+
+	g := &glyph{}
+	dr, mask, maskp, advance, ok := cf.faces[key.font].Glyph(fixed.Point26_6{}, r)
+	if ok {
+		g.advance = advance
+		if !dr.Empty() {
+			// The face reuses its mask for the next glyph, so keep a copy
+			g.mask = image.NewAlpha(image.Rect(0, 0, dr.Dx(), dr.Dy()))
+			draw.Draw(g.mask, g.mask.Bounds(), mask, maskp, draw.Src)
+			g.bounds = dr
+		}
+	}
+	cf.glyphs[key] = g
+	return key, g
+}
+
+// kern returns the kerning between two glyphs, which only fonts have
+// between their own glyphs
+func (cf *chainFace) kern(prev, next glyphKey) fixed.Int26_6 {
+	if prev.font != next.font {
+		return 0
+	}
+	return cf.faces[next.font].Kern(prev.r, next.r)
+}
+
+// Measure returns the advance width of text
+func (cf *chainFace) Measure(text string) fixed.Int26_6 {
+	var width fixed.Int26_6
+	prev := glyphKey{font: -1}
+	for _, r := range text {
+		key, g := cf.glyph(r)
+		width += cf.kern(prev, key) + g.advance
+		prev = key
+	}
+	return width
+}
+
+// Draw draws text in the order given with its origin at dot in color src
+// and returns the area it covers
+func (cf *chainFace) Draw(img draw.Image, src image.Image, dot fixed.Point26_6, text string) image.Rectangle {
+	var area image.Rectangle
+	prev := glyphKey{font: -1}
+	for _, r := range text {
+		key, g := cf.glyph(r)
+		dot.X += cf.kern(prev, key)
+		prev = key
+
+		if g.mask != nil {
+			dr := g.bounds.Add(image.Pt(dot.X.Round(), dot.Y.Round()))
+			draw.DrawMask(img, dr, src, image.Point{}, g.mask, image.Point{}, draw.Over)
+			area = area.Union(dr)
+		}
+		dot.X += g.advance
+	}
+	return area
+}
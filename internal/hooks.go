@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Hook points in the lock lifecycle
+const (
+	HookOnLock        = "on_lock"         // Before the screen is locked
+	HookOnLocked      = "on_locked"       // Once the lock is in place
+	HookOnUnlock      = "on_unlock"       // After the screen is unlocked
+	HookOnAuthFailure = "on_auth_failure" // After a failed unlock attempt
+	HookOnLockout     = "on_lockout"      // When a lockout starts
+	HookOnIdle        = "on_idle"         // When nobody touched the lock screen for a while
+	HookOnResume      = "on_resume"       // When the system resumes from suspend while locked
+	HookOnDuress      = "on_duress"       // When the duress password unlocks the session
+)
+
+// hookPoints lists every valid hook name
+var hookPoints = []string{
+	HookOnLock, HookOnLocked, HookOnUnlock, HookOnAuthFailure,
+	HookOnLockout, HookOnIdle, HookOnResume, HookOnDuress,
+}
+
+// defaultHookTimeout is used for hooks without an explicit timeout
+const defaultHookTimeout = 30 * time.Second
+
+// HookConfig describes one command attached to a hook point
+type HookConfig struct {
+	// Shell command to run
+	Command string `json:"command"`
+
+	// Kill the command after this many seconds (0 uses the default of 30)
+	TimeoutSeconds int `json:"timeout_seconds"`
+
+	// Run in the background instead of waiting for the command to finish
+	Async bool `json:"async"`
+}
+
+// HookEnv describes the event a hook runs for. It's passed to the command
+// as FANCYLOCK_* environment variables.
+type HookEnv struct {
+	User           string // User involved in the event, if any
+	Attempts       int    // Failed attempts during this lock session
+	LockoutSeconds int    // Length of the lockout that just started
+}
+
+// validateHooks checks the configured hooks for unknown names and empty commands
+func validateHooks(hooks map[string][]HookConfig) error {
+	for name, list := range hooks {
+		known := false
+		for _, point := range hookPoints {
+			if name == point {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown hook %q", name)
+		}
+
+		for i, hook := range list {
+			if strings.TrimSpace(hook.Command) == "" {
+				return fmt.Errorf("hook %s #%d has no command", name, i+1)
+			}
+			if hook.TimeoutSeconds < 0 {
+				return fmt.Errorf("hook %s #%d has a negative timeout", name, i+1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configuredHooks returns the hooks for a hook point, including the
+// deprecated pre/post lock commands
+func (h *LockHelper) configuredHooks(name string) []HookConfig {
+	hooks := h.config.Hooks[name]
+
+	switch name {
+	case HookOnLock:
+		if h.config.PreLockCommand != "" {
+			hooks = append([]HookConfig{{Command: h.config.PreLockCommand}}, hooks...)
+		}
+	case HookOnUnlock:
+		if h.config.PostLockCommand != "" {
+			hooks = append([]HookConfig{{Command: h.config.PostLockCommand}}, hooks...)
+		}
+	}
+
+	return hooks
+}
+
+// HasHooks returns whether anything is attached to a hook point
+func (h *LockHelper) HasHooks(name string) bool {
+	return len(h.configuredHooks(name)) > 0
+}
+
+// RunHook runs every command attached to a hook point. It returns once
+// the commands that aren't async are done.
+func (h *LockHelper) RunHook(name string, env HookEnv) {
+	hooks := h.configuredHooks(name)
+	if len(hooks) == 0 {
+		return
+	}
+	h.hooks.Add(1)
+	defer h.hooks.Done()
+
+	vars := []string{
+		"FANCYLOCK_HOOK=" + name,
+		"FANCYLOCK_SESSION_USER=" + h.authenticator.username,
+		fmt.Sprintf("FANCYLOCK_ATTEMPTS=%d", env.Attempts),
+		fmt.Sprintf("FANCYLOCK_LOCKOUT_SECONDS=%d", env.LockoutSeconds),
+	}
+	if env.User != "" {
+		vars = append(vars, "FANCYLOCK_USER="+env.User)
+	}
+	if !h.lockedAt.IsZero() {
+		vars = append(vars, fmt.Sprintf("FANCYLOCK_SESSION_SECONDS=%d", int(time.Since(h.lockedAt).Seconds())))
+	}
+
+	for i, hook := range hooks {
+		if hook.Async {
+			Debug("Starting async %s hook #%d", name, i+1)
+			h.hooks.Add(1)
+			go func() {
+				defer h.hooks.Done()
+				runHookCommand(name, i+1, hook, vars)
+			}()
+			continue
+		}
+		Debug("Running %s hook #%d", name, i+1)
+		runHookCommand(name, i+1, hook, vars)
+	}
+}
+
+// StartHook runs a hook point's commands on their own goroutine, so the
+// event loop keeps drawing and reading input while they run
+func (h *LockHelper) StartHook(name string, env HookEnv) {
+	h.inBackground(func() {
+		h.RunHook(name, env)
+	})
+}
+
+// StartFailureHooks runs the on_auth_failure hooks for a failed attempt
+// by username, then the on_lockout hooks if it started a lockout
+func (h *LockHelper) StartFailureHooks(username string, lockout bool, duration time.Duration) {
+	attempts := h.away.Failures()
+	h.inBackground(func() {
+		h.RunHook(HookOnAuthFailure, HookEnv{User: username, Attempts: attempts})
+		if lockout {
+			h.RunHook(HookOnLockout, HookEnv{
+				Attempts:       attempts,
+				LockoutSeconds: int(duration.Round(time.Second).Seconds()),
+			})
+		}
+	})
+}
+
+// inBackground runs fn on its own goroutine and has WaitHooks wait for it.
+// Hooks that must run in order go in the same fn.
+func (h *LockHelper) inBackground(fn func()) {
+	h.hooks.Add(1)
+	go func() {
+		defer h.hooks.Done()
+		fn()
+	}()
+}
+
+// WaitHooks waits for the hooks still running, so exiting after an unlock
+// doesn't kill them. Every command is killed after its timeout, the wait
+// gives up a little later in case one can't be killed.
+func (h *LockHelper) WaitHooks() {
+	done := make(chan struct{})
+	go func() {
+		h.hooks.Wait()
+		close(done)
+	}()
+
+	limit := h.longestHookTimeout() + 2*time.Second
+	select {
+	case <-done:
+	case <-time.After(limit):
+		Warn("Hooks still running after %v, not waiting for them", limit)
+	}
+}
+
+// longestHookTimeout returns the longest timeout of the configured hooks
+func (h *LockHelper) longestHookTimeout() time.Duration {
+	var longest time.Duration
+	for _, point := range hookPoints {
+		for _, hook := range h.configuredHooks(point) {
+			longest = max(longest, hookTimeout(hook))
+		}
+	}
+	return longest
+}
+
+// hookTimeout returns how long a hook command may run
+func hookTimeout(hook HookConfig) time.Duration {
+	if hook.TimeoutSeconds > 0 {
+		return time.Duration(hook.TimeoutSeconds) * time.Second
+	}
+	return defaultHookTimeout
+}
+
+// runHookCommand runs a single hook command and logs its output
+func runHookCommand(name string, index int, hook HookConfig, vars []string) {
+	timeout := hookTimeout(hook)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", strings.TrimSpace(hook.Command))
+	cmd.Env = append(os.Environ(), vars...)
+
+	// Run in its own process group so a timeout kills everything it started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	start := time.Now()
+	err := cmd.Run()
+
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		Info("Hook %s #%d: %s", name, index, scanner.Text())
+	}
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		Error("Hook %s #%d timed out after %v", name, index, timeout)
+	case err != nil:
+		Error("Hook %s #%d failed: %v", name, index, err)
+	default:
+		Debug("Hook %s #%d finished in %v", name, index, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// NoteActivity tells the idle watcher that someone used the lock screen
+func (h *LockHelper) NoteActivity() {
+	select {
+	case h.activity <- struct{}{}:
+	default:
+	}
+}
+
+// StartSessionWatchers starts watching for idle time and system resume
+// to run the on_idle and on_resume hooks
+func (h *LockHelper) StartSessionWatchers() {
+	if h.stopWatchers != nil {
+		return
+	}
+	stop := make(chan struct{})
+	h.stopWatchers = stop
+
+	if h.HasHooks(HookOnIdle) && h.config.IdleSeconds > 0 {
+		go h.watchIdle(stop)
+	}
+
+	if h.HasHooks(HookOnResume) {
+		go h.watchResume(stop)
+	}
+}
+
+// StopSessionWatchers stops the watchers started by StartSessionWatchers
+func (h *LockHelper) StopSessionWatchers() {
+	if h.stopWatchers != nil {
+		close(h.stopWatchers)
+		h.stopWatchers = nil
+	}
+}
+
+// watchIdle runs the on_idle hook once nobody touched the lock screen for IdleSeconds
+func (h *LockHelper) watchIdle(stop chan struct{}) {
+	idleTime := time.Duration(h.config.IdleSeconds) * time.Second
+	timer := time.NewTimer(idleTime)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-h.activity:
+			timer.Reset(idleTime)
+		case <-timer.C:
+			Debug("Lock screen idle for %v", idleTime)
+			h.RunHook(HookOnIdle, HookEnv{Attempts: h.away.Failures()})
+			// Fire again only after the next round of activity
+			select {
+			case <-stop:
+				return
+			case <-h.activity:
+				timer.Reset(idleTime)
+			}
+		}
+	}
+}
+
+// watchResume runs the on_resume hook when logind reports the end of a suspend
+func (h *LockHelper) watchResume(stop chan struct{}) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		Error("Failed to connect to system bus for resume events: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	err = conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.login1.Manager"),
+		dbus.WithMatchMember("PrepareForSleep"),
+	)
+	if err != nil {
+		Error("Failed to subscribe to sleep events: %v", err)
+		return
+	}
+
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case signal := <-signals:
+			if signal == nil || len(signal.Body) == 0 {
+				continue
+			}
+			// PrepareForSleep(false) is sent once the system is back up
+			if sleeping, ok := signal.Body[0].(bool); ok && !sleeping {
+				Debug("System resumed from suspend")
+				h.RunHook(HookOnResume, HookEnv{Attempts: h.away.Failures()})
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// hookHelper returns a LockHelper with the given hooks configured
+func hookHelper(hooks map[string][]HookConfig) *LockHelper {
+	return &LockHelper{
+		authenticator: &PamAuthenticator{username: "alice"},
+		config:        Configuration{Hooks: hooks},
+	}
+}
+
+func TestStartHookDoesNotBlock(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	h := hookHelper(map[string][]HookConfig{
+		HookOnLocked: {{Command: "sleep 0.3; touch " + marker}},
+	})
+
+	start := time.Now()
+	h.StartHook(HookOnLocked, HookEnv{})
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("StartHook blocked for %v", elapsed)
+	}
+
+	h.WaitHooks()
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("hook didn't finish before WaitHooks returned: %v", err)
+	}
+}
+
+func TestWaitHooksWaitsForAsyncHooks(t *testing.T) {
+	dir := t.TempDir()
+	h := hookHelper(map[string][]HookConfig{
+		HookOnAuthFailure: {{Command: "sleep 0.2; echo $FANCYLOCK_USER > " + filepath.Join(dir, "failure"), Async: true}},
+		HookOnLockout:     {{Command: "echo $FANCYLOCK_LOCKOUT_SECONDS > " + filepath.Join(dir, "lockout")}},
+	})
+
+	h.StartFailureHooks("bob", true, 30*time.Second)
+	h.WaitHooks()
+
+	for name, want := range map[string]string{"failure": "bob\n", "lockout": "30\n"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s hook didn't finish: %v", name, err)
+		} else if string(got) != want {
+			t.Errorf("%s hook wrote %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestWaitHooksGivesUp(t *testing.T) {
+	h := hookHelper(map[string][]HookConfig{
+		HookOnIdle: {{Command: "true", TimeoutSeconds: 1}},
+	})
+
+	// Stands in for a command that can't be killed
+	release := make(chan struct{})
+	defer close(release)
+	h.inBackground(func() { <-release })
+
+	start := time.Now()
+	h.WaitHooks()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("WaitHooks waited %v", elapsed)
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
-	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unsafe"
 
+	"github.com/godbus/dbus/v5"
 	"github.com/msteinert/pam"
 )
 
@@ -28,13 +31,17 @@ func NewPamAuthenticator(config Configuration) *PamAuthenticator {
 }
 
 // Authenticate attempts to authenticate with the given password
-func (a *PamAuthenticator) Authenticate(password string) AuthResult {
+func (a *PamAuthenticator) Authenticate(password []byte) AuthResult {
 	// Define the conversation function that provides the password
 	conv := func(style pam.Style, msg string) (string, error) {
 		switch style {
 		case pam.PromptEchoOff:
-			// Return the password for authentication prompt
-			return password, nil
+			// Return the password for authentication prompt. The string
+			// aliases the caller's buffer, so no Go copy is left behind.
+			if len(password) == 0 {
+				return "", nil
+			}
+			return unsafe.String(&password[0], len(password)), nil
 		case pam.PromptEchoOn:
 			// Ignore username prompts as we already provided it
 			return "", nil
@@ -55,8 +62,9 @@ func (a *PamAuthenticator) Authenticate(password string) AuthResult {
 	t, err := pam.StartFunc(a.serviceName, a.username, conv)
 	if err != nil {
 		return AuthResult{
-			Success: false,
-			Message: fmt.Sprintf("Failed to start PAM transaction: %v", err),
+			Success:    false,
+			Message:    fmt.Sprintf("Failed to start PAM transaction: %v", err),
+			ErrorClass: fmt.Sprintf("start: %v", err),
 		}
 	}
 
@@ -64,8 +72,9 @@ func (a *PamAuthenticator) Authenticate(password string) AuthResult {
 	err = t.Authenticate(0)
 	if err != nil {
 		return AuthResult{
-			Success: false,
-			Message: fmt.Sprintf("Authentication failed: %v", err),
+			Success:    false,
+			Message:    fmt.Sprintf("Authentication failed: %v", err),
+			ErrorClass: fmt.Sprintf("authenticate: %v", err),
 		}
 	}
 
@@ -73,8 +82,9 @@ func (a *PamAuthenticator) Authenticate(password string) AuthResult {
 	err = t.AcctMgmt(0)
 	if err != nil {
 		return AuthResult{
-			Success: false,
-			Message: fmt.Sprintf("Account validation failed: %v", err),
+			Success:    false,
+			Message:    fmt.Sprintf("Account validation failed: %v", err),
+			ErrorClass: fmt.Sprintf("account: %v", err),
 		}
 	}
 
@@ -89,9 +99,23 @@ func (a *PamAuthenticator) Authenticate(password string) AuthResult {
 
 // LockHelper handles screen locking operations
 type LockHelper struct {
-	authenticator *PamAuthenticator
-	config        Configuration
-	mediaCtrl     *MediaController
+	authenticator   *PamAuthenticator
+	config          Configuration
+	mediaCtrl       *MediaController
+	audit           *AuditLogger
+	lockedAt        time.Time                    // When the current lock session started
+	away            AwaySummary                  // Failed attempts and lockouts of the current session
+	busConn         *dbus.Conn                   // Session bus for notifications when there's no media controller
+	activity        chan struct{}                // Input on the lock screen, for the idle watcher
+	stopWatchers    chan struct{}                // Closed to stop the idle and resume watchers
+	duress          *DuressHash                  // Duress password, nil when not configured
+	duressPending   bool                         // Whether the duress password is waiting for its TOTP code
+	fingerprintMu   sync.Mutex                   // Guards fingerprint and fingerprintRun
+	fingerprint     *FingerprintVerifier         // Running fprintd verification, if any
+	fingerprintRun  int                          // Counts stops, so a start still claiming the reader gives up
+	openFingerprint func() (fprintDevice, error) // Connects to the fingerprint reader
+	unlockDevices   *USBMonitor                  // Tracks the trusted USB devices while locked
+	hooks           sync.WaitGroup               // Hook commands still running, see WaitHooks
 }
 
 // NewLockHelper creates a new helper instance with the given configuration
@@ -116,29 +140,24 @@ func NewLockHelper(config Configuration) *LockHelper {
 		Debug("Media control is disabled, skipping media controller initialization")
 	}
 
-	return &LockHelper{
-		authenticator: auth,
-		config:        config,
-		mediaCtrl:     mediaCtrl,
+	var duress *DuressHash
+	if config.DuressPasswordHash != "" {
+		var err error
+		duress, err = ParseDuressHash(config.DuressPasswordHash)
+		if err != nil {
+			Error("Ignoring duress password: %v", err)
+		}
 	}
-}
 
-// RunPreLockCommand runs the configured pre-lock command (if any)
-func (h *LockHelper) RunPreLockCommand() error {
-	if h.config.PreLockCommand == "" {
-		return nil
-	}
-	Debug("Running pre-lock command: %s", h.config.PreLockCommand)
-	return runShellCommand(h.config.PreLockCommand)
-}
-
-// RunPostLockCommand runs the configured post-lock command (if any)
-func (h *LockHelper) RunPostLockCommand() error {
-	if h.config.PostLockCommand == "" {
-		return nil
+	return &LockHelper{
+		authenticator:   auth,
+		config:          config,
+		mediaCtrl:       mediaCtrl,
+		audit:           NewAuditLogger(config),
+		activity:        make(chan struct{}, 1),
+		duress:          duress,
+		openFingerprint: openFprintd,
 	}
-	Debug("Running post-lock command: %s", h.config.PostLockCommand)
-	return runShellCommand(h.config.PostLockCommand)
 }
 
 // CheckUserPermissions verifies that the user has the necessary permissions
@@ -217,62 +236,6 @@ func (h *LockHelper) RunCommand(command string, args ...string) (string, error)
 	return string(output), nil
 }
 
-// NewSecurePassword creates a new secure password container
-func NewSecurePassword() *SecurePassword {
-	return &SecurePassword{
-		data: make([]byte, 0, 64),
-	}
-}
-
-// Append adds a character to the password
-func (p *SecurePassword) Append(char byte) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.data = append(p.data, char)
-}
-
-// RemoveLast removes the last character from the password
-func (p *SecurePassword) RemoveLast() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if len(p.data) > 0 {
-		// Zero out the last byte before removing it
-		p.data[len(p.data)-1] = 0
-		p.data = p.data[:len(p.data)-1]
-	}
-}
-
-// Clear securely wipes the password data
-func (p *SecurePassword) Clear() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	// Zero out the memory before resetting
-	for i := range p.data {
-		p.data[i] = 0
-	}
-	p.data = p.data[:0]
-}
-
-// String returns the password as a string (use carefully)
-func (p *SecurePassword) String() string {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	// Create a temporary string for authentication
-	return string(p.data)
-}
-
-// Length returns the password length
-func (p *SecurePassword) Length() int {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	return len(p.data)
-}
-
-// runShellCommand executes a shell command string
-func runShellCommand(cmd string) error {
-	return exec.Command("sh", "-c", strings.TrimSpace(cmd)).Run()
-}
-
 // PauseMediaIfEnabled pauses all media if enabled in config
 func (h *LockHelper) PauseMediaIfEnabled() error {
 	if !h.config.LockPauseMedia {
@@ -305,9 +268,19 @@ func (h *LockHelper) UnpauseMediaIfEnabled() error {
 	return h.mediaCtrl.UnpauseAllMedia()
 }
 
-// Close cleans up resources
+// Close stops the watchers and closes the D-Bus connections. The lockers
+// call it when Lock returns, so a daemon that locks many times doesn't
+// collect connections and goroutines.
 func (h *LockHelper) Close() {
+	h.StopSessionWatchers()
+	h.StopFingerprint()
+	h.StopUnlockDeviceWatch()
 	if h.mediaCtrl != nil {
 		h.mediaCtrl.Close()
+		h.mediaCtrl = nil
+	}
+	if h.busConn != nil {
+		h.busConn.Close()
+		h.busConn = nil
 	}
 }
@@ -2,42 +2,131 @@ package internal
 
 import (
 	"fmt"
+	"os"
 	"time"
 )
 
+// Lockout backoff curves
+const (
+	BackoffFixed       = "fixed"
+	BackoffLinear      = "linear"
+	BackoffExponential = "exponential"
+)
+
 // LockoutManager handles authentication failures and lockout periods
 type LockoutManager struct {
 	failedAttempts  int           // Count of failed authentication attempts
+	lockoutCount    int           // Number of lockouts since the last reset
 	lockoutUntil    time.Time     // Time until which input is locked out
 	lockoutActive   bool          // Whether a lockout is currently active
 	lastFailureTime time.Time     // Time of the last failed attempt
 	config          Configuration // Application configuration
 	timerRunning    bool          // Track if the countdown timer is already running
+	username        string        // User whose pam_faillock tally is checked
+	faillockLocked  bool          // Whether the current lockout comes from pam_faillock
+	faillockUntil   time.Time     // When pam_faillock unlocks, zero if it needs a reset
+}
+
+// DefaultLockoutPolicy returns the lockout policy used when none is configured
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxAttempts:        3,
+		Backoff:            BackoffLinear,
+		LockoutSeconds:     30,
+		MaxLockoutSeconds:  600,
+		CountEmptyAttempts: true,
+		ResetAfterSeconds:  0, // Never forget failed attempts by default
+	}
+}
+
+// validateLockoutPolicy checks if the lockout policy is usable
+func validateLockoutPolicy(policy LockoutPolicy) error {
+	if policy.MaxAttempts <= 0 {
+		return fmt.Errorf("lockout max_attempts must be positive")
+	}
+
+	switch policy.Backoff {
+	case BackoffFixed, BackoffLinear, BackoffExponential:
+	default:
+		return fmt.Errorf("unknown lockout backoff %q", policy.Backoff)
+	}
+
+	if policy.LockoutSeconds <= 0 {
+		return fmt.Errorf("lockout lockout_seconds must be positive")
+	}
+
+	if policy.MaxLockoutSeconds < policy.LockoutSeconds {
+		return fmt.Errorf("lockout max_lockout_seconds must not be less than lockout_seconds")
+	}
+
+	if policy.ResetAfterSeconds < 0 {
+		return fmt.Errorf("lockout reset_after_seconds must not be negative")
+	}
+
+	return nil
 }
 
-// NewLockoutManager creates a new lockout manager with the given configuration
+// NewLockoutManager creates a new lockout manager with the given configuration.
+// Any lockout left over from a previous run is restored.
 func NewLockoutManager(config Configuration) *LockoutManager {
-	return &LockoutManager{
+	lm := &LockoutManager{
 		failedAttempts:  0,
 		lockoutActive:   false,
 		timerRunning:    false,
 		config:          config,
 		lastFailureTime: time.Now().Add(-24 * time.Hour), // Set to past to avoid initial penalty
+		username:        os.Getenv("USER"),
+	}
+	lm.restoreState()
+	lm.syncFaillock()
+	return lm
+}
+
+// lockoutDuration returns how long the given lockout (1 for the first) lasts
+func (lm *LockoutManager) lockoutDuration(lockoutNumber int) time.Duration {
+	policy := lm.config.Lockout
+	base := time.Duration(policy.LockoutSeconds) * time.Second
+	limit := time.Duration(policy.MaxLockoutSeconds) * time.Second
+
+	duration := base
+	switch policy.Backoff {
+	case BackoffLinear:
+		duration = base * time.Duration(lockoutNumber)
+	case BackoffExponential:
+		// Double for every lockout, stop shifting once we're past the cap
+		for i := 1; i < lockoutNumber && duration < limit; i++ {
+			duration *= 2
+		}
+	}
+
+	if duration > limit {
+		duration = limit
 	}
+	return duration
 }
 
 // HandleFailedAttempt processes a failed authentication and returns lockout information
 // Returns: lockoutActive (bool), lockoutDuration (time.Duration), remainingAttempts (int)
 func (lm *LockoutManager) HandleFailedAttempt() (bool, time.Duration, int) {
+	policy := lm.config.Lockout
+
+	// Forget old failures after a quiet period
+	if policy.ResetAfterSeconds > 0 &&
+		time.Since(lm.lastFailureTime) > time.Duration(policy.ResetAfterSeconds)*time.Second {
+		lm.failedAttempts = 0
+		lm.lockoutCount = 0
+	}
+
 	// Record the failure
 	lm.failedAttempts++
 	lm.lastFailureTime = time.Now()
 
-	Info("Authentication failed (%d/3 attempts)", lm.failedAttempts)
+	Info("Authentication failed (%d/%d attempts)", lm.failedAttempts, policy.MaxAttempts)
 
-	// If we've had 3+ failures, implement a lockout
-	if lm.failedAttempts >= 3 {
+	// If we've reached the attempt limit, implement a lockout
+	if lm.failedAttempts >= policy.MaxAttempts {
 		var lockoutDuration time.Duration
+		lm.lockoutCount++
 
 		// Check if we're in debug mode
 		if lm.config.DebugExit {
@@ -45,39 +134,52 @@ func (lm *LockoutManager) HandleFailedAttempt() (bool, time.Duration, int) {
 			lockoutDuration = 5 * time.Second
 			Info("Debug mode: Using shorter lockout duration of 5 seconds")
 		} else {
-			// Determine the lockout duration based on recent failures
-			// First lockout is 30 seconds, increases for subsequent lockouts
-			if !lm.lockoutActive {
-				// First lockout
-				lockoutDuration = 30 * time.Second
-			} else {
-				// Subsequent lockouts - increase duration but cap at 10 minutes
-				// Increase by 30 seconds each time, based on failed attempts / 3
-				lockoutDuration = 30 * time.Second * time.Duration(lm.failedAttempts/3)
-				if lockoutDuration > 10*time.Minute {
-					lockoutDuration = 10 * time.Minute
-				}
-			}
+			lockoutDuration = lm.lockoutDuration(lm.lockoutCount)
 		}
 
 		// Set the lockout time
 		lm.lockoutUntil = time.Now().Add(lockoutDuration)
 		lm.lockoutActive = true
 
-		Info("Failed %d attempts, locking out for %v", lm.failedAttempts, lockoutDuration)
+		Info("Failed %d attempts, locking out for %v (lockout #%d)", lm.failedAttempts, lockoutDuration, lm.lockoutCount)
 
 		// Reset counter after implementing lockout
-		remainingAttempts := 0
 		lm.failedAttempts = 0
+		lm.saveState()
 
-		return true, lockoutDuration, remainingAttempts
+		// pam_faillock may want an even longer lockout
+		lm.syncFaillock()
+		return true, time.Until(lm.lockoutUntil), 0
 	}
 
 	// Not locked out yet
-	remainingAttempts := 3 - lm.failedAttempts
+	lm.saveState()
+	remainingAttempts := policy.MaxAttempts - lm.failedAttempts
+
+	// Reconcile with pam_faillock, which may lock the account before we do
+	if status := lm.syncFaillock(); status != nil {
+		if status.Locked {
+			return true, time.Until(lm.lockoutUntil), 0
+		}
+		remainingAttempts = min(remainingAttempts, status.Remaining)
+	}
+
 	return false, 0, remainingAttempts
 }
 
+// CountsEmptyAttempts returns whether submitting an empty password is a failure
+func (lm *LockoutManager) CountsEmptyAttempts() bool {
+	return lm.config.Lockout.CountEmptyAttempts
+}
+
+// FormatRemainingAttempts returns a message telling the user how many attempts are left
+func FormatRemainingAttempts(remaining int) string {
+	if remaining == 1 {
+		return "1 attempt remaining"
+	}
+	return fmt.Sprintf("%d attempts remaining", remaining)
+}
+
 // IsLockedOut checks if authentication is currently locked out
 func (lm *LockoutManager) IsLockedOut() bool {
 	if lm.lockoutActive && time.Now().Before(lm.lockoutUntil) {
@@ -88,6 +190,7 @@ func (lm *LockoutManager) IsLockedOut() bool {
 	if lm.lockoutActive && time.Now().After(lm.lockoutUntil) {
 		Info("Lockout period has expired, clearing lockout state")
 		lm.lockoutActive = false
+		lm.faillockLocked = false
 	}
 
 	return false
@@ -119,8 +222,13 @@ func (lm *LockoutManager) FormatRemainingTime() string {
 // ResetLockout resets the lockout state (e.g., after successful authentication)
 func (lm *LockoutManager) ResetLockout() {
 	lm.failedAttempts = 0
+	lm.lockoutCount = 0
 	lm.lockoutActive = false
+	lm.lockoutUntil = time.Time{}
 	lm.timerRunning = false
+	lm.faillockLocked = false
+	lm.faillockUntil = time.Time{}
+	lm.saveState()
 }
 
 // GetLockoutUntil returns the time when the lockout ends
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// lockoutState is the part of the lockout manager that survives a restart
+type lockoutState struct {
+	FailedAttempts int       `json:"failed_attempts"`
+	LockoutCount   int       `json:"lockout_count"`
+	LockoutUntil   time.Time `json:"lockout_until"`
+	LastFailure    time.Time `json:"last_failure"`
+}
+
+// lockoutStateFile is the on-disk form of lockoutState with its MAC
+type lockoutStateFile struct {
+	State lockoutState `json:"state"`
+	MAC   string       `json:"mac"`
+}
+
+// errLockoutStateTampered is returned when the state file fails its integrity checks
+var errLockoutStateTampered = errors.New("lockout state failed integrity check")
+
+// lockoutStatePath returns the location of the persisted lockout state
+func lockoutStatePath() string {
+	return filepath.Join(stateDir(), "lockout.json")
+}
+
+// lockoutKeyPath returns the location of the key used to sign the lockout state
+func lockoutKeyPath() string {
+	return filepath.Join(stateDir(), "lockout.key")
+}
+
+// checkStateFilePermissions makes sure a state file belongs to us and that
+// nobody else can write to it
+func checkStateFilePermissions(path string, info os.FileInfo) error {
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by other users", path)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not owned by the current user", path)
+	}
+	return nil
+}
+
+// loadLockoutKey reads the signing key, creating it on first use
+func loadLockoutKey() ([]byte, error) {
+	path := lockoutKeyPath()
+
+	info, err := os.Stat(path)
+	if err == nil {
+		if err := checkStateFilePermissions(path, info); err != nil {
+			return nil, err
+		}
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read lockout key: %v", err)
+		}
+		if len(key) != sha256.Size {
+			return nil, fmt.Errorf("lockout key has unexpected size %d", len(key))
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to access lockout key: %v", err)
+	}
+
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate lockout key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write lockout key: %v", err)
+	}
+	return key, nil
+}
+
+// signLockoutState computes the MAC of a lockout state
+func signLockoutState(key []byte, state lockoutState) (string, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal lockout state: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// loadLockoutState reads the persisted lockout state. It returns nil without
+// an error if no state has been saved yet. The key is created together with
+// the first state, so a missing state next to an existing key means the state
+// was deleted.
+func loadLockoutState() (*lockoutState, error) {
+	path := lockoutStatePath()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(lockoutKeyPath()); err == nil {
+			return nil, fmt.Errorf("%w: %s was removed", errLockoutStateTampered, path)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to access lockout state: %v", err)
+	}
+	if err := checkStateFilePermissions(path, info); err != nil {
+		return nil, fmt.Errorf("%w: %v", errLockoutStateTampered, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockout state: %v", err)
+	}
+
+	var file lockoutStateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %v", errLockoutStateTampered, err)
+	}
+
+	key, err := loadLockoutKey()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errLockoutStateTampered, err)
+	}
+
+	expected, err := signLockoutState(key, file.State)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(expected), []byte(file.MAC)) {
+		return nil, errLockoutStateTampered
+	}
+
+	return &file.State, nil
+}
+
+// saveLockoutState atomically writes the lockout state to disk
+func saveLockoutState(state lockoutState) error {
+	key, err := loadLockoutKey()
+	if err != nil {
+		return err
+	}
+
+	mac, err := signLockoutState(key, state)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(lockoutStateFile{State: state, MAC: mac})
+	if err != nil {
+		return fmt.Errorf("failed to marshal lockout state: %v", err)
+	}
+
+	return writeFileAtomic(lockoutStatePath(), data)
+}
+
+// writeFileAtomic replaces path with data through a private temporary file,
+// so readers never see a partial write
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %v", path, err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// restoreState continues the lockout and attempt count of a previous run
+func (lm *LockoutManager) restoreState() {
+	state, err := loadLockoutState()
+	if err == nil && state == nil && auditShowsPendingFailures(lm.config, lm.username) {
+		// Every failure saves the state, so it can't be missing after one
+		err = fmt.Errorf("%w: %s and its key were removed after a failed attempt",
+			errLockoutStateTampered, lockoutStatePath())
+	}
+	if errors.Is(err, errLockoutStateTampered) {
+		// Fail closed: somebody edited or replaced the file, treat it as a lockout
+		Error("Lockout state was tampered with (%v), starting a lockout", err)
+		NewAuditLogger(lm.config).Log(AuditEntry{
+			Event:       AuditEventTampering,
+			SessionUser: lm.username,
+			Message:     fmt.Sprintf("Lockout state was tampered with: %v", err),
+		})
+		lm.lockoutCount = 1
+		lm.lockoutUntil = time.Now().Add(lm.lockoutDuration(lm.lockoutCount))
+		lm.lockoutActive = true
+		lm.saveState()
+		return
+	}
+	if err != nil {
+		Error("Failed to load lockout state: %v", err)
+		return
+	}
+	if state == nil {
+		Debug("No saved lockout state found")
+		return
+	}
+
+	lm.failedAttempts = state.FailedAttempts
+	lm.lockoutCount = state.LockoutCount
+	lm.lastFailureTime = state.LastFailure
+
+	// Don't let a clock change or a bad file extend a lockout past the policy cap
+	lockoutUntil := state.LockoutUntil
+	maxUntil := time.Now().Add(time.Duration(lm.config.Lockout.MaxLockoutSeconds) * time.Second)
+	if lockoutUntil.After(maxUntil) {
+		lockoutUntil = maxUntil
+	}
+	lm.lockoutUntil = lockoutUntil
+	lm.lockoutActive = time.Now().Before(lockoutUntil)
+
+	Info("Restored lockout state: %d failed attempts, %d lockouts, locked out: %v",
+		lm.failedAttempts, lm.lockoutCount, lm.lockoutActive)
+}
+
+// auditShowsPendingFailures reports whether the audit log file records a
+// failed attempt or lockout of username that no unlock followed. Only the
+// file can be read back, with the journal alone this is always false.
+func auditShowsPendingFailures(config Configuration, username string) bool {
+	if config.AuditLog == AuditLogJournal || config.AuditLog == AuditLogNone {
+		return false
+	}
+
+	path := auditLogPath(config)
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	entries, err := ReadAuditLog(path)
+	if err != nil {
+		Debug("Unable to check the audit log for failed attempts: %v", err)
+		return false
+	}
+
+	pending := false
+	for _, entry := range entries {
+		if entry.SessionUser != username {
+			continue
+		}
+		switch entry.Event {
+		case AuditEventAuthFailure, AuditEventLockout:
+			pending = true
+		case AuditEventLockEnd:
+			pending = false
+		}
+	}
+	return pending
+}
+
+// saveState persists the current lockout state
+func (lm *LockoutManager) saveState() {
+	err := saveLockoutState(lockoutState{
+		FailedAttempts: lm.failedAttempts,
+		LockoutCount:   lm.lockoutCount,
+		LockoutUntil:   lm.lockoutUntil,
+		LastFailure:    lm.lastFailureTime,
+	})
+	if err != nil {
+		Error("Failed to save lockout state: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// lockoutTestConfig points the lockout state and audit log at a temporary
+// directory and returns a config with the default policy
+func lockoutTestConfig(t *testing.T) Configuration {
+	t.Helper()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("USER", "alice")
+	return Configuration{Lockout: DefaultLockoutPolicy(), AuditLog: AuditLogFile}
+}
+
+// tamperingAudited reports whether the audit log records tampering
+func tamperingAudited(t *testing.T, config Configuration) bool {
+	t.Helper()
+	entries, err := ReadAuditLog(auditLogPath(config))
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if entry.Event == AuditEventTampering {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLockoutStateSurvivesRestart(t *testing.T) {
+	config := lockoutTestConfig(t)
+
+	lm := NewLockoutManager(config)
+	lm.HandleFailedAttempt()
+	lm.HandleFailedAttempt()
+
+	restored := NewLockoutManager(config)
+	if restored.failedAttempts != 2 || restored.IsLockedOut() {
+		t.Errorf("restored %d failed attempts, locked out %v, want 2 and not locked out",
+			restored.failedAttempts, restored.IsLockedOut())
+	}
+	if tamperingAudited(t, config) {
+		t.Error("restoring an intact state was audited as tampering")
+	}
+}
+
+func TestLockoutStateTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T)
+	}{
+		{"edited", func(t *testing.T) {
+			data, err := os.ReadFile(lockoutStatePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[len(data)-3] ^= 1
+			if err := os.WriteFile(lockoutStatePath(), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"state removed", func(t *testing.T) {
+			os.Remove(lockoutStatePath())
+		}},
+		{"state and key removed", func(t *testing.T) {
+			os.Remove(lockoutStatePath())
+			os.Remove(lockoutKeyPath())
+		}},
+		{"key replaced", func(t *testing.T) {
+			os.Remove(lockoutKeyPath())
+			if _, err := loadLockoutKey(); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := lockoutTestConfig(t)
+			lm := NewLockoutManager(config)
+			lm.HandleFailedAttempt()
+			NewLockHelper(config).AuditAuthFailure("", AuthResult{ErrorClass: "authenticate"})
+
+			tt.tamper(t)
+
+			restored := NewLockoutManager(config)
+			if !restored.IsLockedOut() {
+				t.Error("tampered state didn't start a lockout")
+			}
+			if !tamperingAudited(t, config) {
+				t.Error("tampering wasn't audited")
+			}
+		})
+	}
+}
+
+func TestLockoutStateFirstRun(t *testing.T) {
+	config := lockoutTestConfig(t)
+
+	// An unlock after the last failure leaves nothing that must be saved
+	audit := NewAuditLogger(config)
+	audit.Log(AuditEntry{Event: AuditEventAuthFailure, SessionUser: "alice", Time: time.Now().Add(-time.Hour)})
+	audit.Log(AuditEntry{Event: AuditEventLockEnd, SessionUser: "alice"})
+
+	lm := NewLockoutManager(config)
+	if lm.IsLockedOut() || tamperingAudited(t, config) {
+		t.Error("a first run without saved state was treated as tampering")
+	}
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff string
+		want    []int // Seconds of lockouts 1, 2, ...
+		later   int   // Seconds of much later lockouts
+	}{
+		{"fixed", BackoffFixed, []int{30, 30, 30, 30}, 30},
+		{"linear", BackoffLinear, []int{30, 60, 90, 120}, 600},
+		{"exponential", BackoffExponential, []int{30, 60, 120, 240, 480, 600}, 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lm := &LockoutManager{config: Configuration{Lockout: LockoutPolicy{
+				Backoff:           tt.backoff,
+				LockoutSeconds:    30,
+				MaxLockoutSeconds: 600,
+			}}}
+			for i, want := range tt.want {
+				if got := lm.lockoutDuration(i + 1); got != time.Duration(want)*time.Second {
+					t.Errorf("lockout %d = %v, want %ds", i+1, got, want)
+				}
+			}
+
+			// Later lockouts stop at the cap, without overflowing
+			for _, number := range []int{25, 64, 1000} {
+				if got := lm.lockoutDuration(number); got != time.Duration(tt.later)*time.Second {
+					t.Errorf("lockout %d = %v, want %ds", number, got, tt.later)
+				}
+			}
+		})
+	}
+
+	lm := &LockoutManager{config: Configuration{Lockout: LockoutPolicy{
+		Backoff:           BackoffLinear,
+		LockoutSeconds:    30,
+		MaxLockoutSeconds: 100,
+	}}}
+	if got := lm.lockoutDuration(4); got != 100*time.Second {
+		t.Errorf("capped linear lockout = %v, want 100s", got)
+	}
+}
+
+// expireLockout ends the current lockout as if its time had passed
+func expireLockout(lm *LockoutManager) {
+	lm.lockoutUntil = time.Now().Add(-time.Second)
+}
+
+func TestHandleFailedAttempt(t *testing.T) {
+	config := lockoutTestConfig(t)
+	lm := NewLockoutManager(config)
+
+	for _, want := range []int{2, 1} {
+		locked, duration, remaining := lm.HandleFailedAttempt()
+		if locked || duration != 0 || remaining != want {
+			t.Fatalf("got locked %v for %v with %d left, want %d attempts left", locked, duration, remaining, want)
+		}
+	}
+
+	// The third failure starts the first lockout, the next round a longer one
+	for _, want := range []time.Duration{30 * time.Second, 60 * time.Second} {
+		if want > 30*time.Second {
+			expireLockout(lm)
+			if lm.IsLockedOut() {
+				t.Fatal("still locked out after the lockout ended")
+			}
+			lm.HandleFailedAttempt()
+			lm.HandleFailedAttempt()
+		}
+		locked, duration, remaining := lm.HandleFailedAttempt()
+		if !locked || duration.Round(time.Second) != want || remaining != 0 {
+			t.Fatalf("got locked %v for %v with %d left, want a %v lockout", locked, duration, remaining, want)
+		}
+		if !lm.IsLockedOut() {
+			t.Fatal("not locked out after the lockout started")
+		}
+	}
+
+	// Unlocking starts over
+	lm.ResetLockout()
+	if _, _, remaining := lm.HandleFailedAttempt(); remaining != 2 {
+		t.Errorf("%d attempts left after a reset, want 2", remaining)
+	}
+}
+
+func TestLockoutResetAfter(t *testing.T) {
+	tests := []struct {
+		name          string
+		resetAfter    int
+		quiet         time.Duration
+		wantRemaining int
+	}{
+		{"quiet long enough", 60, 2 * time.Minute, 2},
+		{"quiet too short", 60, 30 * time.Second, 0},
+		{"never forgotten", 0, 24 * time.Hour, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := lockoutTestConfig(t)
+			config.Lockout.ResetAfterSeconds = tt.resetAfter
+			lm := NewLockoutManager(config)
+
+			lm.HandleFailedAttempt()
+			lm.HandleFailedAttempt()
+			lm.lastFailureTime = time.Now().Add(-tt.quiet)
+
+			_, _, remaining := lm.HandleFailedAttempt()
+			if remaining != tt.wantRemaining {
+				t.Errorf("%d attempts left, want %d", remaining, tt.wantRemaining)
+			}
+		})
+	}
+
+	// The backoff starts over too
+	config := lockoutTestConfig(t)
+	config.Lockout.ResetAfterSeconds = 60
+	lm := NewLockoutManager(config)
+	for i := 0; i < 3; i++ {
+		lm.HandleFailedAttempt()
+	}
+	expireLockout(lm)
+	lm.lastFailureTime = time.Now().Add(-2 * time.Minute)
+	lm.HandleFailedAttempt()
+	lm.HandleFailedAttempt()
+	if _, duration, _ := lm.HandleFailedAttempt(); duration.Round(time.Second) != 30*time.Second {
+		t.Errorf("lockout after a quiet period = %v, want the first 30s again", duration)
+	}
+}
+
+func TestCountEmptyAttempts(t *testing.T) {
+	// Settings left out of the config keep their defaults
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"lockout": {"count_empty_attempts": false, "reset_after_seconds": 900}}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	if err := readConfig(path, &config); err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultLockoutPolicy()
+	want.CountEmptyAttempts = false
+	want.ResetAfterSeconds = 900
+	if config.Lockout != want {
+		t.Errorf("lockout policy = %+v, want %+v", config.Lockout, want)
+	}
+
+	for _, count := range []bool{true, false} {
+		config := lockoutTestConfig(t)
+		config.Lockout.CountEmptyAttempts = count
+		if got := NewLockoutManager(config).CountsEmptyAttempts(); got != count {
+			t.Errorf("CountsEmptyAttempts = %v, want %v", got, count)
+		}
+	}
+
+	// An ignored empty Enter never reaches PAM or the lockout
+	config = lockoutTestConfig(t)
+	config.Lockout.CountEmptyAttempts = false
+	l := &WaylandLocker{
+		config:         config,
+		lockoutManager: NewLockoutManager(config),
+		securePassword: NewSecurePassword(),
+	}
+	defer l.securePassword.Destroy()
+	l.authenticate()
+	if l.authenticating || l.helper != nil || l.lockoutManager.failedAttempts != 0 {
+		t.Error("empty password was checked")
+	}
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// qrFormatM is the masked format information of level M for each mask, as
+// listed in ISO/IEC 18004
+var qrFormatM = []int{
+	0b101010000010010,
+	0b101000100100101,
+	0b101111001111100,
+	0b101101101001011,
+	0b100010111111001,
+	0b100000011001110,
+	0b100111110010111,
+	0b100101010100000,
+}
+
+func TestQRReedSolomon(t *testing.T) {
+	// "01234567" at version 1-M, the worked example of ISO/IEC 18004
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	want := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+	if got := qrReedSolomonRemainder(data, qrReedSolomonDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("error correction = %X, want %X", got, want)
+	}
+}
+
+// decodeQR reads the data back from a symbol the way a scanner would once
+// it has found the modules: format, unmasking, codewords, blocks and the
+// byte mode segment
+func decodeQR(t *testing.T, qr *QRCode) []byte {
+	t.Helper()
+	version := (qr.size - 17) / 4
+
+	// Finder patterns in three corners
+	for _, corner := range [][2]int{{0, 0}, {qr.size - 7, 0}, {0, qr.size - 7}} {
+		for dy := 0; dy < 7; dy++ {
+			for dx := 0; dx < 7; dx++ {
+				dist := max(abs(dx-3), abs(dy-3))
+				if want := dist != 2; qr.modules[corner[1]+dy][corner[0]+dx] != want {
+					t.Fatalf("finder pattern at %v is broken at %d,%d", corner, dx, dy)
+				}
+			}
+		}
+	}
+
+	// Both copies of the format information
+	var first, second int
+	module := func(x, y int) int {
+		if qr.modules[y][x] {
+			return 1
+		}
+		return 0
+	}
+	for i := 0; i <= 5; i++ {
+		first |= module(8, i) << i
+	}
+	first |= module(8, 7)<<6 | module(8, 8)<<7 | module(7, 8)<<8
+	for i := 9; i < 15; i++ {
+		first |= module(14-i, 8) << i
+	}
+	for i := 0; i < 8; i++ {
+		second |= module(qr.size-1-i, 8) << i
+	}
+	for i := 8; i < 15; i++ {
+		second |= module(8, qr.size-15+i) << i
+	}
+	if first != second {
+		t.Fatalf("format copies differ: %015b and %015b", first, second)
+	}
+	mask := -1
+	for m, format := range qrFormatM {
+		if format == first {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("format %015b isn't level M", first)
+	}
+
+	// Unmask a copy and read the codewords in zigzag order
+	plain := &QRCode{size: qr.size, isFunction: qr.isFunction}
+	for _, row := range qr.modules {
+		plain.modules = append(plain.modules, append([]bool(nil), row...))
+	}
+	plain.applyMask(mask)
+	var bits qrBitBuffer
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = qr.size - 1 - vert
+			}
+			for x := right; x > right-2; x-- {
+				if !qr.isFunction[y][x] {
+					bits = append(bits, plain.modules[y][x])
+				}
+			}
+		}
+	}
+
+	// Undo the interleaving and check each block's error correction
+	spec := qrVersionsM[version-1]
+	codewords := bits.bytes()
+	blockCount := spec.blocks1 + spec.blocks2
+	blocks := make([][]byte, blockCount)
+	next := 0
+	for i := 0; i < max(spec.data1, spec.data2); i++ {
+		for b := range blocks {
+			if b < spec.blocks1 && i >= spec.data1 || b >= spec.blocks1 && i >= spec.data2 {
+				continue
+			}
+			blocks[b] = append(blocks[b], codewords[next])
+			next++
+		}
+	}
+	var data []byte
+	divisor := qrReedSolomonDivisor(spec.ecPerBlock)
+	for b, block := range blocks {
+		ec := make([]byte, spec.ecPerBlock)
+		for i := range ec {
+			ec[i] = codewords[spec.dataCodewords()+i*blockCount+b]
+		}
+		if got := qrReedSolomonRemainder(block, divisor); !bytes.Equal(got, ec) {
+			t.Fatalf("block %d has error correction %X, want %X", b, ec, got)
+		}
+		data = append(data, block...)
+	}
+
+	// Byte mode segment
+	var reader qrBitBuffer
+	for _, b := range data {
+		reader.append(int(b), 8)
+	}
+	read := func(n int) int {
+		value := 0
+		for _, bit := range reader[:n] {
+			value <<= 1
+			if bit {
+				value |= 1
+			}
+		}
+		reader = reader[n:]
+		return value
+	}
+	if mode := read(4); mode != 0x4 {
+		t.Fatalf("mode %04b, want byte mode", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	decoded := make([]byte, read(countBits))
+	for i := range decoded {
+		decoded[i] = byte(read(8))
+	}
+	return decoded
+}
+
+func TestEncodeQR(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		version int
+	}{
+		{"short", "fancylock", 1},
+		{"otpauth URI", "otpauth://totp/fancylock:alice?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&issuer=fancylock", 6},
+		{"version information", strings.Repeat("a", 110), 7},
+		{"two block groups", strings.Repeat("b", 150), 8},
+		{"largest", strings.Repeat("c", 213), 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qr, err := EncodeQR([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version := (qr.size - 17) / 4; version != tt.version {
+				t.Errorf("version = %d, want %d", version, tt.version)
+			}
+			if got := decodeQR(t, qr); string(got) != tt.data {
+				t.Errorf("decoded %q, want %q", got, tt.data)
+			}
+		})
+	}
+
+	if _, err := EncodeQR(bytes.Repeat([]byte("d"), 214)); err == nil {
+		t.Error("encoded more than version 10 holds")
+	}
+}
+
+func TestQRVersionInformation(t *testing.T) {
+	qr, err := EncodeQR(bytes.Repeat([]byte("a"), 110))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 7 from ISO/IEC 18004 annex D, read from the block by the
+	// bottom left finder
+	const want = 0b000111110010010100
+	got := 0
+	for i := 0; i < 18; i++ {
+		if qr.modules[qr.size-11+i%3][i/3] {
+			got |= 1 << i
+		}
+	}
+	if got != want {
+		t.Errorf("version information = %018b, want %018b", got, want)
+	}
+}
@@ -0,0 +1,424 @@
+package internal
+
+import (
+	_ "embed"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed fonts/DejaVuSans-Bold.ttf
+var fontBytes []byte
+
+// All lengths are in logical pixels, the renderer multiplies them by the
+// scale of the output it draws for. Sizes and colors come from the theme.
+const (
+	// maxDots is the most password dots drawn
+	maxDots = 32
+
+	// uiPadding is added around what's drawn when reporting the drawn area
+	uiPadding = 16
+
+	// textMargin is kept free on both sides of texts when the theme doesn't
+	// set their width
+	textMargin = 32
+)
+
+// Failed attempt animation: the dots move by shakeDistance pixels right,
+// left and back, shakeIterations times, with shakeDelay between moves
+const (
+	shakeIterations = 4
+	shakeDistance   = 10
+	shakeDelay      = 80 * time.Millisecond
+)
+
+// shakeOffsets returns the dot offsets of the failed attempt animation
+func shakeOffsets() []int {
+	offsets := make([]int, 0, shakeIterations*3)
+	for i := 0; i < shakeIterations; i++ {
+		offsets = append(offsets, shakeDistance, -shakeDistance, 0)
+	}
+	return offsets
+}
+
+// scaled converts a length in logical pixels to pixels at scale
+func scaled(length int, scale float64) int {
+	return int(math.Round(float64(length) * scale))
+}
+
+// UIState is everything the lock screen shows, independent of the backend
+type UIState struct {
+	Dots        int    // Number of password characters typed
+	ShakeOffset int    // Horizontal offset of the dots during the failed attempt animation
+	Label       string // Who the password is for while switching user
+	Status      string // Result of the last attempt, e.g. remaining attempts
+	Hint        string // What's missing to unlock, e.g. the security key
+	Verifying   bool   // Whether the password is being checked
+	Failed      bool   // Whether the failed attempt animation is playing
+
+	Now         time.Time // Time the clock shows, zero to hide the clock
+	LockedSince time.Time // When the screen was locked, zero if unknown
+
+	Lockout       bool   // Whether a lockout is running
+	LockoutTime   string // Remaining lockout time as mm:ss
+	LockoutReason string // Why the system imposed the lockout, if it did
+}
+
+// Renderer draws the lock screen UI into images that the X11 and Wayland
+// backends then present. It's safe for concurrent use.
+type Renderer struct {
+	background *Background
+	theme      Theme
+	fonts      *fontChain
+	faces      map[float64]*chainFace
+	user       UserProfile
+	avatars    map[int]*image.RGBA // Cut avatar per diameter
+	mu         sync.Mutex
+}
+
+// NewRenderer creates a renderer drawing the UI of theme on top of
+// background. A nil background leaves everything but the UI transparent.
+func NewRenderer(background *Background, theme Theme) *Renderer {
+	return &Renderer{
+		background: background,
+		theme:      theme,
+		fonts:      newFontChain(append([]string{theme.Font.Family}, theme.Font.Fallback...)),
+		faces:      make(map[float64]*chainFace),
+		avatars:    make(map[int]*image.RGBA),
+	}
+}
+
+// SetUser sets whose session the lock screen shows
+func (r *Renderer) SetUser(user UserProfile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.user = user
+	clear(r.avatars)
+}
+
+// face returns the font faces of the given size, or nil if there's no font
+func (r *Renderer) face(size float64) *chainFace {
+	if face, ok := r.faces[size]; ok {
+		return face
+	}
+
+	face, err := newChainFace(r.fonts, size)
+	if err != nil {
+		Error("Failed to create font face: %v", err)
+		return nil
+	}
+
+	r.faces[size] = face
+	return face
+}
+
+// Render draws the UI for state into img, which must start at 0,0, at the
+// given scale. A scale of 0 means 1. It returns the area drawn on top of the
+// background.
+func (r *Renderer) Render(img *image.RGBA, state UIState, scale float64) image.Rectangle {
+	var area image.Rectangle
+	for _, region := range r.RenderRegions(img, state, scale) {
+		area = area.Union(region)
+	}
+	return area
+}
+
+// RenderRegions draws like Render, but returns the areas of the separate
+// parts of the UI, such as the clock and the password prompt
+func (r *Renderer) RenderRegions(img *image.RGBA, state UIState, scale float64) []image.Rectangle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if scale <= 0 {
+		scale = 1
+	}
+
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if r.background != nil {
+		copy(img.Pix, r.background.RGBA(width, height).Pix)
+	} else {
+		clear(img.Pix)
+	}
+
+	if state.Lockout {
+		return []image.Rectangle{r.drawLockout(img, state, scale)}
+	}
+
+	var regions []image.Rectangle
+	for _, area := range []image.Rectangle{r.drawClock(img, state, scale), r.drawPrompt(img, state, scale)} {
+		if !area.Empty() {
+			regions = append(regions, area)
+		}
+	}
+	return regions
+}
+
+// UntilClockChanges returns how long it is from now until the clock shows
+// something else, and false if there's no clock
+func (r *Renderer) UntilClockChanges(now time.Time) (time.Duration, bool) {
+	if !r.theme.Clock.Shown() {
+		return 0, false
+	}
+	return untilNextTick(now, r.theme.Clock.Seconds()), true
+}
+
+// promptColors returns the theme colors of the prompt in state
+func (r *Renderer) promptColors(state UIState) ThemeColors {
+	switch {
+	case state.Verifying:
+		return r.theme.Verifying
+	case state.Failed:
+		return r.theme.Failed
+	case state.Dots > 0:
+		return r.theme.Typing
+	default:
+		return r.theme.Idle
+	}
+}
+
+// anchorY returns the y coordinate offset pixels below anchor, which is
+// margin pixels from the top or bottom edge for those anchors, on an image
+// of the given height
+func anchorY(anchor string, offset, margin, height int, scale float64) int {
+	y := height / 2
+	switch anchor {
+	case AnchorTop:
+		y = scaled(margin, scale)
+	case AnchorBottom:
+		y = height - scaled(margin, scale)
+	}
+	return y + scaled(offset, scale)
+}
+
+// drawPrompt draws the password dots with the texts around them
+func (r *Renderer) drawPrompt(img *image.RGBA, state UIState, scale float64) image.Rectangle {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	layout := r.theme.Layout
+	colors := r.promptColors(state)
+	textColor := themeColor(colors.Text)
+	size := r.theme.Font.Size * scale
+	y := anchorY(layout.Anchor, layout.Offset, layout.Margin, height, scale)
+
+	area := r.drawDots(img, min(state.Dots, maxDots), width/2+scaled(state.ShakeOffset, scale), y, scale, themeColor(colors.Dots))
+
+	// Who we're unlocking as goes above the dots, the rest below. Messages
+	// may wrap, the hint moves down to make room.
+	if state.Label != "" {
+		drawn, _ := r.drawText(img, scale, size, textColor, state.Label, y-scaled(layout.TextGap, scale), 1)
+		area = area.Union(drawn)
+	} else {
+		area = area.Union(r.drawUser(img, scale, textColor, y-scaled(layout.TextGap, scale)))
+	}
+	hintY := y + scaled(layout.TextGap+layout.LineGap, scale)
+	if state.Status != "" {
+		drawn, last := r.drawText(img, scale, size, textColor, state.Status, y+scaled(layout.TextGap, scale), 2)
+		area = area.Union(drawn)
+		hintY = last + scaled(layout.LineGap, scale)
+	}
+	if state.Hint != "" {
+		drawn, _ := r.drawText(img, scale, size, textColor, state.Hint, hintY, 2)
+		area = area.Union(drawn)
+	}
+
+	if area.Empty() {
+		return area
+	}
+	return area.Inset(-scaled(uiPadding, scale)).Intersect(img.Bounds())
+}
+
+// drawUser draws the session user's name with its baseline at y and their
+// picture above it
+func (r *Renderer) drawUser(img *image.RGBA, scale float64, c color.NRGBA, y int) image.Rectangle {
+	theme := r.theme.Avatar
+
+	var area image.Rectangle
+	top := y
+	if theme.ShowName && r.user.Name != "" {
+		size := theme.NameSize * scale
+		area, _ = r.drawText(img, scale, size, c, r.user.Name, y, 1)
+		if face := r.face(size); face != nil {
+			top = y - face.Metrics().Ascent.Ceil()
+		}
+	}
+
+	diameter := scaled(theme.Size, scale)
+	if diameter <= 0 || r.user.Avatar == nil {
+		return area
+	}
+
+	avatar, ok := r.avatars[diameter]
+	if !ok {
+		avatar = circleAvatar(r.user.Avatar, diameter, scaled(theme.Border, scale), themeColor(theme.BorderColor))
+		r.avatars[diameter] = avatar
+	}
+
+	bottom := top - scaled(theme.Gap, scale)
+	left := (img.Bounds().Dx() - diameter) / 2
+	bounds := image.Rect(left, bottom-diameter, left+diameter, bottom)
+	draw.Draw(img, bounds, avatar, image.Point{}, draw.Over)
+	return area.Union(bounds.Intersect(img.Bounds()))
+}
+
+// drawClock draws the time, the date and how long the screen has been
+// locked, each with a shadow that keeps it readable over media
+func (r *Renderer) drawClock(img *image.RGBA, state UIState, scale float64) image.Rectangle {
+	clock := r.theme.Clock
+	if state.Now.IsZero() || !clock.Shown() {
+		return image.Rectangle{}
+	}
+
+	type clockLine struct {
+		size float64
+		text string
+	}
+	var lines []clockLine
+	if clock.TimeFormat != "" {
+		lines = append(lines, clockLine{clock.TimeSize, strftime(clock.TimeFormat, state.Now)})
+	}
+	if clock.DateFormat != "" {
+		lines = append(lines, clockLine{clock.DateSize, strftime(clock.DateFormat, state.Now)})
+	}
+	if clock.LockedFor != "" && !state.LockedSince.IsZero() {
+		lockedFor := formatLockedFor(state.Now.Sub(state.LockedSince))
+		lines = append(lines, clockLine{clock.DateSize, strings.ReplaceAll(clock.LockedFor, "%s", lockedFor)})
+	}
+
+	src := &image.Uniform{themeColor(clock.Color)}
+	shadow := themeColor(clock.Shadow)
+	shadowOffset := max(scaled(2, scale), 1)
+
+	var area image.Rectangle
+	y := anchorY(clock.Anchor, clock.Offset, clock.Margin, img.Bounds().Dy(), scale)
+	for i, line := range lines {
+		if i > 0 {
+			y += scaled(clock.LineGap, scale)
+		}
+		layout := r.layoutText(img, scale, line.size*scale, line.text, y, 1)
+		if layout == nil {
+			continue
+		}
+
+		if shadow.A > 0 {
+			shaded := *layout
+			shaded.box.left += shadowOffset
+			shaded.box.baseline += shadowOffset
+			area = area.Union(shaded.Draw(img, &image.Uniform{shadow}))
+		}
+		area = area.Union(layout.Draw(img, src))
+	}
+
+	if area.Empty() {
+		return area
+	}
+	return area.Inset(-scaled(uiPadding, scale)).Intersect(img.Bounds())
+}
+
+// drawLockout darkens the screen and shows the lockout countdown
+func (r *Renderer) drawLockout(img *image.RGBA, state UIState, scale float64) image.Rectangle {
+	height := img.Bounds().Dy()
+	lockout := r.theme.Lockout
+	textColor := themeColor(lockout.Text)
+	titleSize := r.theme.Font.TitleSize * scale
+	subtitleSize := r.theme.Font.SubtitleSize * scale
+
+	draw.Draw(img, img.Bounds(), &image.Uniform{themeColor(lockout.Shade)}, image.Point{}, draw.Over)
+
+	if lockout.Title != "" {
+		r.drawText(img, scale, titleSize, textColor, lockout.Title, height/2-scaled(100, scale), 1)
+	}
+	if lockout.Subtitle != "" {
+		r.drawText(img, scale, subtitleSize, textColor, lockout.Subtitle, height/2, 1)
+	}
+	r.drawText(img, scale, titleSize, textColor, state.LockoutTime, height/2+scaled(100, scale), 1)
+
+	// Explain lockouts imposed by the system rather than by us
+	if state.LockoutReason != "" {
+		r.drawText(img, scale, subtitleSize, textColor, state.LockoutReason, height/2+scaled(170, scale), 3)
+	}
+
+	return img.Bounds()
+}
+
+// drawDots draws count dots of color c centered on x with their centers at y
+func (r *Renderer) drawDots(img *image.RGBA, count, x, y int, scale float64, c color.NRGBA) image.Rectangle {
+	if count == 0 {
+		return image.Rectangle{}
+	}
+
+	radius := scaled(r.theme.Dots.Radius, scale)
+	spacing := scaled(r.theme.Dots.Spacing, scale)
+
+	// Dots are drawn through a mask so translucent colors blend in
+	mask := image.NewAlpha(image.Rect(-radius, -radius, radius+1, radius+1))
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			if dx*dx+dy*dy <= radius*radius {
+				mask.SetAlpha(dx, dy, color.Alpha{0xff})
+			}
+		}
+	}
+
+	src := &image.Uniform{c}
+	startX := x - (count-1)*spacing/2
+	for i := 0; i < count; i++ {
+		center := image.Pt(startX+i*spacing, y)
+		draw.DrawMask(img, mask.Bounds().Add(center), src, image.Point{}, mask, mask.Bounds().Min, draw.Over)
+	}
+
+	return image.Rect(startX-radius, y-radius, startX+(count-1)*spacing+radius+1, y+radius+1)
+}
+
+// drawText lays out text of color c in the theme's text column with the
+// baseline of its first line at y, wrapping it into at most maxLines lines.
+// It returns the area the text covers and the baseline of its last line.
+func (r *Renderer) drawText(img *image.RGBA, scale, size float64, c color.NRGBA, text string, y, maxLines int) (image.Rectangle, int) {
+	layout := r.layoutText(img, scale, size, text, y, maxLines)
+	if layout == nil {
+		return image.Rectangle{}, y
+	}
+	return layout.Draw(img, &image.Uniform{c}).Intersect(img.Bounds()), layout.LastBaseline()
+}
+
+// layoutText lays out text in the theme's text column like drawText, or
+// returns nil if there's no font
+func (r *Renderer) layoutText(img *image.RGBA, scale, size float64, text string, y, maxLines int) *textLayout {
+	face := r.face(size)
+	if face == nil {
+		return nil
+	}
+
+	width := img.Bounds().Dx()
+	boxWidth := width - 2*scaled(textMargin, scale)
+	if r.theme.Layout.TextWidth > 0 {
+		boxWidth = min(scaled(r.theme.Layout.TextWidth, scale), width)
+	}
+
+	return layoutText(face, text, textBox{
+		left:     (width - boxWidth) / 2,
+		width:    boxWidth,
+		baseline: y,
+		maxLines: maxLines,
+		align:    r.theme.Layout.Align,
+	})
+}
+
+// copyToARGB copies the area of img into a little-endian ARGB8888 buffer
+// with the given stride, which is BGRA in memory. Wayland's ARGB8888 and the
+// 32bpp pixmaps of X11 share that layout; X11 ignores the alpha byte.
+func copyToARGB(data []byte, stride int, img *image.RGBA, area image.Rectangle) {
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(area.Min.X, y):img.PixOffset(area.Max.X, y)]
+		dst := data[(y-area.Min.Y)*stride:]
+		for i := 0; i < len(src); i += 4 {
+			dst[i+0] = src[i+2]
+			dst[i+1] = src[i+1]
+			dst[i+2] = src[i+0]
+			dst[i+3] = src[i+3]
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// securePasswordCapacity is the fixed size of the password buffer. The buffer
+// never grows, so the password is never copied to a new heap allocation.
+const securePasswordCapacity = 4096
+
+// DisableCoreDumps marks the process as non-dumpable so that password memory
+// can't end up in a core file or be read by other processes of the same user
+func DisableCoreDumps() error {
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set PR_SET_DUMPABLE: %v", err)
+	}
+
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{Cur: 0, Max: 0}); err != nil {
+		return fmt.Errorf("failed to disable core dumps: %v", err)
+	}
+
+	return nil
+}
+
+// NewSecurePassword creates a new secure password container backed by a
+// locked, non-dumpable memory mapping
+func NewSecurePassword() *SecurePassword {
+	buf, err := unix.Mmap(-1, 0, securePasswordCapacity,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		// Fall back to a regular allocation, we still wipe it on every clear
+		Error("Failed to map secure password buffer: %v", err)
+		return &SecurePassword{
+			buf: make([]byte, securePasswordCapacity),
+		}
+	}
+
+	// Keep the password out of swap
+	if err := unix.Mlock(buf); err != nil {
+		Warn("Failed to mlock password buffer: %v", err)
+	}
+
+	// Keep the password out of core dumps
+	if err := unix.Madvise(buf, unix.MADV_DONTDUMP); err != nil {
+		Warn("Failed to exclude password buffer from core dumps: %v", err)
+	}
+
+	return &SecurePassword{
+		buf:    buf,
+		mapped: true,
+	}
+}
+
+// Append adds a character to the password
+func (p *SecurePassword) Append(char byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.length >= len(p.buf) {
+		Debug("Password buffer full, ignoring input")
+		return
+	}
+	p.buf[p.length] = char
+	p.length++
+}
+
+// RemoveLast removes the last character from the password
+func (p *SecurePassword) RemoveLast() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.length > 0 {
+		// Zero out the last byte before removing it
+		p.length--
+		p.buf[p.length] = 0
+	}
+}
+
+// Clear securely wipes the password data
+func (p *SecurePassword) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.wipe()
+}
+
+// wipe zeroes the whole buffer, the caller must hold the mutex
+func (p *SecurePassword) wipe() {
+	for i := range p.buf {
+		p.buf[i] = 0
+	}
+	p.length = 0
+}
+
+// WithBytes calls fn with the password bytes while holding the lock.
+// The slice aliases the locked buffer; fn must not retain or modify it.
+func (p *SecurePassword) WithBytes(fn func(password []byte)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(p.buf[:p.length])
+}
+
+// Copy returns a new SecurePassword holding the same password, so a slow
+// check like PAM can read it without holding this one's lock. The caller
+// must Destroy the copy.
+func (p *SecurePassword) Copy() *SecurePassword {
+	c := NewSecurePassword()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.length = copy(c.buf, p.buf[:p.length])
+	return c
+}
+
+// Length returns the password length
+func (p *SecurePassword) Length() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.length
+}
+
+// Destroy wipes the password and releases the locked memory
+func (p *SecurePassword) Destroy() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.wipe()
+	if p.mapped {
+		unix.Munlock(p.buf)
+		unix.Munmap(p.buf)
+		p.mapped = false
+	}
+	p.buf = nil
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecurePasswordCopy(t *testing.T) {
+	password := NewSecurePassword()
+	defer password.Destroy()
+	for _, c := range []byte("hunter2") {
+		password.Append(c)
+	}
+
+	copied := password.Copy()
+	defer copied.Destroy()
+
+	// Reading the copy must not hold the original's lock
+	copied.WithBytes(func(secret []byte) {
+		if got := password.Length(); got != 7 {
+			t.Errorf("original length = %d, want 7", got)
+		}
+		if !bytes.Equal(secret, []byte("hunter2")) {
+			t.Errorf("copy = %q, want hunter2", secret)
+		}
+	})
+
+	password.Clear()
+	if got := copied.Length(); got != 7 {
+		t.Errorf("copy length after clearing the original = %d, want 7", got)
+	}
+}
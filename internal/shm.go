@@ -0,0 +1,388 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"sync"
+	"syscall"
+
+	"github.com/neurlang/wayland/wl"
+	"golang.org/x/sys/unix"
+)
+
+// shmBufferCount is how many buffers each lock surface cycles through: one
+// the compositor holds on to while the next frame is drawn into the other
+const shmBufferCount = 2
+
+// shmBuffer is one buffer of a surface's shm pool
+type shmBuffer struct {
+	owner  *surfaceBuffers
+	buffer *wl.Buffer
+	data   []byte          // This buffer's part of the pool mapping
+	busy   bool            // Attached and not released by the compositor yet
+	stale  image.Rectangle // Area that lags behind the frame on screen
+}
+
+// surfaceBuffers presents frames on one lock surface. It reuses the buffers
+// of a single shm pool, paces redraws with frame callbacks and only damages
+// what changed since the previous frame. Frames are drawn at the output's
+// native resolution.
+type surfaceBuffers struct {
+	shm        *wl.Shm
+	surface    *wl.Surface
+	renderer   *Renderer
+	viewport   *wpViewport        // nil without wp_viewporter
+	fractional *wpFractionalScale // nil without wp_fractional_scale_v1
+
+	mu             sync.Mutex
+	outputScale    int     // wl_output.scale of the surface's output
+	preferredScale float64 // Fractional scale the compositor asked for, 0 if it didn't
+	scale          float64 // Scale the pool was created for
+	width          int     // Surface size
+	height         int
+	bufferWidth    int // Buffer size, the surface size at scale
+	bufferHeight   int
+	last           UIState // Latest state presented, drawn again when the scale changes
+	fd             int
+	pool           *wl.ShmPool
+	mapping        []byte
+	buffers        []*shmBuffer
+	shown          *image.RGBA     // Frame on screen
+	scratch        *image.RGBA     // Frame being drawn
+	uiArea         image.Rectangle // Where the UI of the frame on screen is
+	fresh          bool            // Nothing was presented since the pool was created
+	callback       *wl.Callback    // Frame callback of the last commit, until it's done
+	pending        *UIState        // Latest state that's waiting for the compositor
+}
+
+// newSurfaceBuffers creates the buffer manager of surface. The pool is
+// created when the compositor configures the surface.
+func newSurfaceBuffers(shm *wl.Shm, surface *wl.Surface, renderer *Renderer) *surfaceBuffers {
+	return &surfaceBuffers{
+		shm:      shm,
+		surface:  surface,
+		renderer: renderer,
+		fd:       -1,
+	}
+}
+
+// Configure sizes the buffers for the surface and presents state right away,
+// since a configured lock surface must not stay without a buffer
+func (b *surfaceBuffers) Configure(width, height int, state UIState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if width != b.width || height != b.height || b.pool == nil || b.wantedScale() != b.scale {
+		b.destroyPool()
+		if err := b.createPool(width, height); err != nil {
+			Error("%v", err)
+			return
+		}
+	}
+
+	// Take input on the whole surface
+	b.surface.SetInputRegion(nil)
+
+	// The configure is only acked by a commit, so commit even if the frame
+	// didn't change
+	b.fresh = true
+	b.callback = nil
+	b.present(state)
+}
+
+// SetOutputScale sets the integer scale of the surface's output
+func (b *surfaceBuffers) SetOutputScale(scale int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.outputScale = scale
+	b.rescale()
+}
+
+// SetPreferredScale sets the fractional scale the compositor asked for
+func (b *surfaceBuffers) SetPreferredScale(scale float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.preferredScale = scale
+	b.rescale()
+}
+
+// wantedScale returns the scale to draw at: the compositor's fractional
+// scale if a viewport can show it, otherwise the output's scale
+func (b *surfaceBuffers) wantedScale() float64 {
+	if b.viewport != nil && b.preferredScale > 0 {
+		return b.preferredScale
+	}
+	if b.outputScale > 1 {
+		return float64(b.outputScale)
+	}
+	return 1
+}
+
+// rescale recreates the pool and redraws if the scale changed after the
+// surface was configured
+func (b *surfaceBuffers) rescale() {
+	if b.pool == nil || b.wantedScale() == b.scale {
+		return
+	}
+
+	width, height := b.width, b.height
+	b.destroyPool()
+	if err := b.createPool(width, height); err != nil {
+		Error("%v", err)
+		return
+	}
+
+	b.callback = nil
+	b.present(b.last)
+}
+
+// applyScale tells the compositor how the buffers map onto the surface
+func (b *surfaceBuffers) applyScale() {
+	if b.viewport != nil {
+		b.surface.SetBufferScale(1)
+		b.viewport.SetDestination(int32(b.width), int32(b.height))
+		return
+	}
+	b.surface.SetBufferScale(int32(b.scale))
+}
+
+// Present shows state on the surface once the compositor is ready for the
+// next frame. States presented in the meantime replace each other.
+func (b *surfaceBuffers) Present(state UIState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pool == nil || b.callback != nil {
+		b.pending = &state
+		return
+	}
+	b.present(state)
+}
+
+// Destroy releases the pool and its buffers
+func (b *surfaceBuffers) Destroy() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.destroyPool()
+	b.callback = nil
+	b.pending = nil
+
+	if b.viewport != nil {
+		b.viewport.Destroy()
+		b.viewport.Unregister()
+		b.viewport = nil
+	}
+	if b.fractional != nil {
+		b.fractional.Destroy()
+		b.fractional.Unregister()
+		b.fractional = nil
+	}
+}
+
+// createPool creates a pool holding shmBufferCount buffers for a surface of
+// the given size at the wanted scale
+func (b *surfaceBuffers) createPool(width, height int) error {
+	scale := b.wantedScale()
+	bufferWidth, bufferHeight := scaled(width, scale), scaled(height, scale)
+	stride := bufferWidth * 4
+	size := stride * bufferHeight
+
+	fd, err := unix.MemfdCreate("fancylock-shm", unix.MFD_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to create memory file descriptor: %v", err)
+	}
+
+	if err := syscall.Ftruncate(fd, int64(size*shmBufferCount)); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to truncate memory file: %v", err)
+	}
+
+	mapping, err := syscall.Mmap(fd, 0, size*shmBufferCount, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to map memory: %v", err)
+	}
+
+	pool, err := b.shm.CreatePool(uintptr(fd), int32(size*shmBufferCount))
+	if err != nil {
+		syscall.Munmap(mapping)
+		unix.Close(fd)
+		return fmt.Errorf("failed to create shared memory pool: %v", err)
+	}
+
+	b.fd = fd
+	b.mapping = mapping
+	b.pool = pool
+	b.scale = scale
+	b.width, b.height = width, height
+	b.bufferWidth, b.bufferHeight = bufferWidth, bufferHeight
+
+	for i := 0; i < shmBufferCount; i++ {
+		buffer, err := pool.CreateBuffer(int32(i*size), int32(bufferWidth), int32(bufferHeight), int32(stride), wl.ShmFormatArgb8888)
+		if err != nil {
+			b.destroyPool()
+			return fmt.Errorf("failed to create buffer: %v", err)
+		}
+
+		buf := &shmBuffer{
+			owner:  b,
+			buffer: buffer,
+			data:   mapping[i*size : (i+1)*size],
+			stale:  image.Rect(0, 0, bufferWidth, bufferHeight),
+		}
+		buffer.AddReleaseHandler(buf)
+		b.buffers = append(b.buffers, buf)
+	}
+
+	b.shown = image.NewRGBA(image.Rect(0, 0, bufferWidth, bufferHeight))
+	b.scratch = image.NewRGBA(image.Rect(0, 0, bufferWidth, bufferHeight))
+	b.uiArea = image.Rectangle{}
+	b.fresh = true
+
+	Debug("Created shm pool with %d buffers of %dx%d for %dx%d at scale %g",
+		shmBufferCount, bufferWidth, bufferHeight, width, height, scale)
+	return nil
+}
+
+// destroyPool destroys the buffers and the pool, if there are any
+func (b *surfaceBuffers) destroyPool() {
+	for _, buf := range b.buffers {
+		buf.buffer.Destroy()
+		buf.buffer.Unregister()
+	}
+	b.buffers = nil
+
+	if b.pool != nil {
+		b.pool.Destroy()
+		b.pool.Unregister()
+		b.pool = nil
+	}
+	if b.mapping != nil {
+		syscall.Munmap(b.mapping)
+		b.mapping = nil
+	}
+	if b.fd >= 0 {
+		unix.Close(b.fd)
+		b.fd = -1
+	}
+
+	b.width, b.height = 0, 0
+	b.bufferWidth, b.bufferHeight = 0, 0
+	b.shown, b.scratch = nil, nil
+}
+
+// present draws state into a free buffer and commits it with a frame
+// callback. It must be called with mu held.
+func (b *surfaceBuffers) present(state UIState) {
+	b.last = state
+
+	var buf *shmBuffer
+	for _, candidate := range b.buffers {
+		if !candidate.busy {
+			buf = candidate
+			break
+		}
+	}
+	if buf == nil {
+		// Drawn when the compositor releases one
+		b.pending = &state
+		return
+	}
+	b.pending = nil
+
+	area := b.renderer.Render(b.scratch, state, b.scale)
+	damage := b.scratch.Bounds()
+	if b.fresh {
+		b.applyScale()
+	} else {
+		damage = changedArea(b.shown, b.scratch, area.Union(b.uiArea))
+		if damage.Empty() {
+			return
+		}
+	}
+
+	// Every buffer now lags behind in the damaged area, the one we're
+	// about to attach catches up on everything it missed
+	for _, other := range b.buffers {
+		other.stale = other.stale.Union(damage)
+	}
+	stride := b.bufferWidth * 4
+	copyToARGB(buf.data[buf.stale.Min.Y*stride+buf.stale.Min.X*4:], stride, b.scratch, buf.stale)
+	buf.stale = image.Rectangle{}
+
+	b.shown, b.scratch = b.scratch, b.shown
+	b.uiArea = area
+	b.fresh = false
+
+	callback, err := b.surface.Frame()
+	if err != nil {
+		Error("Failed to request frame callback: %v", err)
+	} else {
+		callback.AddDoneHandler(b)
+		b.callback = callback
+	}
+
+	b.surface.Attach(buf.buffer, 0, 0)
+	b.surface.DamageBuffer(int32(damage.Min.X), int32(damage.Min.Y), int32(damage.Dx()), int32(damage.Dy()))
+	b.surface.Commit()
+	buf.busy = true
+
+	Debug("Presented frame: dots=%d, offset=%d, lockout=%v, damage=%v", state.Dots, state.ShakeOffset, state.Lockout, damage)
+}
+
+// HandleCallbackDone draws what was presented while waiting for the frame
+func (b *surfaceBuffers) HandleCallbackDone(ev wl.CallbackDoneEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ev.C.Unregister()
+	if ev.C != b.callback {
+		return
+	}
+	b.callback = nil
+
+	if b.pending != nil {
+		b.present(*b.pending)
+	}
+}
+
+// HandleBufferRelease marks the buffer free again and draws what was waiting
+// for one
+func (buf *shmBuffer) HandleBufferRelease(ev wl.BufferReleaseEvent) {
+	b := buf.owner
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buf.busy = false
+	if b.pending != nil && b.callback == nil && b.pool != nil {
+		b.present(*b.pending)
+	}
+}
+
+// changedArea returns the part of area where a and b differ
+func changedArea(a, b *image.RGBA, area image.Rectangle) image.Rectangle {
+	area = area.Intersect(a.Bounds())
+
+	var changed image.Rectangle
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		rowA := a.Pix[a.PixOffset(area.Min.X, y):a.PixOffset(area.Max.X, y)]
+		rowB := b.Pix[b.PixOffset(area.Min.X, y):b.PixOffset(area.Max.X, y)]
+		if bytes.Equal(rowA, rowB) {
+			continue
+		}
+
+		first, last := 0, len(rowA)-1
+		for rowA[first] == rowB[first] {
+			first++
+		}
+		for rowA[last] == rowB[last] {
+			last--
+		}
+		changed = changed.Union(image.Rect(area.Min.X+first/4, y, area.Min.X+last/4+1, y+1))
+	}
+	return changed
+}
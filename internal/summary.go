@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// AwaySummary collects the failed attempts and lockouts of one lock session.
+// It's safe for concurrent use, hooks read it from their own goroutines.
+type AwaySummary struct {
+	mu       sync.Mutex
+	failures []time.Time
+	lockouts []time.Time
+}
+
+// Reset forgets everything recorded so far
+func (s *AwaySummary) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = nil
+	s.lockouts = nil
+}
+
+// RecordFailure records a failed unlock attempt
+func (s *AwaySummary) RecordFailure(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, at)
+}
+
+// RecordLockout records the start of a lockout
+func (s *AwaySummary) RecordLockout(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockouts = append(s.lockouts, at)
+}
+
+// Failures returns the number of failed attempts recorded so far
+func (s *AwaySummary) Failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.failures)
+}
+
+// IsEmpty returns whether nothing worth reporting happened
+func (s *AwaySummary) IsEmpty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.failures) == 0 && len(s.lockouts) == 0
+}
+
+// Body returns the notification text describing the session
+func (s *AwaySummary) Body() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []string
+
+	if n := len(s.failures); n > 0 {
+		first := s.failures[0].Format("15:04")
+		last := s.failures[n-1].Format("15:04")
+		if n == 1 {
+			lines = append(lines, fmt.Sprintf("1 failed unlock attempt at %s", first))
+		} else {
+			lines = append(lines, fmt.Sprintf("%d failed unlock attempts between %s and %s", n, first, last))
+		}
+	}
+
+	if n := len(s.lockouts); n > 0 {
+		times := make([]string, 0, n)
+		for _, t := range s.lockouts {
+			times = append(times, t.Format("15:04"))
+		}
+		if n == 1 {
+			lines = append(lines, fmt.Sprintf("1 lockout at %s", times[0]))
+		} else {
+			lines = append(lines, fmt.Sprintf("%d lockouts at %s", n, strings.Join(times, ", ")))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// sendNotification shows a desktop notification through org.freedesktop.Notifications
+func sendNotification(conn *dbus.Conn, summary, body string) error {
+	obj := conn.Object("org.freedesktop.Notifications", dbus.ObjectPath("/org/freedesktop/Notifications"))
+
+	// Critical urgency keeps the notification around until it's dismissed
+	hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(byte(2))}
+
+	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
+		"FancyLock",     // app_name
+		uint32(0),       // replaces_id
+		"security-high", // app_icon
+		summary,         // summary
+		body,            // body
+		[]string{},      // actions
+		hints,           // hints
+		int32(-1),       // expire_timeout
+	)
+	if call.Err != nil {
+		return fmt.Errorf("failed to send notification: %v", call.Err)
+	}
+	return nil
+}
+
+// sessionBus returns the session bus connection, sharing the media controller's if there is one
+func (h *LockHelper) sessionBus() (*dbus.Conn, error) {
+	if h.mediaCtrl != nil {
+		return h.mediaCtrl.conn, nil
+	}
+	if h.busConn == nil {
+		conn, err := dbus.ConnectSessionBus()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to session bus: %v", err)
+		}
+		h.busConn = conn
+	}
+	return h.busConn, nil
+}
+
+// NotifyAwaySummary tells the user about failed attempts and lockouts that
+// happened while the session was locked
+func (h *LockHelper) NotifyAwaySummary() {
+	if !h.config.AwaySummary || h.away.IsEmpty() {
+		return
+	}
+
+	conn, err := h.sessionBus()
+	if err != nil {
+		Error("Failed to show away summary: %v", err)
+		return
+	}
+
+	if err := sendNotification(conn, "While you were away", h.away.Body()); err != nil {
+		Error("Failed to show away summary: %v", err)
+		return
+	}
+
+	Debug("Shown away summary notification")
+	h.away.Reset()
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"fmt"
+	"os/user"
+	"slices"
+)
+
+// SwitchUserPrompt tracks the "switch user" state of the lock screen, which
+// lets a designated user unlock the session with their own password
+type SwitchUserPrompt struct {
+	active   bool   // Whether we're unlocking as someone other than the owner
+	editing  bool   // Whether the username is still being typed
+	username []rune // Username typed so far
+}
+
+// NewSwitchUserPrompt creates a new, inactive switch user prompt
+func NewSwitchUserPrompt() *SwitchUserPrompt {
+	return &SwitchUserPrompt{}
+}
+
+// Start switches the prompt to username entry
+func (p *SwitchUserPrompt) Start() {
+	p.active = true
+	p.editing = true
+	p.username = p.username[:0]
+}
+
+// Cancel returns the prompt to unlocking as the session owner
+func (p *SwitchUserPrompt) Cancel() {
+	p.active = false
+	p.editing = false
+	p.username = p.username[:0]
+}
+
+// IsActive returns whether we're unlocking as another user
+func (p *SwitchUserPrompt) IsActive() bool {
+	return p.active
+}
+
+// IsEditing returns whether key input goes to the username
+func (p *SwitchUserPrompt) IsEditing() bool {
+	return p.active && p.editing
+}
+
+// AppendChar adds a character to the username
+func (p *SwitchUserPrompt) AppendChar(r rune) {
+	if len(p.username) < 32 {
+		p.username = append(p.username, r)
+	}
+}
+
+// RemoveLast removes the last character from the username
+func (p *SwitchUserPrompt) RemoveLast() {
+	if len(p.username) > 0 {
+		p.username = p.username[:len(p.username)-1]
+	}
+}
+
+// Confirm finishes username entry, returns false if no username was typed
+func (p *SwitchUserPrompt) Confirm() bool {
+	if len(p.username) == 0 {
+		return false
+	}
+	p.editing = false
+	return true
+}
+
+// Username returns the user to authenticate, or "" for the session owner
+func (p *SwitchUserPrompt) Username() string {
+	if !p.active || p.editing {
+		return ""
+	}
+	return string(p.username)
+}
+
+// Label returns the text to show on the lock screen, or "" when inactive
+func (p *SwitchUserPrompt) Label() string {
+	if !p.active {
+		return ""
+	}
+	if p.editing {
+		return fmt.Sprintf("Unlock as: %s_", string(p.username))
+	}
+	return fmt.Sprintf("Password for %s", string(p.username))
+}
+
+// SwitchUserEnabled returns whether anyone besides the session owner may unlock
+func (h *LockHelper) SwitchUserEnabled() bool {
+	return len(h.config.UnlockUsers) > 0 || len(h.config.UnlockGroups) > 0
+}
+
+// IsUnlockAllowed checks whether username may unlock this session
+func (h *LockHelper) IsUnlockAllowed(username string) bool {
+	if username == h.authenticator.username {
+		return true
+	}
+
+	if slices.Contains(h.config.UnlockUsers, username) {
+		return true
+	}
+
+	if len(h.config.UnlockGroups) == 0 {
+		return false
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		Debug("Failed to look up user %s: %v", username, err)
+		return false
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		Debug("Failed to look up groups of %s: %v", username, err)
+		return false
+	}
+
+	for _, name := range h.config.UnlockGroups {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			Debug("Failed to look up group %s: %v", name, err)
+			continue
+		}
+		if slices.Contains(groupIDs, group.Gid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthenticateUser authenticates username with the given password. An empty
+// username means the session owner, whose password is checked against the
+// duress password before PAM and who may need a TOTP code after it. A
+// trusted USB device must be present if any are configured. Unlocks by
+// other users are audited.
+func (h *LockHelper) AuthenticateUser(username string, password []byte) AuthResult {
+	owner := h.authenticator.username
+	if username == "" || username == owner {
+		h.duressPending = false
+		duress := h.checkDuress(password)
+
+		var result AuthResult
+		if duress {
+			result = AuthResult{Success: true, Message: "Authentication successful"}
+		} else {
+			result = h.authenticator.Authenticate(password)
+		}
+
+		result = h.checkUnlockDevice(result)
+		if result.Success && h.SecondFactorEnabled() {
+			// The duress hooks wait for the code like the unlock does
+			h.duressPending = duress
+			return AuthResult{Success: false, SecondFactor: true, Message: "Enter authentication code"}
+		}
+		if result.Success && duress {
+			h.startDuressHook()
+		}
+		return result
+	}
+
+	if !h.IsUnlockAllowed(username) {
+		Info("User %s is not allowed to unlock this session", username)
+		return AuthResult{
+			Success:    false,
+			Message:    fmt.Sprintf("User %s is not allowed to unlock this session", username),
+			ErrorClass: "not allowed to unlock",
+		}
+	}
+
+	auth := &PamAuthenticator{
+		serviceName: h.config.PamService,
+		username:    username,
+	}
+	result := h.checkUnlockDevice(auth.Authenticate(password))
+
+	if result.Success {
+		Info("Session of %s unlocked by %s", owner, username)
+		h.audit.Log(AuditEntry{
+			Event:       AuditEventUnlockByOther,
+			User:        username,
+			SessionUser: owner,
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"image"
+	"image/draw"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/unicode/bidi"
+)
+
+// Text alignment. Start and end follow the direction of the text, so start
+// is the left edge for English and the right edge for Hebrew or Arabic.
+const (
+	AlignStart  = "start"
+	AlignCenter = "center"
+	AlignEnd    = "end"
+)
+
+// ellipsis replaces the end of text that doesn't fit
+const ellipsis = "…"
+
+// textBox is where and how a block of text is laid out
+type textBox struct {
+	left, width int    // Horizontal extent lines are aligned in
+	baseline    int    // Baseline of the first line
+	maxLines    int    // Lines after this many are cut off with an ellipsis
+	align       string // AlignStart, AlignCenter or AlignEnd
+}
+
+// textLayout is text broken into lines that fit a textBox
+type textLayout struct {
+	face       *chainFace
+	box        textBox
+	lines      []string // In logical order
+	rtl        bool     // Whether the paragraph is right-to-left
+	lineHeight int
+}
+
+// layoutText breaks text into lines of at most box.width pixels, breaking
+// between words where it can and within words where it must
+func layoutText(face *chainFace, text string, box textBox) *textLayout {
+	l := &textLayout{
+		face:       face,
+		box:        box,
+		rtl:        isRightToLeft(text),
+		lineHeight: face.Metrics().Height.Ceil(),
+	}
+	maxWidth := fixed.I(box.width)
+
+	for _, paragraph := range strings.Split(text, "\n") {
+		l.lines = append(l.lines, wrapParagraph(face, paragraph, maxWidth)...)
+	}
+
+	if box.maxLines > 0 && len(l.lines) > box.maxLines {
+		last := l.lines[box.maxLines-1] + " " + strings.Join(l.lines[box.maxLines:], " ")
+		l.lines = l.lines[:box.maxLines]
+		l.lines[box.maxLines-1] = truncate(face, last, maxWidth)
+	}
+	return l
+}
+
+// wrapParagraph breaks a paragraph into lines no wider than maxWidth
+func wrapParagraph(face *chainFace, paragraph string, maxWidth fixed.Int26_6) []string {
+	words := strings.Fields(paragraph)
+	if len(words) == 0 {
+		return []string{""}
+	}
+
+	var lines []string
+	line := ""
+	for _, word := range words {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if face.Measure(candidate) <= maxWidth {
+			line = candidate
+			continue
+		}
+
+		if line != "" {
+			lines = append(lines, line)
+		}
+		// A word wider than a whole line is broken wherever it has to be
+		for face.Measure(word) > maxWidth {
+			head := fitPrefix(face, word, maxWidth)
+			lines = append(lines, head)
+			word = word[len(head):]
+		}
+		line = word
+	}
+	return append(lines, line)
+}
+
+// fitPrefix returns the longest prefix of text that fits maxWidth, at least
+// one character so breaking always makes progress
+func fitPrefix(face *chainFace, text string, maxWidth fixed.Int26_6) string {
+	end := 0
+	for i, r := range text {
+		next := i + len(string(r))
+		if end > 0 && face.Measure(text[:next]) > maxWidth {
+			break
+		}
+		end = next
+	}
+	return text[:end]
+}
+
+// truncate shortens text to fit maxWidth, ending it with an ellipsis if any
+// of it had to go
+func truncate(face *chainFace, text string, maxWidth fixed.Int26_6) string {
+	if face.Measure(text) <= maxWidth {
+		return text
+	}
+
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		shortened := strings.TrimRightFunc(string(runes), unicode.IsSpace) + ellipsis
+		if face.Measure(shortened) <= maxWidth {
+			return shortened
+		}
+	}
+	return ellipsis
+}
+
+// isRightToLeft reports whether the first character of text with a strong
+// direction is right-to-left
+func isRightToLeft(text string) bool {
+	for _, r := range text {
+		props, _ := bidi.LookupRune(r)
+		switch props.Class() {
+		case bidi.L:
+			return false
+		case bidi.R, bidi.AL:
+			return true
+		}
+	}
+	return false
+}
+
+// visualOrder returns line in the order its characters appear on screen.
+// Right-to-left runs are mirrored, and in a right-to-left paragraph the runs
+// go from right to left too.
+func visualOrder(line string, rtl bool) string {
+	direction := bidi.LeftToRight
+	if rtl {
+		direction = bidi.RightToLeft
+	}
+
+	var p bidi.Paragraph
+	if _, err := p.SetString(line, bidi.DefaultDirection(direction)); err != nil {
+		return line
+	}
+	ordering, err := p.Order()
+	if err != nil || ordering.NumRuns() == 0 {
+		return line
+	}
+
+	runs := make([]string, ordering.NumRuns())
+	for i := range runs {
+		run := ordering.Run(i)
+		runs[i] = run.String()
+		if run.Direction() == bidi.RightToLeft {
+			runs[i] = bidi.ReverseString(runs[i])
+		}
+	}
+	if rtl {
+		for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+			runs[i], runs[j] = runs[j], runs[i]
+		}
+	}
+	return strings.Join(runs, "")
+}
+
+// lineX returns where a line of the given width starts
+func (l *textLayout) lineX(width int) int {
+	align := l.box.align
+	if l.rtl {
+		// Start and end swap sides for right-to-left text
+		switch align {
+		case AlignStart:
+			align = AlignEnd
+		case AlignEnd:
+			align = AlignStart
+		}
+	}
+
+	switch align {
+	case AlignStart:
+		return l.box.left
+	case AlignEnd:
+		return l.box.left + l.box.width - width
+	default:
+		return l.box.left + (l.box.width-width)/2
+	}
+}
+
+// Draw draws the lines in color src and returns the area they cover
+func (l *textLayout) Draw(img draw.Image, src image.Image) image.Rectangle {
+	var area image.Rectangle
+	for i, line := range l.lines {
+		visual := visualOrder(line, l.rtl)
+		x := l.lineX(l.face.Measure(visual).Round())
+		y := l.box.baseline + i*l.lineHeight
+		area = area.Union(l.face.Draw(img, src, fixed.P(x, y), visual))
+	}
+	return area
+}
+
+// LastBaseline returns the baseline of the last line
+func (l *textLayout) LastBaseline() int {
+	return l.box.baseline + (max(len(l.lines), 1)-1)*l.lineHeight
+}
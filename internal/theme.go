@@ -0,0 +1,327 @@
+package internal
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed themes/*.json
+var builtinThemes embed.FS
+
+// defaultThemeName is the theme used when none is configured
+const defaultThemeName = "default"
+
+// Layout anchors, where the password prompt sits on the screen
+const (
+	AnchorTop    = "top"
+	AnchorCenter = "center"
+	AnchorBottom = "bottom"
+)
+
+// Theme describes how the lock screen looks. Theme files are JSON and only
+// need the fields they change, the rest comes from the default theme.
+type Theme struct {
+	Background ThemeBackground `json:"background"`
+	Font       ThemeFont       `json:"font"`
+	Dots       ThemeDots       `json:"dots"`
+	Layout     ThemeLayout     `json:"layout"`
+
+	// Prompt colors while nothing is typed, while typing, while the
+	// password is checked and while the failed attempt animation plays
+	Idle      ThemeColors `json:"idle"`
+	Typing    ThemeColors `json:"typing"`
+	Verifying ThemeColors `json:"verifying"`
+	Failed    ThemeColors `json:"failed"`
+
+	Lockout ThemeLockout `json:"lockout"`
+	Clock   ThemeClock   `json:"clock"`
+	Avatar  ThemeAvatar  `json:"avatar"`
+}
+
+// ThemeBackground is what fills the Wayland lock surfaces. background_color
+// and background_image in the configuration take precedence.
+type ThemeBackground struct {
+	Color string `json:"color"` // #rrggbb
+	Image string `json:"image"` // PNG, JPEG, GIF or WebP file, relative to the theme directory, optional
+}
+
+// ThemeFont selects the fonts and their sizes in logical pixels. Fonts are
+// fontconfig family names or font files. Characters the family has no glyph
+// for come from the first fallback that has one, then from the built-in
+// DejaVu Sans Bold.
+type ThemeFont struct {
+	Family       string   `json:"family"`   // "" for the built-in DejaVu Sans Bold
+	Fallback     []string `json:"fallback"` // Tried in order for missing glyphs
+	Size         float64  `json:"size"`     // Prompt texts
+	TitleSize    float64  `json:"title_size"`
+	SubtitleSize float64  `json:"subtitle_size"`
+}
+
+// ThemeDots sizes the password dots in logical pixels
+type ThemeDots struct {
+	Radius  int `json:"radius"`
+	Spacing int `json:"spacing"` // Between dot centers
+}
+
+// ThemeLayout places the password prompt. The dots are offset pixels below
+// the anchor, which is margin pixels from the top or bottom edge for those
+// anchors. Texts go text_gap pixels above and below the dots, with line_gap
+// pixels between the lines below. They're aligned in a centered column of
+// text_width pixels and wrap when they don't fit.
+type ThemeLayout struct {
+	Anchor    string `json:"anchor"` // top, center or bottom
+	Offset    int    `json:"offset"`
+	Margin    int    `json:"margin"`
+	TextGap   int    `json:"text_gap"`
+	LineGap   int    `json:"line_gap"`
+	Align     string `json:"align"`      // start, center or end
+	TextWidth int    `json:"text_width"` // 0 for the width of the screen
+}
+
+// ThemeColors are the prompt colors of one state, #rrggbb or #rrggbbaa
+type ThemeColors struct {
+	Dots string `json:"dots"`
+	Text string `json:"text"`
+}
+
+// ThemeLockout is the lockout countdown screen
+type ThemeLockout struct {
+	Shade    string `json:"shade"` // Drawn over the screen, #rrggbbaa
+	Text     string `json:"text"`
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle"`
+}
+
+// ThemeClock is the clock above the password prompt: the time, the date and
+// how long the screen has been locked, each on its own line. It's placed
+// like the prompt, the time's baseline is offset pixels below the anchor.
+type ThemeClock struct {
+	TimeFormat string  `json:"time_format"` // strftime format, "" hides the time
+	DateFormat string  `json:"date_format"` // strftime format, "" hides the date
+	LockedFor  string  `json:"locked_for"`  // %s is how long, "" hides the line
+	TimeSize   float64 `json:"time_size"`
+	DateSize   float64 `json:"date_size"` // Also the size of the locked for line
+	Color      string  `json:"color"`
+	Shadow     string  `json:"shadow"` // Drawn behind the texts, keeps them readable over media
+	Anchor     string  `json:"anchor"` // top, center or bottom
+	Offset     int     `json:"offset"`
+	Margin     int     `json:"margin"`
+	LineGap    int     `json:"line_gap"`
+}
+
+// ThemeAvatar is the picture and real name of the session's user. They go
+// above the password dots, where the switch user label replaces them. The
+// picture is cut into a circle, gap pixels above the name.
+type ThemeAvatar struct {
+	Size        int     `json:"size"`   // Diameter, 0 hides the picture
+	Border      int     `json:"border"` // Width of the ring around the picture, 0 for none
+	BorderColor string  `json:"border_color"`
+	Gap         int     `json:"gap"`
+	ShowName    bool    `json:"show_name"`
+	NameSize    float64 `json:"name_size"`
+}
+
+// Shown reports whether the clock shows anything
+func (c ThemeClock) Shown() bool {
+	return c.TimeFormat != "" || c.DateFormat != "" || c.LockedFor != ""
+}
+
+// Seconds reports whether the clock changes every second rather than every
+// minute
+func (c ThemeClock) Seconds() bool {
+	return showsSeconds(c.TimeFormat) || showsSeconds(c.DateFormat)
+}
+
+// DefaultTheme returns the theme FancyLock looks like out of the box
+func DefaultTheme() Theme {
+	return Theme{
+		Background: ThemeBackground{Color: defaultBackgroundColor},
+		Font:       ThemeFont{Size: 32, TitleSize: 96, SubtitleSize: 36},
+		Dots:       ThemeDots{Radius: 12, Spacing: 40},
+		Layout:     ThemeLayout{Anchor: AnchorCenter, Offset: 70, TextGap: 60, LineGap: 50, Align: AlignCenter},
+		Idle:       ThemeColors{Dots: "#ffffff", Text: "#ffffff"},
+		Typing:     ThemeColors{Dots: "#ffffff", Text: "#ffffff"},
+		Verifying:  ThemeColors{Dots: "#ffffff", Text: "#ffffff"},
+		Failed:     ThemeColors{Dots: "#ffffff", Text: "#ffffff"},
+		Lockout: ThemeLockout{
+			Shade:    "#000000c8",
+			Text:     "#ffffff",
+			Title:    "INTRUDER ALERT",
+			Subtitle: "Security cooldown engaged",
+		},
+		Clock: ThemeClock{
+			TimeFormat: "%H:%M",
+			DateFormat: "%A %-d %B",
+			LockedFor:  "Locked for %s",
+			TimeSize:   72,
+			DateSize:   28,
+			Color:      "#ffffff",
+			Shadow:     "#00000080",
+			Anchor:     AnchorTop,
+			Margin:     140,
+			LineGap:    44,
+		},
+		Avatar: ThemeAvatar{
+			Size:        96,
+			Border:      3,
+			BorderColor: "#ffffffc0",
+			Gap:         16,
+			ShowName:    true,
+			NameSize:    32,
+		},
+	}
+}
+
+// userThemeDir returns ~/.config/fancylock/themes, next to config.json
+func userThemeDir() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".config", "fancylock", "themes")
+}
+
+// LoadTheme loads the named theme. A file NAME.json in the user theme
+// directory wins over the built-in theme of the same name.
+func LoadTheme(name string) (Theme, error) {
+	if name == "" {
+		name = defaultThemeName
+	}
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return Theme{}, fmt.Errorf("invalid theme name %q", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(userThemeDir(), name+".json"))
+	if os.IsNotExist(err) {
+		data, err = builtinThemes.ReadFile("themes/" + name + ".json")
+		if err != nil {
+			return Theme{}, fmt.Errorf("unknown theme %q, built-in themes are %s", name, strings.Join(BuiltinThemeNames(), ", "))
+		}
+	} else if err != nil {
+		return Theme{}, fmt.Errorf("failed to read theme %q: %v", name, err)
+	}
+
+	theme := DefaultTheme()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&theme); err != nil {
+		return Theme{}, fmt.Errorf("failed to parse theme %q: %v", name, err)
+	}
+
+	// Images of user themes may sit next to the theme file
+	if theme.Background.Image != "" && !filepath.IsAbs(theme.Background.Image) {
+		theme.Background.Image = filepath.Join(userThemeDir(), theme.Background.Image)
+	}
+	if err := theme.validate(); err != nil {
+		return Theme{}, fmt.Errorf("invalid theme %q: %v", name, err)
+	}
+
+	return theme, nil
+}
+
+// ThemeFor returns the theme config asks for, or the default theme if it
+// can't be loaded, so a broken theme never keeps the screen from locking
+func ThemeFor(config Configuration) Theme {
+	theme, err := LoadTheme(config.Theme)
+	if err != nil {
+		Error("Using the default theme: %v", err)
+		return DefaultTheme()
+	}
+	return theme
+}
+
+// BuiltinThemeNames lists the themes that come with FancyLock
+func BuiltinThemeNames() []string {
+	entries, _ := builtinThemes.ReadDir("themes")
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate checks that every color parses and every size makes sense
+func (t Theme) validate() error {
+	if _, err := parseHexColor(t.Background.Color); err != nil {
+		return fmt.Errorf("background.color: %v", err)
+	}
+
+	colors := map[string]string{
+		"idle.dots":           t.Idle.Dots,
+		"idle.text":           t.Idle.Text,
+		"typing.dots":         t.Typing.Dots,
+		"typing.text":         t.Typing.Text,
+		"verifying.dots":      t.Verifying.Dots,
+		"verifying.text":      t.Verifying.Text,
+		"failed.dots":         t.Failed.Dots,
+		"failed.text":         t.Failed.Text,
+		"lockout.shade":       t.Lockout.Shade,
+		"lockout.text":        t.Lockout.Text,
+		"clock.color":         t.Clock.Color,
+		"clock.shadow":        t.Clock.Shadow,
+		"avatar.border_color": t.Avatar.BorderColor,
+	}
+	for field, value := range colors {
+		if _, err := parseThemeColor(value); err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+	}
+
+	if t.Font.Size <= 0 || t.Font.TitleSize <= 0 || t.Font.SubtitleSize <= 0 || t.Clock.TimeSize <= 0 || t.Clock.DateSize <= 0 || t.Avatar.NameSize <= 0 {
+		return fmt.Errorf("font sizes must be positive")
+	}
+	if t.Dots.Radius <= 0 || t.Dots.Spacing < 2*t.Dots.Radius {
+		return fmt.Errorf("dots need a positive radius and a spacing of at least twice the radius")
+	}
+
+	for field, anchor := range map[string]string{"layout.anchor": t.Layout.Anchor, "clock.anchor": t.Clock.Anchor} {
+		switch anchor {
+		case AnchorTop, AnchorCenter, AnchorBottom:
+		default:
+			return fmt.Errorf("%s must be %s, %s or %s", field, AnchorTop, AnchorCenter, AnchorBottom)
+		}
+	}
+
+	if t.Avatar.Size < 0 || t.Avatar.Border < 0 || t.Avatar.Gap < 0 {
+		return fmt.Errorf("avatar sizes must not be negative")
+	}
+
+	switch t.Layout.Align {
+	case AlignStart, AlignCenter, AlignEnd:
+	default:
+		return fmt.Errorf("layout.align must be %s, %s or %s", AlignStart, AlignCenter, AlignEnd)
+	}
+	if t.Layout.TextWidth < 0 {
+		return fmt.Errorf("layout.text_width must not be negative")
+	}
+
+	return nil
+}
+
+// parseThemeColor parses a color in the form #rrggbb or #rrggbbaa
+func parseThemeColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb or #rrggbbaa", s)
+	}
+	return color.NRGBA{R: uint8(value >> 24), G: uint8(value >> 16), B: uint8(value >> 8), A: uint8(value)}, nil
+}
+
+// themeColor parses a color of a validated theme
+func themeColor(s string) color.NRGBA {
+	c, _ := parseThemeColor(s)
+	return c
+}
@@ -0,0 +1,359 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// totpPeriod and totpDigits are the RFC 6238 defaults that every
+	// authenticator app supports
+	totpPeriod = 30
+	totpDigits = 6
+
+	// totpSkew is how many time steps before and after now are accepted
+	totpSkew = 1
+
+	// totpSecretSize is the length of new secrets in bytes
+	totpSecretSize = 20
+
+	// totpRecoveryCodes is the number of recovery codes created on enrollment
+	totpRecoveryCodes = 10
+)
+
+// totpEncoding is base32 without padding, as used in otpauth URIs
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpFile is the on-disk TOTP secret with the unused recovery codes
+type totpFile struct {
+	Secret        string   `json:"secret"`         // Base32 secret shared with the authenticator app
+	RecoveryCodes []string `json:"recovery_codes"` // SHA-256 of each unused recovery code
+	LastCounter   uint64   `json:"last_counter"`   // Last time step used, so a code can't be replayed
+}
+
+// defaultTOTPSecretPath returns the default location of the TOTP secret
+func defaultTOTPSecretPath() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".config", "fancylock", "totp.json")
+}
+
+// totpSecretPath returns the configured TOTP secret path or the default one
+func totpSecretPath(config Configuration) string {
+	if config.TOTPSecretFile != "" {
+		return config.TOTPSecretFile
+	}
+	return defaultTOTPSecretPath()
+}
+
+// totpCode computes the code for a time step as described in RFC 4226
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// totpCounter returns the time step of t
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix()) / totpPeriod
+}
+
+// matchTOTP returns the time step that code is valid for, checking the steps
+// around now in constant time per step
+func matchTOTP(secret []byte, code string, now time.Time) (uint64, bool) {
+	current := totpCounter(now)
+	var matched uint64
+	found := false
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			matched = step
+			found = true
+		}
+	}
+	return matched, found
+}
+
+// hashRecoveryCode returns the stored form of a recovery code
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes in recovery codes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// newRecoveryCode returns a random recovery code like "abcde-fghij"
+func newRecoveryCode() (string, error) {
+	raw := make([]byte, 7)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code: %v", err)
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(raw))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// loadTOTPFile reads the TOTP secret, refusing files other users can access
+func loadTOTPFile(path string) (*totpFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access TOTP secret: %v", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s must not be accessible by other users (chmod 600)", path)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return nil, fmt.Errorf("%s is not owned by the current user", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TOTP secret: %v", err)
+	}
+
+	var file totpFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse TOTP secret: %v", err)
+	}
+	if _, err := totpEncoding.DecodeString(file.Secret); err != nil || file.Secret == "" {
+		return nil, fmt.Errorf("TOTP secret in %s is not valid base32", path)
+	}
+
+	return &file, nil
+}
+
+// saveTOTPFile atomically writes the TOTP secret
+func saveTOTPFile(path string, file *totpFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal TOTP secret: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create TOTP secret directory: %v", err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+// SecondFactorEnabled returns whether a TOTP code is required after PAM
+func (h *LockHelper) SecondFactorEnabled() bool {
+	return h.config.TOTPEnabled
+}
+
+// CheckSecondFactor makes sure the TOTP secret can be used if totp_enabled is
+// set. Locking with a second factor nobody could enter would lock the owner
+// out for good, so lockers refuse to start when this fails.
+func CheckSecondFactor(config Configuration) error {
+	if !config.TOTPEnabled {
+		return nil
+	}
+	if _, err := loadTOTPFile(totpSecretPath(config)); err != nil {
+		return fmt.Errorf("totp_enabled is set but the secret can't be used, run fancylock totp enroll: %v", err)
+	}
+	return nil
+}
+
+// VerifySecondFactor checks a TOTP or recovery code for the session owner.
+// Used recovery codes and time steps are consumed. If the duress password
+// came before the code, its hooks start once the code is accepted.
+func (h *LockHelper) VerifySecondFactor(code []byte) AuthResult {
+	duress := h.duressPending
+	h.duressPending = false
+
+	result := h.verifyCode(code)
+	if result.Success && duress {
+		h.startDuressHook()
+	}
+	return result
+}
+
+// verifyCode checks a TOTP or recovery code against the enrolled secret
+func (h *LockHelper) verifyCode(code []byte) AuthResult {
+	failed := func(class string) AuthResult {
+		return AuthResult{
+			Success:    false,
+			Message:    "Invalid authentication code",
+			ErrorClass: "totp: " + class,
+		}
+	}
+
+	path := totpSecretPath(h.config)
+	file, err := loadTOTPFile(path)
+	if err != nil {
+		Error("Unable to check authentication code: %v", err)
+		return failed("secret unavailable")
+	}
+
+	secret, _ := totpEncoding.DecodeString(file.Secret)
+	input := strings.TrimSpace(string(code))
+
+	if len(input) == totpDigits {
+		step, ok := matchTOTP(secret, input, time.Now())
+		if !ok {
+			return failed("invalid code")
+		}
+		if step <= file.LastCounter {
+			Info("Rejected an authentication code that was already used")
+			return failed("code reused")
+		}
+		file.LastCounter = step
+		if err := saveTOTPFile(path, file); err != nil {
+			Error("Failed to save TOTP state: %v", err)
+		}
+		return AuthResult{Success: true, Message: "Authentication successful"}
+	}
+
+	// Anything else may be a recovery code
+	hash := hashRecoveryCode(input)
+	for i, stored := range file.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(stored)) != 1 {
+			continue
+		}
+		file.RecoveryCodes = append(file.RecoveryCodes[:i], file.RecoveryCodes[i+1:]...)
+		if err := saveTOTPFile(path, file); err != nil {
+			// Refuse the code rather than letting it be used again
+			Error("Failed to consume recovery code: %v", err)
+			return failed("secret unavailable")
+		}
+		Info("Recovery code used, %d left", len(file.RecoveryCodes))
+		return AuthResult{Success: true, Message: "Authentication successful"}
+	}
+
+	return failed("invalid code")
+}
+
+// readLine prompts on the terminal and reads a line
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read input: %v", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// RunTOTPCommand implements "fancylock totp", which manages the TOTP secret
+func RunTOTPCommand(args []string) error {
+	if len(args) == 0 || args[0] != "enroll" {
+		fmt.Fprintf(os.Stderr, "Usage: fancylock totp enroll [options]\n")
+		return fmt.Errorf("unknown or missing totp command")
+	}
+
+	flags := flag.NewFlagSet("totp enroll", flag.ContinueOnError)
+	configPath := flags.String("c", "", "Path to configuration file")
+	flags.StringVar(configPath, "config", "", "Path to configuration file")
+	force := flags.Bool("force", false, "Replace an existing secret")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: fancylock totp enroll [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fmt.Fprintf(os.Stderr, "  -c, --config string\n    	Path to configuration file\n")
+		fmt.Fprintf(os.Stderr, "  --force\n    	Replace an existing secret\n")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	config := DefaultConfig()
+	if *configPath == "" {
+		*configPath = DefaultConfigPath()
+	}
+	if *configPath != "" {
+		if err := LoadConfig(*configPath, &config); err != nil {
+			return err
+		}
+	}
+
+	path := totpSecretPath(config)
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use --force to replace it", path)
+	}
+
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("failed to generate secret: %v", err)
+	}
+	encoded := totpEncoding.EncodeToString(secret)
+
+	username := os.Getenv("USER")
+	hostname, _ := os.Hostname()
+	label := url.PathEscape("FancyLock:" + username + "@" + hostname)
+	uri := fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=FancyLock&algorithm=SHA1&digits=%d&period=%d",
+		label, encoded, totpDigits, totpPeriod)
+
+	qr, err := EncodeQR([]byte(uri))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Scan this code with your authenticator app:")
+	fmt.Println()
+	fmt.Print(qr.Terminal())
+	fmt.Println()
+	fmt.Printf("Or enter the secret manually: %s\n\n", encoded)
+
+	// Make sure the app is set up before anything depends on it
+	code, err := readLine("Enter the code shown by the app: ")
+	if err != nil {
+		return err
+	}
+	if _, ok := matchTOTP(secret, code, time.Now()); !ok {
+		return fmt.Errorf("the code is not valid, nothing was saved")
+	}
+
+	file := &totpFile{Secret: encoded, LastCounter: totpCounter(time.Now())}
+	codes := make([]string, 0, totpRecoveryCodes)
+	for i := 0; i < totpRecoveryCodes; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return err
+		}
+		codes = append(codes, code)
+		file.RecoveryCodes = append(file.RecoveryCodes, hashRecoveryCode(code))
+	}
+
+	if err := saveTOTPFile(path, file); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nSaved the secret to %s\n\n", path)
+	fmt.Println("Recovery codes, each works once in place of a code. Keep them somewhere safe:")
+	for _, code := range codes {
+		fmt.Printf("  %s\n", code)
+	}
+	if !config.TOTPEnabled {
+		fmt.Println("\nSet \"totp_enabled\": true in the config to require a code when unlocking.")
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTOTPFile saves a TOTP secret for tests and returns its path
+func writeTOTPFile(t *testing.T, file *totpFile) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "totp.json")
+	if err := saveTOTPFile(path, file); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, cut to the 6 digits authenticator apps show
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		counter := totpCounter(time.Unix(tt.time, 0))
+		if got := totpCode(rfc6238Secret, counter); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := totpCounter(now)
+
+	tests := []struct {
+		name    string
+		counter uint64
+		want    bool
+	}{
+		{"current step", current, true},
+		{"previous step", current - 1, true},
+		{"next step", current + 1, true},
+		{"two steps ago", current - 2, false},
+		{"two steps ahead", current + 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := matchTOTP(rfc6238Secret, totpCode(rfc6238Secret, tt.counter), now)
+			if ok != tt.want {
+				t.Fatalf("matched = %v, want %v", ok, tt.want)
+			}
+			if ok && step != tt.counter {
+				t.Errorf("step = %d, want %d", step, tt.counter)
+			}
+		})
+	}
+}
+
+func TestSecondFactorRejectsReplay(t *testing.T) {
+	h := &LockHelper{}
+	h.config.TOTPEnabled = true
+	h.config.TOTPSecretFile = writeTOTPFile(t, &totpFile{Secret: totpEncoding.EncodeToString(rfc6238Secret)})
+
+	code := totpCode(rfc6238Secret, totpCounter(time.Now()))
+	if result := h.VerifySecondFactor([]byte(code)); !result.Success {
+		t.Fatalf("first use: %+v", result)
+	}
+
+	file, err := loadTOTPFile(h.config.TOTPSecretFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.LastCounter == 0 {
+		t.Error("used time step wasn't saved")
+	}
+
+	// The same code, and any earlier one, is refused from the saved step
+	if result := h.VerifySecondFactor([]byte(code)); result.Success || result.ErrorClass != "totp: code reused" {
+		t.Errorf("replayed code: %+v", result)
+	}
+	previous := totpCode(rfc6238Secret, file.LastCounter-1)
+	if result := h.VerifySecondFactor([]byte(previous)); result.Success {
+		t.Errorf("earlier code accepted: %+v", result)
+	}
+	if result := h.VerifySecondFactor([]byte("000000x")); result.Success || result.ErrorClass != "totp: invalid code" {
+		t.Errorf("invalid code: %+v", result)
+	}
+}
+
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	h := &LockHelper{}
+	h.config.TOTPEnabled = true
+	h.config.TOTPSecretFile = writeTOTPFile(t, &totpFile{
+		Secret:        totpEncoding.EncodeToString(rfc6238Secret),
+		RecoveryCodes: []string{hashRecoveryCode("abcde-fghij"), hashRecoveryCode("klmno-pqrst")},
+	})
+
+	// Case, spaces and dashes don't matter
+	if result := h.VerifySecondFactor([]byte(" ABCDE FGHIJ ")); !result.Success {
+		t.Fatalf("first use: %+v", result)
+	}
+	if result := h.VerifySecondFactor([]byte("abcde-fghij")); result.Success {
+		t.Error("recovery code accepted twice")
+	}
+
+	file, err := loadTOTPFile(h.config.TOTPSecretFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.RecoveryCodes) != 1 || file.RecoveryCodes[0] != hashRecoveryCode("klmno-pqrst") {
+		t.Errorf("recovery codes left = %v, want only the unused one", file.RecoveryCodes)
+	}
+	if result := h.VerifySecondFactor([]byte("klmnopqrst")); !result.Success {
+		t.Errorf("other recovery code: %+v", result)
+	}
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"image"
 	"os/exec"
 	"sync"
 	"time"
@@ -18,6 +19,7 @@ type Monitor struct {
 	Y      int
 	Width  int
 	Height int
+	Scale  float64 // UI scale, 0 if unknown
 }
 
 // X11Locker implements the ScreenLocker interface for X11
@@ -31,14 +33,35 @@ type X11Locker struct {
 	height         uint16
 	helper         *LockHelper
 	mediaPlayer    *MediaPlayer
-	passwordBuf    string
+	securePassword *SecurePassword
 	isLocked       bool
-	passwordDots   []bool // true for filled, false for empty
-	maxDots        int
-	dotWindows     []xproto.Window // Track password dot windows
+	passwordDots   []bool          // true for filled, false for empty
 	lockoutManager *LockoutManager // Use the shared lockout manager
-	messageWindows []xproto.Window // Windows for displaying lockout messages on each monitor
-	textGC         xproto.Gcontext // Graphics context for drawing text
+	switchUser     *SwitchUserPrompt
+	statusMessage  string          // Shown below the password dots, e.g. remaining attempts
+	unlockedBy     string          // User who unlocked the session, "" for the owner
+	awaitingCode   bool            // Whether the password was accepted and a TOTP code is next
+	injectedEvents int             // Input events sent or faked by other clients during this lock
+	xinput         *xiInput        // Tells input faked through XTest apart, nil if it can't
+	synthetic      chan string     // Input events other clients sent with SendEvent
+	loweredWindows []xproto.Window // Windows pushed below the lock, raised again on unlock
+	renderer       *Renderer
+	uiDepth        byte            // Depth of the UI windows, 32 with a compositor
+	uiVisual       xproto.Visualid // Visual of the UI windows
+	uiColormap     xproto.Colormap // Colormap of the ARGB visual, 0 with the root visual
+	uiGC           xproto.Gcontext // GC matching the depth of the UI windows
+	outputs        []x11Output     // UI window of each monitor
+	shakeOffset    int             // Horizontal offset of the dots during the shake animation
+	verifying      bool            // Whether the password is being checked
+	failed         bool            // Whether the failed attempt animation is playing
+	lockoutShown   bool            // Whether the last frame showed the lockout countdown
+}
+
+// x11Output is the UI windows of one monitor with the frame drawn into them
+type x11Output struct {
+	monitor Monitor
+	windows []xproto.Window // One per part of the UI, created when needed
+	frame   *image.RGBA
 }
 
 // MediaType defines the type of media file
@@ -98,17 +121,106 @@ type Configuration struct {
 	// Enable debug exit with ESC or Q key
 	DebugExit bool `json:"debug_exit"`
 
-	// Command to run before locking the screen
+	// Command to run before locking the screen (deprecated, use the on_lock hook)
 	PreLockCommand string `json:"pre_lock_command"`
 
-	// Command to run after unlocking the screen
+	// Command to run after unlocking the screen (deprecated, use the on_unlock hook)
 	PostLockCommand string `json:"post_lock_command"`
 
+	// Commands to run at points of the lock lifecycle, keyed by hook name
+	Hooks map[string][]HookConfig `json:"hooks"`
+
+	// Seconds without input on the lock screen before the on_idle hook runs
+	IdleSeconds int `json:"idle_seconds"`
+
+	// Hash of a password that unlocks the session and runs the on_duress hook
+	DuressPasswordHash string `json:"duress_password_hash"`
+
+	// Whether to ask for a TOTP code after the password
+	TOTPEnabled bool `json:"totp_enabled"`
+
+	// Path of the TOTP secret, empty for the default location
+	TOTPSecretFile string `json:"totp_secret_file"`
+
+	// Whether to accept a fingerprint through fprintd while the password is typed
+	FingerprintEnabled bool `json:"fingerprint_enabled"`
+
+	// USB devices of which one must be plugged in to unlock
+	UnlockDevices []USBDeviceRule `json:"unlock_devices"`
+
+	// USB devices whose removal locks the screen in daemon mode
+	LockOnRemove []USBDeviceRule `json:"lock_on_remove"`
+
+	// How long a lock_on_remove device must stay unplugged before locking
+	LockOnRemoveDebounceMs int `json:"lock_on_remove_debounce_ms"`
+
+	// Where sysfs is mounted, can point elsewhere for testing
+	SysfsRoot string `json:"sysfs_root"`
+
+	// Name of the theme, a built-in one or NAME.json in ~/.config/fancylock/themes
+	Theme string `json:"theme"`
+
+	// Color behind the Wayland lock prompt, as #rrggbb, empty for the theme's
+	BackgroundColor string `json:"background_color"`
+
+	// Image behind the Wayland lock prompt, scaled to cover each output,
+	// empty for the theme's
+	BackgroundImage string `json:"background_image"`
+
+	// Whether the Wayland lock surfaces are transparent, so media played
+	// behind them shows through. Only for compositors known to handle it.
+	TransparentBackground bool `json:"transparent_background"`
+
 	// Whether to pause all media players when locking the screen
 	LockPauseMedia bool `json:"lock_pause_media"`
 
 	// Whether to unpause all media players when unlocking the screen
 	UnlockUnpauseMedia bool `json:"unlock_unpause_media"`
+
+	// Additional users that may unlock the session with their own password
+	UnlockUsers []string `json:"unlock_users"`
+
+	// Members of these groups may also unlock the session
+	UnlockGroups []string `json:"unlock_groups"`
+
+	// Policy for throttling failed unlock attempts
+	Lockout LockoutPolicy `json:"lockout"`
+
+	// Whether to read the pam_faillock tally so the lock screen matches system lockouts
+	FaillockEnabled bool `json:"faillock_enabled"`
+
+	// Directory holding pam_faillock tally files, empty to use faillock.conf
+	FaillockDir string `json:"faillock_dir"`
+
+	// Where to write the audit log: "file", "journal", "both" or "none"
+	AuditLog string `json:"audit_log"`
+
+	// Path of the JSON-lines audit log, empty for the default location
+	AuditLogPath string `json:"audit_log_path"`
+
+	// Whether to show a notification about failed attempts after unlocking
+	AwaySummary bool `json:"away_summary"`
+}
+
+// LockoutPolicy controls how failed unlock attempts are throttled
+type LockoutPolicy struct {
+	// Number of failed attempts before a lockout starts
+	MaxAttempts int `json:"max_attempts"`
+
+	// How lockouts grow: "fixed", "linear" or "exponential"
+	Backoff string `json:"backoff"`
+
+	// Duration of the first lockout in seconds
+	LockoutSeconds int `json:"lockout_seconds"`
+
+	// Upper bound for any lockout in seconds
+	MaxLockoutSeconds int `json:"max_lockout_seconds"`
+
+	// Whether pressing Enter with an empty password counts as a failure
+	CountEmptyAttempts bool `json:"count_empty_attempts"`
+
+	// Forget failed attempts after this many quiet seconds (0 disables)
+	ResetAfterSeconds int `json:"reset_after_seconds"`
 }
 
 // ScreenLocker interface defines methods that any screen locker should implement
@@ -119,8 +231,10 @@ type ScreenLocker interface {
 
 // AuthResult represents the result of an authentication attempt
 type AuthResult struct {
-	Success bool
-	Message string
+	Success      bool
+	Message      string
+	ErrorClass   string // PAM stage and error of a failure, safe to log
+	SecondFactor bool   // The password was right but a TOTP code is still needed
 }
 
 // PamAuthenticator handles PAM-based user authentication
@@ -129,9 +243,12 @@ type PamAuthenticator struct {
 	username    string
 }
 
+// SecurePassword holds password input in a fixed, mlocked buffer
 type SecurePassword struct {
-	data []byte
-	mu   sync.Mutex
+	buf    []byte // Fixed-size backing buffer, never reallocated
+	length int    // Number of bytes currently in use
+	mapped bool   // Whether buf is an mmap'd region that must be unmapped
+	mu     sync.Mutex
 }
 
 // WaylandDisplay handles the Wayland display connection
@@ -169,6 +286,7 @@ type surfaceHandler struct {
 	client      *WaylandLocker
 	surface     *wl.Surface
 	lockSurface *ext.SessionLockSurface
+	buffers     *surfaceBuffers
 }
 
 // outputInfo contains information about a Wayland output
@@ -176,6 +294,7 @@ type outputInfo struct {
 	x, y   int
 	width  int
 	height int
+	scale  int // wl_output.scale, 0 until the compositor sends it
 }
 
 // RegistryHandler handles Wayland registry events
@@ -185,6 +304,8 @@ type RegistryHandler struct {
 	lockManager      *ext.SessionLockManager
 	seat             *wl.Seat
 	shm              *wl.Shm
+	viewporter       *wpViewporter
+	fractionalScale  *wpFractionalScaleManager
 	outputs          map[uint32]*wl.Output
 	outputGeometries map[*wl.Output]outputInfo
 	locker           *WaylandLocker
@@ -208,6 +329,9 @@ type handlerFunc func(wl.OutputGeometryEvent)
 // outputModeHandlerFunc is a function type for handling output mode events
 type outputModeHandlerFunc func(ev wl.OutputModeEvent)
 
+// outputScaleHandlerFunc is a function type for handling output scale events
+type outputScaleHandlerFunc func(ev wl.OutputScaleEvent)
+
 // WaylandLocker represents a Wayland-based screen locker
 type WaylandLocker struct {
 	// Wayland connection and display
@@ -216,6 +340,8 @@ type WaylandLocker struct {
 	registryHandler *RegistryHandler
 	compositor      *wl.Compositor
 	shm             *wl.Shm
+	viewporter      *wpViewporter             // nil if the compositor lacks wp_viewporter
+	fractionalScale *wpFractionalScaleManager // nil if it lacks wp_fractional_scale_v1
 	seat            *wl.Seat
 	keyboard        *wl.Keyboard
 	pointer         *wl.Pointer
@@ -228,19 +354,38 @@ type WaylandLocker struct {
 	surfaces map[*wl.Output]struct {
 		wlSurface   *wl.Surface
 		lockSurface *ext.SessionLockSurface
+		buffers     *surfaceBuffers
 	}
 	outputs map[uint32]*wl.Output
 
 	// State
 	mu              sync.Mutex
-	done            chan struct{}
+	done            chan struct{} // Closed through finish when the lock is over
+	doneOnce        sync.Once
 	redrawCh        chan int
 	securePassword  *SecurePassword
+	switchUser      *SwitchUserPrompt
+	statusMessage   string // Shown below the password dots, e.g. remaining attempts
+	awaitingCode    bool   // Whether the password was accepted and a TOTP code is next
 	countdownActive bool
-	countdownTimer  *time.Timer
+	countdownTicker *time.Ticker
 	lockActive      bool
 	mediaPlayer     *MediaPlayer
 	lockoutManager  *LockoutManager
+	renderer        *Renderer
+
+	// Event loop, see runEventLoop
+	loopDone            chan struct{}
+	tasks               chan func()
+	authResults         chan authOutcome
+	authenticating      bool // Whether PAM is checking what was typed
+	shakeSteps          []int
+	shakeDots           int
+	shakeTimer          *time.Timer
+	afterShake          func()
+	clockTimer          *time.Timer // Fires when the clock shows something else
+	fingerprintEvents   <-chan FingerprintEvent
+	unlockDeviceChanges <-chan bool
 
 	// Keymap data
 	keymapData   []byte
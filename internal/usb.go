@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultSysfsRoot is where the kernel exposes sysfs
+	defaultSysfsRoot = "/sys"
+
+	// usbPollInterval is how often sysfs is rescanned when uevents aren't available
+	usbPollInterval = time.Second
+)
+
+// USBDeviceRule matches a USB device by its sysfs attributes. Empty fields
+// match any value.
+type USBDeviceRule struct {
+	Vendor  string `json:"vendor"`  // idVendor in hex, e.g. "1050"
+	Product string `json:"product"` // idProduct in hex, e.g. "0407"
+	Serial  string `json:"serial"`  // serial attribute, required for unlock_devices
+}
+
+// USBDevice is a USB device found in sysfs
+type USBDevice struct {
+	Name    string // sysfs name, e.g. "1-2"
+	Vendor  string
+	Product string
+	Serial  string
+}
+
+// String describes the rule for logs
+func (r USBDeviceRule) String() string {
+	s := r.Vendor + ":" + r.Product
+	if r.Serial != "" {
+		s += " serial " + r.Serial
+	}
+	return s
+}
+
+// Matches reports whether a device satisfies the rule
+func (r USBDeviceRule) Matches(device USBDevice) bool {
+	if r.Vendor != "" && !strings.EqualFold(r.Vendor, device.Vendor) {
+		return false
+	}
+	if r.Product != "" && !strings.EqualFold(r.Product, device.Product) {
+		return false
+	}
+	// A device without a serial never matches a rule that names one
+	if r.Serial != "" && (device.Serial == "" || r.Serial != device.Serial) {
+		return false
+	}
+	return true
+}
+
+// validateUSBDeviceRules makes sure every rule names at least a vendor and
+// product. Rules for a device that stands in as a factor need a serial too,
+// or any device of the same model would do.
+func validateUSBDeviceRules(name string, rules []USBDeviceRule, needSerial bool) error {
+	for i, rule := range rules {
+		if rule.Vendor == "" || rule.Product == "" {
+			return fmt.Errorf("%s #%d needs a vendor and a product", name, i+1)
+		}
+		if needSerial && strings.TrimSpace(rule.Serial) == "" {
+			return fmt.Errorf("%s #%d needs a serial", name, i+1)
+		}
+	}
+	return nil
+}
+
+// readSysfsAttr reads a sysfs attribute without its trailing newline
+func readSysfsAttr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// ScanUSBDevices lists the USB devices under sysfsRoot/bus/usb/devices
+func ScanUSBDevices(sysfsRoot string) ([]USBDevice, error) {
+	if sysfsRoot == "" {
+		sysfsRoot = defaultSysfsRoot
+	}
+	dir := filepath.Join(sysfsRoot, "bus", "usb", "devices")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list USB devices: %v", err)
+	}
+
+	var devices []USBDevice
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		// Interfaces like 1-2:1.0 have no idVendor and are skipped
+		vendor := readSysfsAttr(path, "idVendor")
+		if vendor == "" {
+			continue
+		}
+		devices = append(devices, USBDevice{
+			Name:    entry.Name(),
+			Vendor:  vendor,
+			Product: readSysfsAttr(path, "idProduct"),
+			Serial:  readSysfsAttr(path, "serial"),
+		})
+	}
+
+	return devices, nil
+}
+
+// matchUSBDevices returns whether any device satisfies any rule
+func matchUSBDevices(devices []USBDevice, rules []USBDeviceRule) bool {
+	for _, device := range devices {
+		for _, rule := range rules {
+			if rule.Matches(device) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openUeventSocket subscribes to kernel uevents over netlink
+func openUeventSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open uevent socket: %v", err)
+	}
+
+	// Group 1 carries the kernel's own events
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to bind uevent socket: %v", err)
+	}
+
+	// Wake up regularly so the monitor can notice it was stopped
+	timeout := unix.NsecToTimeval(usbPollInterval.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to set uevent socket timeout: %v", err)
+	}
+
+	return fd, nil
+}
+
+// parseUevent splits a kernel uevent into its action and properties
+func parseUevent(msg []byte) (string, map[string]string) {
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	action, _, _ := strings.Cut(string(fields[0]), "@")
+	props := make(map[string]string)
+	for _, field := range fields[1:] {
+		if key, value, found := strings.Cut(string(field), "="); found {
+			props[key] = value
+		}
+	}
+	return action, props
+}
+
+// isUSBDeviceUevent reports whether a uevent is about a whole USB device
+func isUSBDeviceUevent(msg []byte) bool {
+	action, props := parseUevent(msg)
+	if action != "add" && action != "remove" && action != "bind" && action != "unbind" {
+		return false
+	}
+	return props["SUBSYSTEM"] == "usb" && props["DEVTYPE"] == "usb_device"
+}
+
+// USBMonitor tracks whether a device matching any of its rules is plugged in
+type USBMonitor struct {
+	sysfsRoot string
+	rules     []USBDeviceRule
+	present   atomic.Bool
+	changes   chan bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewUSBMonitor scans sysfs once and then watches for devices coming and
+// going. Kernel uevents trigger rescans; with a custom sysfs root, or when
+// netlink isn't available, sysfs is polled instead.
+func NewUSBMonitor(sysfsRoot string, rules []USBDeviceRule) *USBMonitor {
+	if sysfsRoot == "" {
+		sysfsRoot = defaultSysfsRoot
+	}
+
+	m := &USBMonitor{
+		sysfsRoot: sysfsRoot,
+		rules:     rules,
+		changes:   make(chan bool, 1),
+		stop:      make(chan struct{}),
+	}
+	m.present.Store(m.scan())
+
+	go m.run()
+	return m
+}
+
+// scan checks sysfs for a matching device
+func (m *USBMonitor) scan() bool {
+	devices, err := ScanUSBDevices(m.sysfsRoot)
+	if err != nil {
+		Debug("USB scan failed: %v", err)
+		return false
+	}
+	return matchUSBDevices(devices, m.rules)
+}
+
+// Present returns whether a matching device is plugged in
+func (m *USBMonitor) Present() bool {
+	return m.present.Load()
+}
+
+// Changes delivers the new presence every time it changes
+func (m *USBMonitor) Changes() <-chan bool {
+	return m.changes
+}
+
+// Stop stops watching, it's safe to call twice
+func (m *USBMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// rescan updates the presence and reports a change
+func (m *USBMonitor) rescan() {
+	present := m.scan()
+	if m.present.Swap(present) == present {
+		return
+	}
+
+	Debug("Trusted USB device present: %v", present)
+
+	// Only the latest state matters, drop one nobody picked up yet
+	select {
+	case <-m.changes:
+	default:
+	}
+	m.changes <- present
+}
+
+// run watches for USB devices until the monitor is stopped
+func (m *USBMonitor) run() {
+	fd := -1
+	if m.sysfsRoot == defaultSysfsRoot {
+		var err error
+		fd, err = openUeventSocket()
+		if err != nil {
+			Warn("Falling back to polling for USB devices: %v", err)
+		}
+	}
+	if fd >= 0 {
+		defer unix.Close(fd)
+	}
+
+	buf := make([]byte, 8192)
+	ticker := time.NewTicker(usbPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+
+		if fd < 0 {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.rescan()
+			}
+			continue
+		}
+
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.ENOBUFS {
+			// The socket overran and events were lost, so look again
+			Debug("Uevent socket overran, rescanning USB devices")
+			m.rescan()
+			continue
+		}
+		if err != nil {
+			if err != unix.EAGAIN && err != unix.EINTR {
+				Error("Failed to read uevent: %v", err)
+			}
+			continue
+		}
+		if isUSBDeviceUevent(buf[:n]) {
+			m.rescan()
+		}
+	}
+}
+
+// UnlockDeviceRequired returns whether unlocking needs a trusted USB device
+func (h *LockHelper) UnlockDeviceRequired() bool {
+	return len(h.config.UnlockDevices) > 0
+}
+
+// StartUnlockDeviceWatch starts tracking the trusted USB devices. It returns
+// nil if none are configured.
+func (h *LockHelper) StartUnlockDeviceWatch() <-chan bool {
+	if !h.UnlockDeviceRequired() || h.unlockDevices != nil {
+		return nil
+	}
+	h.unlockDevices = NewUSBMonitor(h.config.SysfsRoot, h.config.UnlockDevices)
+	return h.unlockDevices.Changes()
+}
+
+// StopUnlockDeviceWatch stops tracking the trusted USB devices
+func (h *LockHelper) StopUnlockDeviceWatch() {
+	if h.unlockDevices != nil {
+		h.unlockDevices.Stop()
+		h.unlockDevices = nil
+	}
+}
+
+// UnlockDevicePresent returns whether unlocking is allowed as far as the
+// trusted USB devices are concerned
+func (h *LockHelper) UnlockDevicePresent() bool {
+	if !h.UnlockDeviceRequired() {
+		return true
+	}
+	if h.unlockDevices != nil {
+		return h.unlockDevices.Present()
+	}
+
+	devices, err := ScanUSBDevices(h.config.SysfsRoot)
+	if err != nil {
+		Error("Unable to check for trusted USB devices: %v", err)
+		return false
+	}
+	return matchUSBDevices(devices, h.config.UnlockDevices)
+}
+
+// UnlockDeviceMessage returns the text to show while no trusted USB device
+// is plugged in, or "" when there's nothing to say
+func (h *LockHelper) UnlockDeviceMessage() string {
+	if h.UnlockDevicePresent() {
+		return ""
+	}
+	return "Insert security key"
+}
+
+// checkUnlockDevice is the authentication stage after PAM. A correct
+// password is refused while no trusted USB device is plugged in.
+func (h *LockHelper) checkUnlockDevice(result AuthResult) AuthResult {
+	if !result.Success || h.UnlockDevicePresent() {
+		return result
+	}
+
+	Info("Password accepted but no trusted USB device is plugged in")
+	return AuthResult{
+		Success:    false,
+		Message:    "Insert security key",
+		ErrorClass: "usb: security key missing",
+	}
+}
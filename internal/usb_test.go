@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addSysfsDevice creates a fake sysfs USB device or interface under root
+func addSysfsDevice(t *testing.T, root, name string, attrs map[string]string) {
+	t.Helper()
+	dir := filepath.Join(root, "bus", "usb", "devices", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for attr, value := range attrs {
+		if err := os.WriteFile(filepath.Join(dir, attr), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUSBDeviceRuleMatches(t *testing.T) {
+	yubikey := USBDevice{Name: "1-2", Vendor: "1050", Product: "0407", Serial: "123456"}
+
+	tests := []struct {
+		name string
+		rule USBDeviceRule
+		want bool
+	}{
+		{"vendor and product", USBDeviceRule{Vendor: "1050", Product: "0407"}, true},
+		{"serial", USBDeviceRule{Vendor: "1050", Product: "0407", Serial: "123456"}, true},
+		{"other serial", USBDeviceRule{Vendor: "1050", Product: "0407", Serial: "654321"}, false},
+		{"serial is case sensitive", USBDeviceRule{Vendor: "1050", Product: "0407", Serial: "123456 "}, false},
+		{"other vendor", USBDeviceRule{Vendor: "046d", Product: "0407"}, false},
+		{"other product", USBDeviceRule{Vendor: "1050", Product: "0110"}, false},
+		{"empty rule", USBDeviceRule{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Matches(yubikey); got != tt.want {
+				t.Errorf("%v.Matches(%+v) = %v, want %v", tt.rule, yubikey, got, tt.want)
+			}
+		})
+	}
+
+	noSerial := USBDevice{Name: "1-3", Vendor: "1050", Product: "0407"}
+	if (USBDeviceRule{Vendor: "1050", Product: "0407", Serial: "123456"}).Matches(noSerial) {
+		t.Error("device without a serial matched a rule with one")
+	}
+
+	upper := USBDevice{Vendor: "04F2", Product: "B6DD"}
+	if !(USBDeviceRule{Vendor: "04f2", Product: "b6dd"}).Matches(upper) {
+		t.Error("lower case rule didn't match upper case device")
+	}
+}
+
+func TestValidateUSBDeviceRules(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      []USBDeviceRule
+		needSerial bool
+		wantErr    bool
+	}{
+		{"none", nil, true, false},
+		{"complete", []USBDeviceRule{{Vendor: "1050", Product: "0407", Serial: "123456"}}, true, false},
+		{"missing product", []USBDeviceRule{{Vendor: "1050", Serial: "1"}}, false, true},
+		{"missing vendor", []USBDeviceRule{{Product: "0407", Serial: "1"}}, false, true},
+		{"missing serial", []USBDeviceRule{{Vendor: "1050", Product: "0407"}}, true, true},
+		{"blank serial", []USBDeviceRule{{Vendor: "1050", Product: "0407", Serial: " "}}, true, true},
+		{"serial not needed", []USBDeviceRule{{Vendor: "1050", Product: "0407"}}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUSBDeviceRules("unlock_devices", tt.rules, tt.needSerial)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScanUSBDevices(t *testing.T) {
+	root := t.TempDir()
+	addSysfsDevice(t, root, "usb1", map[string]string{"idVendor": "1d6b", "idProduct": "0002"})
+	addSysfsDevice(t, root, "1-2", map[string]string{"idVendor": "1050", "idProduct": "0407", "serial": "123456"})
+	addSysfsDevice(t, root, "1-2:1.0", map[string]string{"bInterfaceClass": "03"})
+
+	devices, err := ScanUSBDevices(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []USBDevice{
+		{Name: "1-2", Vendor: "1050", Product: "0407", Serial: "123456"},
+		{Name: "usb1", Vendor: "1d6b", Product: "0002"},
+	}
+	if !slices.Equal(devices, want) {
+		t.Errorf("devices = %+v, want %+v", devices, want)
+	}
+
+	rules := []USBDeviceRule{{Vendor: "1050", Product: "0407"}}
+	if !matchUSBDevices(devices, rules) {
+		t.Error("plugged in device didn't match")
+	}
+	if matchUSBDevices(devices, []USBDeviceRule{{Vendor: "046d", Product: "c52b"}}) {
+		t.Error("missing device matched")
+	}
+
+	if _, err := ScanUSBDevices(filepath.Join(root, "missing")); err == nil {
+		t.Error("scanning a missing sysfs succeeded")
+	}
+}
+
+func TestIsUSBDeviceUevent(t *testing.T) {
+	uevent := func(header string, props ...string) []byte {
+		return []byte(strings.Join(append([]string{header}, props...), "\x00"))
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want bool
+	}{
+		{"device added", uevent("add@/devices/pci0000:00/usb1/1-2", "ACTION=add", "SUBSYSTEM=usb", "DEVTYPE=usb_device"), true},
+		{"device removed", uevent("remove@/devices/pci0000:00/usb1/1-2", "ACTION=remove", "SUBSYSTEM=usb", "DEVTYPE=usb_device"), true},
+		{"interface", uevent("add@/devices/pci0000:00/usb1/1-2/1-2:1.0", "SUBSYSTEM=usb", "DEVTYPE=usb_interface"), false},
+		{"changed", uevent("change@/devices/pci0000:00/usb1/1-2", "SUBSYSTEM=usb", "DEVTYPE=usb_device"), false},
+		{"other subsystem", uevent("add@/devices/virtual/input/input9", "SUBSYSTEM=input"), false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isUSBDeviceUevent(tt.msg); got != tt.want {
+				t.Errorf("isUSBDeviceUevent = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUSBMonitorPollsSysfs(t *testing.T) {
+	root := t.TempDir()
+	addSysfsDevice(t, root, "usb1", map[string]string{"idVendor": "1d6b", "idProduct": "0002"})
+
+	monitor := NewUSBMonitor(root, []USBDeviceRule{{Vendor: "1050", Product: "0407"}})
+	defer monitor.Stop()
+	if monitor.Present() {
+		t.Fatal("device present before it was plugged in")
+	}
+
+	waitChange := func(want bool) {
+		t.Helper()
+		select {
+		case present := <-monitor.Changes():
+			if present != want {
+				t.Fatalf("change to %v, want %v", present, want)
+			}
+		case <-time.After(3 * usbPollInterval):
+			t.Fatalf("no change to %v", want)
+		}
+		if monitor.Present() != want {
+			t.Fatalf("Present() = %v after change to %v", monitor.Present(), want)
+		}
+	}
+
+	addSysfsDevice(t, root, "1-2", map[string]string{"idVendor": "1050", "idProduct": "0407"})
+	waitChange(true)
+
+	if err := os.RemoveAll(filepath.Join(root, "bus", "usb", "devices", "1-2")); err != nil {
+		t.Fatal(err)
+	}
+	waitChange(false)
+}
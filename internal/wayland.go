@@ -1,26 +1,15 @@
 package internal
 
 import (
-	_ "embed"
 	"fmt"
-	"image"
-	"image/color"
 	"syscall"
 	"time"
 
-	"golang.org/x/image/font"
-	"golang.org/x/image/font/opentype"
-	"golang.org/x/image/math/fixed"
-
 	"github.com/neurlang/wayland/wl"
 	"github.com/neurlang/wayland/wlclient"
 	ext "github.com/tuxx/wayland-ext-session-lock-go"
-	"golang.org/x/sys/unix"
 )
 
-//go:embed fonts/DejaVuSans-Bold.ttf
-var fontBytes []byte
-
 var _ wl.KeyboardKeyHandler = (*WaylandLocker)(nil)
 var _ wl.KeyboardEnterHandler = (*WaylandLocker)(nil)
 var _ wl.KeyboardLeaveHandler = (*WaylandLocker)(nil)
@@ -34,76 +23,28 @@ func (h *surfaceHandler) HandleSessionLockSurfaceConfigure(ev ext.SessionLockSur
 	h.lockSurface.AckConfigure(ev.Serial)
 	Debug("Acknowledged configure")
 
-	// Create a shared memory buffer for the surface
-	stride := int(ev.Width) * 4
-	size := stride * int(ev.Height)
-
-	// Create memory-backed file descriptor
-	fd, err := unix.MemfdCreate("buffer", unix.MFD_CLOEXEC)
-	if err != nil {
-		Error("Failed to create memfd: %v", err)
-		return
-	}
-	defer unix.Close(fd) // Ensure fd is closed on all exit paths
-
-	// Set the size of the file
-	if err = syscall.Ftruncate(fd, int64(size)); err != nil {
-		Error("Failed to truncate memfd: %v", err)
-		return
-	}
-
-	// Map the file into memory
-	data, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-	if err != nil {
-		Error("Failed to mmap: %v", err)
-		return
-	}
-	defer syscall.Munmap(data)
-
-	// Fill with black transparent color (RGBA format)
-	for i := 0; i < size; i += 4 {
-		data[i+0] = 0 // Blue
-		data[i+1] = 0 // Green
-		data[i+2] = 0 // Red
-		data[i+3] = 0 // Alpha (fully transparent)
-	}
-
-	pool, err := h.client.shm.CreatePool(uintptr(fd), int32(size))
-	if err != nil {
-		Error("Failed to create pool: %v", err)
-		return
-	}
-
-	// Create a buffer from the pool
-	buffer, err := pool.CreateBuffer(0, int32(ev.Width), int32(ev.Height), int32(stride), wl.ShmFormatArgb8888)
-	if err != nil {
-		Error("Failed to create buffer: %v", err)
-		// Explicitly destroy the pool as it's no longer needed if buffer creation fails
-		pool.Destroy()
-		return
-	}
-
-	// Attach buffer to surface and commit
-	h.surface.Attach(buffer, 0, 0)
-	h.surface.Damage(0, 0, int32(ev.Width), int32(ev.Height))
-	h.surface.SetInputRegion(nil)
-	h.surface.Commit()
-
-	Info("Created %dx%d buffer with transparent background and committed surface\n", ev.Width, ev.Height)
+	// Draw the full UI right away, the surface must not stay empty
+	h.buffers.Configure(int(ev.Width), int(ev.Height), h.client.uiState(h.client.securePassword.Length(), 0))
+	Info("Drew %dx%d frame and committed surface\n", ev.Width, ev.Height)
 }
 
 func NewWaylandLocker(config Configuration) *WaylandLocker {
 	Debug("WaylandLocker logger initialized")
 
+	theme := ThemeFor(config)
 	return &WaylandLocker{
 		display: nil,
 		surfaces: make(map[*wl.Output]struct {
 			wlSurface   *wl.Surface
 			lockSurface *ext.SessionLockSurface
+			buffers     *surfaceBuffers
 		}),
 		outputs:         make(map[uint32]*wl.Output),
 		done:            make(chan struct{}),
 		redrawCh:        make(chan int, 1),
+		loopDone:        make(chan struct{}),
+		tasks:           make(chan func(), 8),
+		authResults:     make(chan authOutcome, 1),
 		config:          config,
 		helper:          NewLockHelper(config),
 		lockActive:      false,
@@ -111,6 +52,8 @@ func NewWaylandLocker(config Configuration) *WaylandLocker {
 		lockoutManager:  NewLockoutManager(config),
 		countdownActive: false,
 		securePassword:  NewSecurePassword(),
+		switchUser:      NewSwitchUserPrompt(),
+		renderer:        NewRenderer(NewBackground(config, theme), theme),
 	}
 }
 
@@ -193,137 +136,77 @@ func (l *WaylandLocker) HandleKeyboardModifiers(ev wl.KeyboardModifiersEvent) {
 	}
 }
 
-func drawPasswordFeedback(l *WaylandLocker, surface *wl.Surface, count int, offsetX int) {
-	width, height := l.getSurfaceDimensions(surface)
-	stride := int(width) * 4
-	size := stride * int(height)
-
-	fd, err := unix.MemfdCreate("pwfeedback", unix.MFD_CLOEXEC)
-	if err != nil {
-		Error("Failed to create memory file descriptor: %v", err)
-		return
-	}
-	defer unix.Close(fd) // Ensure fd is always closed
-
-	err = syscall.Ftruncate(fd, int64(size))
-	if err != nil {
-		Error("Failed to truncate memory file: %v", err)
-		return
+// uiState collects what the lock screen shows with dots password characters
+// typed and the dots moved by offset
+func (l *WaylandLocker) uiState(dots, offset int) UIState {
+	state := UIState{
+		Dots:        dots,
+		ShakeOffset: offset,
+		Label:       l.switchUser.Label(),
+		Status:      l.statusMessage,
+		Hint:        l.helper.UnlockDeviceMessage(),
+		Verifying:   l.authenticating,
+		Failed:      len(l.shakeSteps) > 0,
+		Now:         time.Now(),
+		LockedSince: l.helper.LockedAt(),
 	}
-
-	data, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-	if err != nil {
-		Error("Failed to map memory: %v", err)
-		return
-	}
-	defer syscall.Munmap(data) // Ensure memory mapping is cleaned up
-
-	// Fill with transparent color first
-	for i := 0; i < size; i += 4 {
-		data[i+0] = 0 // Blue
-		data[i+1] = 0 // Green
-		data[i+2] = 0 // Red
-		data[i+3] = 0 // Alpha (fully transparent)
+	if l.lockoutManager.IsLockedOut() {
+		state.Lockout = true
+		state.LockoutTime = l.lockoutManager.FormatRemainingTime()
+		state.LockoutReason = l.lockoutManager.LockoutReason()
 	}
+	return state
+}
 
-	// Much larger dots
-	dotSpacing := 40 // Increased spacing for larger dots
-	dotRadius := 12  // 4x the original size (was 3)
-	totalWidth := count * dotSpacing
-	startX := (int(width)-totalWidth)/2 + offsetX
-	y := int(height) - 100
-
-	for i := 0; i < count && i < 32; i++ {
-		x := startX + i*dotSpacing
-		// Draw larger circular dots
-		for dy := -dotRadius; dy <= dotRadius; dy++ {
-			for dx := -dotRadius; dx <= dotRadius; dx++ {
-				// Make sure we're within the circle
-				if dx*dx+dy*dy <= dotRadius*dotRadius {
-					px := x + dx
-					py := y + dy
-					if px >= 0 && py >= 0 && px < int(width) && py < int(height) {
-						offset := (py*int(width) + px) * 4
-						data[offset+0] = 0xff // Blue
-						data[offset+1] = 0xff // Green
-						data[offset+2] = 0xff // Red
-						data[offset+3] = 0xff // Alpha
-					}
-				}
-			}
+// redrawSurfaces draws the UI on every lock surface, as soon as each of them
+// is ready for a new frame
+func (l *WaylandLocker) redrawSurfaces(dots, offset int) {
+	state := l.uiState(dots, offset)
+	for _, entry := range l.surfaces {
+		if entry.buffers != nil {
+			entry.buffers.Present(state)
 		}
 	}
+}
 
-	pool, err := l.shm.CreatePool(uintptr(fd), int32(size))
-	if err != nil {
-		Error("Failed to create shared memory pool: %v", err)
-		return
-	}
-
-	buffer, err := pool.CreateBuffer(0, int32(width), int32(height), int32(stride), wl.ShmFormatArgb8888)
-	if err != nil {
-		Error("Failed to create buffer: %v", err)
-		pool.Destroy()
-		return
+// destroySurfaceBuffers releases the shm pools of all lock surfaces
+func (l *WaylandLocker) destroySurfaceBuffers() {
+	for _, entry := range l.surfaces {
+		if entry.buffers != nil {
+			entry.buffers.Destroy()
+		}
 	}
-
-	// Set input region to nil to allow input through the transparent parts
-	surface.SetInputRegion(nil)
-
-	// Attach buffer to surface and commit
-	surface.Attach(buffer, 0, 0)
-	surface.Damage(0, 0, int32(width), int32(height))
-	surface.Commit()
-
-	Debug("Drew password feedback dots: count=%d, offsetX=%d", count, offsetX)
 }
 
-func (l *WaylandLocker) shakePasswordDots() {
+// shakePasswordDots starts the failed attempt animation. The password is
+// cleared right away, then is called once the animation is over.
+func (l *WaylandLocker) shakePasswordDots(then func()) {
 	Debug("Starting password shake animation")
 
-	// Number of shake iterations
-	iterations := 4
-	// Shake distance in pixels
-	distance := 10
-	// Time between movements in milliseconds
-	delay := 80 * time.Millisecond
-
-	// Get current dot count safely
-	dotCount := l.securePassword.Length()
-
-	// Perform the shake animation with horizontal movement
-	for i := 0; i < iterations; i++ {
-		// Move right
-		for _, entry := range l.surfaces {
-			if entry.wlSurface != nil {
-				drawPasswordFeedback(l, entry.wlSurface, dotCount, distance)
-			}
-		}
-		time.Sleep(delay)
+	l.shakeDots = l.securePassword.Length()
+	l.securePassword.Clear()
+	l.shakeSteps = shakeOffsets()
+	l.afterShake = then
+	l.shakeStep()
+}
 
-		// Move left
-		for _, entry := range l.surfaces {
-			if entry.wlSurface != nil {
-				drawPasswordFeedback(l, entry.wlSurface, dotCount, -distance)
-			}
-		}
-		time.Sleep(delay)
+// shakeStep shows the next frame of the failed attempt animation
+func (l *WaylandLocker) shakeStep() {
+	if len(l.shakeSteps) == 0 {
+		l.shakeTimer = nil
 
-		// Back to center
-		for _, entry := range l.surfaces {
-			if entry.wlSurface != nil {
-				drawPasswordFeedback(l, entry.wlSurface, dotCount, 0)
-			}
+		// Final redraw without the old dots
+		l.redrawSurfaces(l.securePassword.Length(), 0)
+		if then := l.afterShake; then != nil {
+			l.afterShake = nil
+			then()
 		}
-		time.Sleep(delay)
+		return
 	}
 
-	// Final redraw with no dots
-	for _, entry := range l.surfaces {
-		if entry.wlSurface != nil {
-			drawPasswordFeedback(l, entry.wlSurface, 0, 0)
-		}
-	}
+	l.redrawSurfaces(l.shakeDots, l.shakeSteps[0])
+	l.shakeSteps = l.shakeSteps[1:]
+	l.shakeTimer = time.NewTimer(shakeDelay)
 }
 
 // Handle keyboard key events
@@ -335,19 +218,25 @@ func (l *WaylandLocker) HandleKeyboardKey(ev wl.KeyboardKeyEvent) {
 	if ev.State != wl.KeyboardKeyStatePressed {
 		return
 	}
+	l.helper.NoteActivity()
+
+	// What was typed is being checked, don't touch it
+	if l.authenticating {
+		Debug("Ignoring key while authenticating")
+		return
+	}
 
 	// If countdown is active, ignore all keys except Escape
 	if l.countdownActive {
 		if ev.Key == 1 { // Escape key
-			l.countdownActive = false
-			l.countdownTimer.Stop()
+			l.stopCountdown()
 			l.securePassword.Clear()
 			if l.config.DebugExit {
 				Info("ESC pressed during countdown, triggering debug exit\n")
 				if l.lock != nil {
 					l.lock.UnlockAndDestroy()
 				}
-				close(l.done)
+				l.finish()
 			}
 		}
 		return
@@ -364,6 +253,9 @@ func (l *WaylandLocker) HandleKeyboardKey(ev wl.KeyboardKeyEvent) {
 	case 14: // Backspace key
 		l.handleBackspace()
 		return
+	case 15: // Tab key
+		l.handleTab()
+		return
 	}
 
 	// Convert key code to character using XKB state
@@ -391,6 +283,56 @@ func (l *WaylandLocker) HandleKeyboardKey(ev wl.KeyboardKeyEvent) {
 func (l *WaylandLocker) HandleSessionLockLocked(ev ext.SessionLockLockedEvent) {
 	Info("Session is now locked! Lock is active.\n")
 	l.lockActive = true
+
+	l.helper.StartHook(HookOnLocked, HookEnv{})
+	l.helper.StartSessionWatchers()
+
+	// Accept a fingerprint while the password is typed and keep the
+	// "insert security key" hint up to date, both through the event loop.
+	// Claiming the reader waits on fprintd, so it's done off the loop.
+	l.unlockDeviceChanges = l.helper.StartUnlockDeviceWatch()
+	go func() {
+		events := l.helper.StartFingerprint()
+		l.post(func() { l.fingerprintEvents = events })
+	}()
+}
+
+// handleFingerprint shows a fingerprint result and unlocks on a match
+func (l *WaylandLocker) handleFingerprint(event FingerprintEvent) {
+	Debug("Fingerprint result: %s", event.Result)
+
+	// Results can still arrive after a password unlock stopped verification
+	if !l.helper.FingerprintActive() {
+		return
+	}
+
+	if l.lockoutManager.IsLockedOut() || l.awaitingCode || l.authenticating {
+		Debug("Ignoring fingerprint during lockout, code entry or password check")
+		return
+	}
+
+	if event.Matched {
+		if !l.helper.UnlockDevicePresent() {
+			Info("Fingerprint matched but no trusted USB device is plugged in")
+			return
+		}
+		if l.helper.SecondFactorEnabled() {
+			l.awaitingCode = true
+			l.securePassword.Clear()
+			l.statusMessage = "Enter authentication code"
+			l.updatePasswordDisplay()
+			return
+		}
+		Debug("Fingerprint matched, unlocking session")
+		l.unlock("")
+		return
+	}
+
+	if event.Failed {
+		l.helper.AuditFingerprintFailure(event)
+	}
+	l.statusMessage = event.Message
+	l.updatePasswordDisplay()
 }
 
 func (l *WaylandLocker) HandleSessionLockFinished(ev ext.SessionLockFinishedEvent) {
@@ -407,7 +349,7 @@ func (l *WaylandLocker) HandleSessionLockFinished(ev ext.SessionLockFinishedEven
 	}
 
 	// Signal that we're done
-	close(l.done)
+	l.finish()
 }
 
 func (f handlerFunc) HandleOutputGeometry(ev wl.OutputGeometryEvent) { f(ev) }
@@ -416,6 +358,8 @@ func (f outputModeHandlerFunc) HandleOutputMode(ev wl.OutputModeEvent) {
 	f(ev)
 }
 
+func (f outputScaleHandlerFunc) HandleOutputScale(ev wl.OutputScaleEvent) { f(ev) }
+
 // HandleRegistryGlobalRemove handles registry global remove events
 func (h *RegistryHandler) HandleRegistryGlobalRemove(ev wl.RegistryGlobalRemoveEvent) {
 	// Remove the output from our map if it exists
@@ -446,6 +390,12 @@ func (h *RegistryHandler) HandleRegistryGlobal(ev wl.RegistryGlobalEvent) {
 		// Use the specialized binding function from the ext package
 		h.lockManager = ext.BindSessionLockManager(h.registry, ev.Name, 1)
 		Debug("Bound ext_session_lock_manager_v1")
+	case "wp_viewporter":
+		h.viewporter = bindViewporter(h.registry, ev.Name)
+		Debug("Bound wp_viewporter")
+	case "wp_fractional_scale_manager_v1":
+		h.fractionalScale = bindFractionalScaleManager(h.registry, ev.Name)
+		Debug("Bound wp_fractional_scale_manager_v1")
 	case "wl_output":
 		output := wlclient.RegistryBindOutputInterface(h.registry, ev.Name, ev.Version)
 		h.outputs[ev.Name] = output
@@ -474,6 +424,12 @@ func (h *RegistryHandler) HandleRegistryGlobal(ev wl.RegistryGlobalEvent) {
 				h.outputGeometries[output] = info
 			}
 		}))
+
+		output.AddScaleHandler(outputScaleHandlerFunc(func(ev wl.OutputScaleEvent) {
+			info := h.outputGeometries[output]
+			info.scale = int(ev.Factor)
+			h.outputGeometries[output] = info
+		}))
 	}
 }
 
@@ -556,12 +512,10 @@ func (l *WaylandLocker) HandleSeatCapabilities(ev wl.SeatCapabilitiesEvent) {
 func (l *WaylandLocker) Lock() error {
 	Info("Locking screen")
 	l.lockActive = true
+	defer l.helper.Close()
 
-	// Run pre-lock command if configured
-	if err := l.helper.RunPreLockCommand(); err != nil {
-		Error("Failed to run pre-lock command: %v", err)
-		// Continue with locking despite the error
-	}
+	// Run on_lock hooks before anything is put on screen
+	l.helper.RunHook(HookOnLock, HookEnv{})
 
 	// Pause media if enabled
 	if err := l.helper.PauseMediaIfEnabled(); err != nil {
@@ -569,39 +523,43 @@ func (l *WaylandLocker) Lock() error {
 		// Continue with locking despite the error
 	}
 
+	// Show whose session this is from the first frame on
+	l.renderer.SetUser(l.helper.SessionUserProfile())
+
 	// Initialize Wayland connection
 	if err := l.initWayland(); err != nil {
 		Error("Failed to initialize Wayland: %v", err)
 		return err
 	}
 
-	// Start the media player if configured
+	// Start the media player if configured. It plays behind the lock
+	// surfaces, so it's only visible through a transparent background.
 	if l.mediaPlayer != nil {
+		if !l.config.TransparentBackground {
+			Warn("media_dir is set but transparent_background is off, so the media plays hidden behind the opaque lock screen")
+		}
 		if err := l.mediaPlayer.Start(); err != nil {
 			Error("Failed to start media player: %v", err)
 			// Continue with locking despite the error
 		}
 	}
 
-	// Start redraw goroutine for password dots
-	go func() {
-		for {
-			select {
-			case <-l.done:
-				return
-			case count := <-l.redrawCh:
-				Debug("Redrawing password dots: count=%d", count)
-				for _, entry := range l.surfaces {
-					if entry.wlSurface != nil {
-						drawPasswordFeedback(l, entry.wlSurface, count, 0)
-					}
-				}
-			}
-		}
-	}()
+	// Continue a lockout carried over from a previous run
+	if l.lockoutManager.IsLockedOut() {
+		Info("Resuming lockout until: %v", l.lockoutManager.GetLockoutUntil())
+		remaining := int(l.lockoutManager.GetRemainingTime().Seconds())
+		l.post(func() {
+			l.StartCountdown("Account locked", remaining)
+		})
+	}
 
-	// Wait for lock to complete
+	// Wait for lock to complete and the event loop to let go of Wayland
 	<-l.done
+	<-l.loopDone
+	l.helper.WaitHooks()
+
+	// Wipe and release the password buffer
+	l.securePassword.Destroy()
 
 	return nil
 }
@@ -616,380 +574,185 @@ func (l *WaylandLocker) authenticate() {
 		return
 	}
 
+	// Ignore an empty Enter unless the policy counts it as a failure
+	if l.securePassword.Length() == 0 && !l.lockoutManager.CountsEmptyAttempts() {
+		Debug("Empty password submitted, ignoring")
+		return
+	}
+
 	if l.helper == nil {
 		l.helper = NewLockHelper(l.config)
 		Debug("Created lock helper for PAM auth")
 	}
 
-	password := l.securePassword.String()
-	result := l.helper.authenticator.Authenticate(password)
-	Debug("PAM result: success=%v message=%s", result.Success, result.Message)
-
-	if result.Success {
-		Debug("Auth OK, unlocking session")
-
-		// Reset lockout on successful authentication
-		l.lockoutManager.ResetLockout()
-
-		go func() {
-			if l.mediaPlayer != nil {
-				Debug("Stopping media player")
-				l.mediaPlayer.Stop()
-			}
-
-			// Unpause media if enabled
-			if err := l.helper.UnpauseMediaIfEnabled(); err != nil {
-				Warn("Failed to unpause media: %v", err)
-			}
-
-			time.Sleep(200 * time.Millisecond)
-
-			if l.lock != nil {
-				Debug("Safely unlocking session")
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							Error("Recovered from panic in unlock: %v", r)
-						}
-					}()
-					l.lock.UnlockAndDestroy()
-				}()
-
-				time.Sleep(100 * time.Millisecond)
-			}
-
-			// Run post-lock command before signaling completion
-			if err := l.helper.RunPostLockCommand(); err != nil {
-				Warn("Post-lock command error: %v", err)
-			} else {
-				if l.config.PostLockCommand == "" {
-					// Add a small delay when no post-lock command is specified
-					// to ensure proper cleanup of Wayland resources
-					Debug("No post-lock command specified, adding small delay for cleanup")
-					time.Sleep(200 * time.Millisecond)
-				} else {
-					Info("Post-lock command executed successfully")
-				}
-			}
-
-			Debug("Signaling completion")
-			close(l.done)
-		}()
-	} else {
-		Debug("Auth failed: %s", result.Message)
-
-		// Authentication failed, use the lockout manager to handle the failed attempt
-		lockoutActive, lockoutDuration, _ := l.lockoutManager.HandleFailedAttempt()
-
-		// First, do the password shake animation
-		l.shakePasswordDots()
-
-		// If lockout was activated, show the lockout message
-		if lockoutActive {
-			Info("Lockout activated until: %v", l.lockoutManager.GetLockoutUntil())
-
-			// Show lockout message on screen AFTER the shake animation is complete
-			l.StartCountdown("Account locked", int(lockoutDuration.Seconds()))
-		}
-	}
-
-	l.securePassword.Clear()
-
-	select {
-	case l.redrawCh <- 0: // Send 0 to indicate no dots
-	default:
-	}
-}
-
-func (l *WaylandLocker) StartCountdown(message string, duration int) {
-	Debug(">>> Starting countdown: %s (%ds)", message, duration)
-
-	// Set countdown active flag
-	l.countdownActive = true
-
-	// Make sure the duration is reasonable
-	if duration > 600 {
-		Debug("Capping long duration to 600 seconds")
-		duration = 600 // Cap at 10 minutes
-	}
-
+	// PAM can take seconds to fail, so it runs outside the event loop, which
+	// gets the result through authResults. It checks its own copy of the
+	// password, the display keeps reading the length in the meantime.
+	username := l.switchUser.Username()
+	awaitingCode := l.awaitingCode
+	password := l.securePassword.Copy()
+	l.authenticating = true
+	l.updatePasswordDisplay()
 	go func() {
-		Debug("Starting countdown on all surfaces")
-
-		// Update every second
-		for i := duration; i >= 0; i-- {
-			// Loop through all surfaces to show the countdown on each
-			for _, entry := range l.surfaces {
-				if entry.wlSurface != nil {
-					func(s *wl.Surface) {
-						defer func() {
-							if r := recover(); r != nil {
-								Error("Recovered from panic in countdown: %v", r)
-							}
-						}()
-
-						safeCenteredMessage(s, l, message, i)
-					}(entry.wlSurface)
-				}
-			}
-
-			Debug("Countdown: %d seconds remaining", i)
+		defer password.Destroy()
 
-			// Check if we should continue
-			if i > 0 {
-				time.Sleep(1 * time.Second)
+		var result AuthResult
+		password.WithBytes(func(secret []byte) {
+			if awaitingCode {
+				result = l.helper.VerifySecondFactor(secret)
+			} else {
+				result = l.helper.AuthenticateUser(username, secret)
 			}
-		}
-
-		Debug("Countdown finished")
+		})
 
-		// Clear the countdown message after it's done
-		for _, entry := range l.surfaces {
-			if entry.wlSurface != nil {
-				func(s *wl.Surface) {
-					defer func() {
-						if r := recover(); r != nil {
-							Error("Recovered from panic when clearing countdown: %v", r)
-						}
-					}()
-
-					clearMessage(s, l)
-				}(entry.wlSurface)
-			}
+		select {
+		case l.authResults <- authOutcome{username: username, result: result}:
+		case <-l.done:
 		}
-
-		// Reset countdown active flag
-		l.countdownActive = false
 	}()
 }
 
-func clearMessage(surface *wl.Surface, l *WaylandLocker) {
-	if surface == nil || l == nil {
-		return
-	}
-
-	width, height := l.getSurfaceDimensions(surface)
-
-	stride := width * 4
-	size := stride * height
-
-	fd, err := unix.MemfdCreate("clearbuffer", unix.MFD_CLOEXEC)
-	if err != nil {
-		Error("Failed to create memfd for clear: %v", err)
-		return
-	}
-	defer unix.Close(fd)
+// finishAuthentication acts on the result of authenticate
+func (l *WaylandLocker) finishAuthentication(outcome authOutcome) {
+	l.authenticating = false
+	username, result := outcome.username, outcome.result
+	Debug("PAM result: success=%v message=%s", result.Success, result.Message)
 
-	err = syscall.Ftruncate(fd, int64(size))
-	if err != nil {
-		Error("Failed to truncate memfd for clear: %v", err)
+	// The password was right, ask for the TOTP code next
+	if result.SecondFactor {
+		l.awaitingCode = true
+		l.statusMessage = result.Message
+		l.securePassword.Clear()
+		l.updatePasswordDisplay()
 		return
 	}
+	l.awaitingCode = false
 
-	data, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-	if err != nil {
-		Error("Failed to mmap for clear: %v", err)
+	if result.Success {
+		Debug("Auth OK, unlocking session")
+		l.securePassword.Clear()
+		l.unlock(username)
 		return
 	}
-	defer syscall.Munmap(data)
-
-	// Fill with completely transparent pixels
-	for i := 0; i < size; i += 4 {
-		data[i+0] = 0 // Blue
-		data[i+1] = 0 // Green
-		data[i+2] = 0 // Red
-		data[i+3] = 0 // Completely transparent
-	}
 
-	// Create shared memory pool
-	pool, err := l.shm.CreatePool(uintptr(fd), int32(size))
-	if err != nil {
-		Error("Failed to create pool for clear: %v", err)
-		return
-	}
+	Debug("Auth failed: %s", result.Message)
 
-	// Create buffer
-	buffer, err := pool.CreateBuffer(0, int32(width), int32(height), int32(stride), wl.ShmFormatArgb8888)
-	if err != nil {
-		Error("Failed to create buffer for clear: %v", err)
-		return
+	// Authentication failed, use the lockout manager to handle the failed attempt
+	lockoutActive, lockoutDuration, remainingAttempts := l.lockoutManager.HandleFailedAttempt()
+	l.helper.AuditAuthFailure(username, result)
+	if lockoutActive {
+		l.helper.AuditLockout(lockoutDuration, l.lockoutManager.LockoutReason())
 	}
+	l.helper.StartFailureHooks(username, lockoutActive, lockoutDuration)
 
-	// Attach and commit
-	surface.Attach(buffer, 0, 0)
-	surface.Damage(0, 0, int32(width), int32(height))
-	surface.Commit()
-}
-
-func safeCenteredMessage(surface *wl.Surface, l *WaylandLocker, message string, secondsLeft int) {
-	if surface == nil || l == nil {
-		return
+	// Tell the user how many attempts the policy has left
+	if lockoutActive {
+		l.statusMessage = ""
+	} else {
+		l.statusMessage = FormatRemainingAttempts(remainingAttempts)
 	}
 
-	width, height := l.getSurfaceDimensions(surface)
-
-	// Format time in mm:ss format
-	minutes := secondsLeft / 60
-	seconds := secondsLeft % 60
-	timeStr := fmt.Sprintf("%02d:%02d", minutes, seconds)
-
-	// Create RGBA image
-	img := image.NewRGBA(image.Rect(0, 0, width, height))
-
-	// Draw semi-transparent black background
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			img.SetRGBA(x, y, color.RGBA{0, 0, 0, 200}) // More opaque black
+	// Show the lockout message after the shake animation is complete
+	l.shakePasswordDots(func() {
+		if lockoutActive {
+			Info("Lockout activated until: %v", l.lockoutManager.GetLockoutUntil())
+			l.StartCountdown("Account locked", int(lockoutDuration.Seconds()))
 		}
-	}
-
-	// Draw "Intruder Alert!" message at the center
-	lockedMsg := "INTRUDER ALERT"
-
-	// Create a font drawer for basic text
-	ttf, err := opentype.Parse(fontBytes)
-	if err != nil {
-		Error("Failed to parse embedded TTF font: %v", err)
-		return
-	}
-
-	// Large font for "Intruder Alert!"
-	face, err := opentype.NewFace(ttf, &opentype.FaceOptions{
-		Size:    96, // Big font size
-		DPI:     72,
-		Hinting: font.HintingFull,
 	})
-	if err != nil {
-		Error("Failed to create font face: %v", err)
-		return
-	}
-	defer face.Close()
-
-	lockedX := (width - font.MeasureString(face, lockedMsg).Round()) / 2
-	lockedY := height/2 - 50
-
-	d := &font.Drawer{
-		Dst:  img,
-		Src:  image.White,
-		Face: face,
-		Dot:  fixed.P(lockedX, lockedY),
-	}
-	d.DrawString(lockedMsg)
+}
 
-	// Smaller font for "Security cooldown engaged"
-	smallFace, err := opentype.NewFace(ttf, &opentype.FaceOptions{
-		Size:    36, // Smaller font size
-		DPI:     72,
-		Hinting: font.HintingFull,
-	})
-	if err != nil {
-		Error("Failed to create small font face: %v", err)
-		return
-	}
-	defer smallFace.Close()
+// unlock ends the lock session on behalf of username, "" for the owner
+func (l *WaylandLocker) unlock(username string) {
+	// Reset lockout on successful authentication
+	l.lockoutManager.ResetLockout()
+	l.statusMessage = ""
+	l.helper.AuditLockEnd(username)
+	l.helper.StopSessionWatchers()
+	l.helper.StopFingerprint()
+	l.helper.StopUnlockDeviceWatch()
 
-	retryMsg := "Security cooldown engaged"
-	retryX := (width - font.MeasureString(smallFace, retryMsg).Round()) / 2
-	retryY := height/2 + 10
+	go func() {
+		if l.mediaPlayer != nil {
+			Debug("Stopping media player")
+			l.mediaPlayer.Stop()
+		}
 
-	d.Face = smallFace
-	d.Dot = fixed.P(retryX, retryY)
-	d.DrawString(retryMsg)
+		// Unpause media if enabled
+		if err := l.helper.UnpauseMediaIfEnabled(); err != nil {
+			Warn("Failed to unpause media: %v", err)
+		}
 
-	// Timer below with large font again
-	d.Face = face
-	timerX := (width - font.MeasureString(face, timeStr).Round()) / 2
-	timerY := height/2 + 150 // Moved lower
-	d.Dot = fixed.P(timerX, timerY)
-	d.DrawString(timeStr)
+		time.Sleep(200 * time.Millisecond)
 
-	// Convert the image to a byte slice for Wayland
-	stride := width * 4
-	size := stride * height
+		if l.lock != nil {
+			// The lock is a protocol object, it's released on the event loop
+			unlocked := make(chan struct{})
+			l.post(func() {
+				defer close(unlocked)
+				defer func() {
+					if r := recover(); r != nil {
+						Error("Recovered from panic in unlock: %v", r)
+					}
+				}()
+				Debug("Safely unlocking session")
+				l.lock.UnlockAndDestroy()
+			})
+			select {
+			case <-unlocked:
+			case <-l.done:
+			}
 
-	fd, err := unix.MemfdCreate("msgbuffer", unix.MFD_CLOEXEC)
-	if err != nil {
-		Error("Failed to create memfd for message: %v", err)
-		return
-	}
-	defer unix.Close(fd)
+			time.Sleep(100 * time.Millisecond)
+		}
 
-	err = syscall.Ftruncate(fd, int64(size))
-	if err != nil {
-		Error("Failed to truncate memfd for message: %v", err)
-		return
-	}
+		// Let the user know if someone tried to get in
+		l.helper.NotifyAwaySummary()
 
-	data, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-	if err != nil {
-		Error("Failed to mmap for message: %v", err)
-		return
-	}
-	defer syscall.Munmap(data)
-
-	// Copy image data to the buffer
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			offset := (y*width + x) * 4
-			data[offset+0] = byte(b >> 8)
-			data[offset+1] = byte(g >> 8)
-			data[offset+2] = byte(r >> 8)
-			data[offset+3] = byte(a >> 8)
+		// Run on_unlock hooks before signaling completion
+		if l.helper.HasHooks(HookOnUnlock) {
+			l.helper.RunHook(HookOnUnlock, HookEnv{User: username})
+		} else {
+			// Add a small delay when no hook is configured
+			// to ensure proper cleanup of Wayland resources
+			Debug("No on_unlock hooks configured, adding small delay for cleanup")
+			time.Sleep(200 * time.Millisecond)
 		}
-	}
 
-	// Create shared memory pool and rest of the function remains unchanged
-	pool, err := l.shm.CreatePool(uintptr(fd), int32(size))
-	if err != nil {
-		Error("Failed to create pool for message: %v", err)
-		return
-	}
+		Debug("Signaling completion")
+		l.finish()
+	}()
+}
 
-	// Create buffer
-	buffer, err := pool.CreateBuffer(0, int32(width), int32(height), int32(stride), wl.ShmFormatArgb8888)
-	if err != nil {
-		Error("Failed to create buffer for message: %v", err)
-		pool.Destroy()
-		return
-	}
+// StartCountdown shows the lockout countdown on every surface until it runs
+// out. It must be called on the event loop.
+func (l *WaylandLocker) StartCountdown(message string, duration int) {
+	Debug(">>> Starting countdown: %s (%ds)", message, duration)
 
-	// Attach and commit
-	surface.Attach(buffer, 0, 0)
-	surface.Damage(0, 0, int32(width), int32(height))
-	surface.Commit()
+	l.stopCountdown()
+	l.countdownActive = true
+	l.countdownTicker = time.NewTicker(time.Second)
+	l.redrawSurfaces(l.securePassword.Length(), 0)
 }
 
-// getSurfaceDimensions returns the width and height for a given surface
-// If dimensions can't be determined, returns reasonable minimum values
-func (l *WaylandLocker) getSurfaceDimensions(surface *wl.Surface) (width, height int) {
-	// Set minimum reasonable dimensions as absolute fallback
-	width = 640
-	height = 480
-
-	// Try to get actual dimensions
-	for output, entry := range l.surfaces {
-		if entry.wlSurface == surface {
-			if l.registryHandler != nil && l.registryHandler.outputGeometries != nil {
-				if info, ok := l.registryHandler.outputGeometries[output]; ok {
-					width = info.width
-					height = info.height
-					return
-				}
-			}
-			break
-		}
+// countdownTick redraws the remaining lockout time, and the prompt once the
+// lockout is over
+func (l *WaylandLocker) countdownTick() {
+	if l.lockoutManager.IsLockedOut() {
+		Debug("Countdown: %s remaining", l.lockoutManager.FormatRemainingTime())
+	} else {
+		Debug("Countdown finished")
+		l.stopCountdown()
 	}
+	l.redrawSurfaces(l.securePassword.Length(), 0)
+}
 
-	// If we couldn't get dimensions from the registry, try to get them from the compositor
-	if surface != nil {
-		// Many Wayland compositors provide a configure event with dimensions
-		// This would be handled in the surface's configure callback
-		// For now, we'll log that we're using minimum dimensions
-		Error("Could not determine surface dimensions, using minimum values: %dx%d", width, height)
+// stopCountdown stops the countdown redraws
+func (l *WaylandLocker) stopCountdown() {
+	if l.countdownTicker != nil {
+		l.countdownTicker.Stop()
+		l.countdownTicker = nil
 	}
-
-	return
+	l.countdownActive = false
 }
 
 // initWayland initializes the Wayland connection and resources
@@ -1001,6 +764,15 @@ func (l *WaylandLocker) initWayland() error {
 	}
 	l.display = conn
 
+	// The event loop waits on the socket. Find it before locking, so the
+	// session is never locked with a loop that can't read events.
+	socket, err := waylandSocket(conn)
+	if err != nil {
+		Error("Can't wait on the Wayland socket, polling the compositor every %v instead: %v",
+			waylandPollInterval, err)
+		socket = nil
+	}
+
 	// Get registry and set up registry handler
 	registry, err := wlclient.DisplayGetRegistry(conn)
 	if err != nil {
@@ -1028,6 +800,8 @@ func (l *WaylandLocker) initWayland() error {
 	l.compositor = regHandler.compositor
 	l.lockManager = regHandler.lockManager
 	l.shm = regHandler.shm
+	l.viewporter = regHandler.viewporter
+	l.fractionalScale = regHandler.fractionalScale
 	l.seat = regHandler.seat
 	for id, output := range regHandler.outputs {
 		l.outputs[id] = output
@@ -1068,19 +842,25 @@ func (l *WaylandLocker) initWayland() error {
 			return fmt.Errorf("failed to get lock surface: %w", err)
 		}
 
+		buffers := newSurfaceBuffers(l.shm, s, l.renderer)
+		l.trackSurfaceScale(output, s, buffers)
+
 		// Add listener
 		ext.SessionLockSurfaceAddListener(lockSurface, &surfaceHandler{
 			client:      l,
 			surface:     s,
 			lockSurface: lockSurface,
+			buffers:     buffers,
 		})
 
 		l.surfaces[output] = struct {
 			wlSurface   *wl.Surface
 			lockSurface *ext.SessionLockSurface
+			buffers     *surfaceBuffers
 		}{
 			wlSurface:   s,
 			lockSurface: lockSurface,
+			buffers:     buffers,
 		}
 	}
 
@@ -1118,22 +898,11 @@ func (l *WaylandLocker) initWayland() error {
 	}
 	l.mediaPlayer.SetMonitors(monitors)
 
-	// Start event loop
-	go func() {
-		for {
-			select {
-			case <-l.done:
-				return
-			default:
-				if err := wlclient.DisplayDispatch(conn); err != nil {
-					Error("Failed to dispatch Wayland events: %v", err)
-					close(l.done)
-					return
-				}
-				time.Sleep(10 * time.Millisecond)
-			}
-		}
-	}()
+	// The event loop reads when the lock started, so record it first
+	l.helper.AuditLockStart()
+
+	// From here on only the event loop talks to the compositor
+	go l.runEventLoop(socket)
 
 	return nil
 }
@@ -1189,23 +958,59 @@ func (h *RegistryHandler) HandleKeyboardKey(keyboard *wl.Keyboard, serial uint32
 func (l *WaylandLocker) handleEscape() {
 	Info("ESC pressed, clearing password\n")
 	l.securePassword.Clear()
+	if l.awaitingCode {
+		Debug("Cancelling authentication code entry")
+		l.awaitingCode = false
+		l.statusMessage = ""
+		l.updatePasswordDisplay()
+		return
+	}
+	if l.switchUser.IsActive() {
+		Debug("Leaving switch user prompt")
+		l.switchUser.Cancel()
+		l.updatePasswordDisplay()
+		return
+	}
 	if l.config.DebugExit {
 		Info("Debug exit triggered by ESC key\n")
 		if l.lock != nil {
 			l.lock.UnlockAndDestroy()
 		}
-		close(l.done)
+		l.finish()
 	}
 }
 
 // handleEnter handles the Enter key press
 func (l *WaylandLocker) handleEnter() {
+	if l.switchUser.IsEditing() {
+		if l.switchUser.Confirm() {
+			Debug("Switch user prompt confirmed, waiting for password")
+		}
+		l.updatePasswordDisplay()
+		return
+	}
 	Info("ENTER key detected, authenticating\n")
 	l.authenticate()
 }
 
+// handleTab handles the Tab key press, which opens the switch user prompt
+func (l *WaylandLocker) handleTab() {
+	if !l.helper.SwitchUserEnabled() || l.switchUser.IsActive() || l.awaitingCode {
+		return
+	}
+	Debug("Opening switch user prompt")
+	l.securePassword.Clear()
+	l.switchUser.Start()
+	l.updatePasswordDisplay()
+}
+
 // handleBackspace handles the Backspace key press
 func (l *WaylandLocker) handleBackspace() {
+	if l.switchUser.IsEditing() {
+		l.switchUser.RemoveLast()
+		l.updatePasswordDisplay()
+		return
+	}
 	Info("BACKSPACE pressed, removing last character\n")
 	l.securePassword.RemoveLast()
 	select {
@@ -1219,6 +1024,11 @@ func (l *WaylandLocker) handleChar(r rune) {
 	// Accept a wider range of characters, including those generated by Alt+key combinations
 	// This includes most Unicode characters that might be used in passwords
 	if r >= 0x20 && r <= 0x10FFFF { // Accept most Unicode characters
+		if l.switchUser.IsEditing() {
+			l.switchUser.AppendChar(r)
+			l.updatePasswordDisplay()
+			return
+		}
 		l.securePassword.Append(byte(r))
 		select {
 		case l.redrawCh <- l.securePassword.Length():
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/neurlang/wayland/wl"
+	"github.com/neurlang/wayland/wlclient"
+	"golang.org/x/sys/unix"
+)
+
+// authOutcome is the result of a password or code check, handed back to the
+// event loop
+type authOutcome struct {
+	username string
+	result   AuthResult
+}
+
+// waylandPollInterval is how often the event loop asks the compositor for
+// events when it can't wait on the socket
+const waylandPollInterval = 20 * time.Millisecond
+
+// waylandSocket returns the socket of the Wayland connection. The library
+// keeps it to itself, but the event loop needs to wait for it together with
+// everything else. This depends on the library's private layout, which
+// TestWaylandSocket checks against the pinned version.
+func waylandSocket(display *wl.Display) (syscall.RawConn, error) {
+	field := reflect.ValueOf(display.Context()).Elem().FieldByName("conn")
+	if !field.IsValid() || field.Type() != reflect.TypeOf((*net.UnixConn)(nil)) {
+		return nil, fmt.Errorf("unsupported Wayland library, no socket in the connection")
+	}
+
+	conn := *(**net.UnixConn)(unsafe.Pointer(field.UnsafeAddr()))
+	if conn == nil {
+		return nil, fmt.Errorf("connection to the compositor is closed")
+	}
+	return conn.SyscallConn()
+}
+
+// pollReadable reports whether fd has data to read, without waiting
+func pollReadable(fd uintptr) bool {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 0)
+	return err == nil && n > 0
+}
+
+// socketReadable reports whether the socket has events to dispatch
+func socketReadable(socket syscall.RawConn) bool {
+	readable := false
+	socket.Control(func(fd uintptr) {
+		readable = pollReadable(fd)
+	})
+	return readable
+}
+
+// waitReadable signals readable whenever the socket has events, then waits
+// for resume so it never looks at the socket while the loop reads from it.
+// Waiting happens in the runtime's poller, nothing wakes up in between.
+func waitReadable(socket syscall.RawConn, readable chan<- struct{}, resume, done <-chan struct{}) {
+	for {
+		// A closed connection is signaled too, dispatching reports the error
+		err := socket.Read(pollReadable)
+
+		select {
+		case readable <- struct{}{}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-resume:
+		case <-done:
+			return
+		}
+	}
+}
+
+// timerC returns the channel of t, or nil, which never fires, without a timer
+func timerC(t *time.Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
+// tickerC returns the channel of t, or nil, which never fires, without a ticker
+func tickerC(t *time.Ticker) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
+// finish signals that the lock is over. Unlocking, the compositor, a debug
+// exit and a broken connection can each end it, possibly at the same time.
+func (l *WaylandLocker) finish() {
+	l.doneOnce.Do(func() {
+		close(l.done)
+	})
+}
+
+// post runs task on the event loop
+func (l *WaylandLocker) post(task func()) {
+	select {
+	case l.tasks <- task:
+	case <-l.done:
+	}
+}
+
+// runEventLoop owns the Wayland connection until the lock is done. It
+// dispatches events when the socket has some and handles redraw requests,
+// authentication results, timers and watcher updates in between. Nothing
+// else talks to the compositor.
+//
+// Without the socket, the loop makes a round trip every waylandPollInterval
+// instead, which dispatches whatever the compositor sent in the meantime.
+func (l *WaylandLocker) runEventLoop(socket syscall.RawConn) {
+	defer close(l.loopDone)
+	defer l.closeWayland()
+
+	var readable chan struct{}
+	resume := make(chan struct{})
+	var poll *time.Ticker
+	if socket != nil {
+		readable = make(chan struct{})
+		go waitReadable(socket, readable, resume, l.done)
+	} else {
+		poll = time.NewTicker(waylandPollInterval)
+		defer poll.Stop()
+	}
+
+	l.scheduleClock()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-tickerC(poll):
+			if err := l.pollEvents(); err != nil {
+				Error("Failed to dispatch Wayland events: %v", err)
+				l.finish()
+				return
+			}
+		case <-readable:
+			if err := l.dispatchEvents(socket); err != nil {
+				Error("Failed to dispatch Wayland events: %v", err)
+				l.finish()
+				return
+			}
+			select {
+			case resume <- struct{}{}:
+			case <-l.done:
+				return
+			}
+		case count := <-l.redrawCh:
+			// The animation draws the dots itself until it's over
+			if l.shakeTimer == nil {
+				Debug("Redrawing password dots: count=%d", count)
+				l.redrawSurfaces(count, 0)
+			}
+		case task := <-l.tasks:
+			task()
+		case outcome := <-l.authResults:
+			l.finishAuthentication(outcome)
+		case <-timerC(l.shakeTimer):
+			l.shakeStep()
+		case <-tickerC(l.countdownTicker):
+			l.countdownTick()
+		case <-timerC(l.clockTimer):
+			l.updatePasswordDisplay()
+			l.scheduleClock()
+		case event := <-l.fingerprintEvents:
+			l.mu.Lock()
+			l.handleFingerprint(event)
+			l.mu.Unlock()
+		case <-l.unlockDeviceChanges:
+			// Keep the "insert security key" hint up to date
+			l.updatePasswordDisplay()
+		}
+	}
+}
+
+// scheduleClock sets the clock timer to when the clock next changes
+func (l *WaylandLocker) scheduleClock() {
+	if wait, ok := l.renderer.UntilClockChanges(time.Now()); ok {
+		l.clockTimer = time.NewTimer(wait)
+	}
+}
+
+// dispatchEvents dispatches the events waiting on the socket
+func (l *WaylandLocker) dispatchEvents(socket syscall.RawConn) error {
+	for {
+		err := wlclient.DisplayDispatch(l.display)
+		if err == wl.ErrContextRunProxyNil {
+			// Sent to an object we destroyed before the compositor noticed
+			Debug("Ignoring event for a destroyed Wayland object")
+		} else if err != nil {
+			return err
+		}
+
+		if !socketReadable(socket) {
+			return nil
+		}
+	}
+}
+
+// pollEvents dispatches the events the compositor sent so far through a
+// round trip, for when the loop can't wait on the socket
+func (l *WaylandLocker) pollEvents() error {
+	for {
+		err := wlclient.DisplayRoundtrip(l.display)
+		if err != wl.ErrContextRunProxyNil {
+			return err
+		}
+		// Sent to an object we destroyed before the compositor noticed
+		Debug("Ignoring event for a destroyed Wayland object")
+	}
+}
+
+// closeWayland stops the timers and lets go of the buffers and connection
+func (l *WaylandLocker) closeWayland() {
+	if l.shakeTimer != nil {
+		l.shakeTimer.Stop()
+		l.shakeTimer = nil
+	}
+	if l.clockTimer != nil {
+		l.clockTimer.Stop()
+		l.clockTimer = nil
+	}
+	l.stopCountdown()
+
+	l.destroySurfaceBuffers()
+	wlclient.DisplayDisconnect(l.display)
+}
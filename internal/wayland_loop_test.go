@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neurlang/wayland/wlclient"
+)
+
+func TestWaylandFinishConcurrently(t *testing.T) {
+	l := &WaylandLocker{done: make(chan struct{})}
+
+	// Unlocking and a lost connection can end the lock at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.finish()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-l.done:
+	default:
+		t.Fatal("done isn't closed")
+	}
+}
+
+func TestWaylandSocket(t *testing.T) {
+	// Connecting only dials, so a bare listener stands in for the compositor
+	dir := t.TempDir()
+	listener, err := net.Listen("unix", filepath.Join(dir, "wayland-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	t.Setenv("WAYLAND_DISPLAY", "wayland-test")
+
+	display, err := wlclient.DisplayConnect(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wlclient.DisplayDisconnect(display)
+
+	// Fails when an update of the Wayland library moves the connection
+	socket, err := waylandSocket(display)
+	if err != nil {
+		t.Fatalf("waylandSocket: %v", err)
+	}
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if socketReadable(socket) {
+		t.Error("socket readable before the compositor sent anything")
+	}
+	server.Write(make([]byte, 8))
+	readable := make(chan struct{}, 1)
+	resume := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go waitReadable(socket, readable, resume, done)
+	select {
+	case <-readable:
+	case <-time.After(time.Second):
+		t.Error("socket not readable after the compositor sent an event")
+	}
+}
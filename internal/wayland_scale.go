@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/neurlang/wayland/wl"
+)
+
+// Client side of the wp_viewporter and wp_fractional_scale_v1 protocols,
+// which the Wayland library doesn't come with. Lock surfaces use them to
+// draw at the output's native resolution when it's scaled by a fraction.
+
+// fractionalScaleDenominator is what wp_fractional_scale_v1 scales are
+// multiplied by, 180 stands for 1.5
+const fractionalScaleDenominator = 120
+
+// wpViewporter is a wp_viewporter object
+type wpViewporter struct {
+	wl.BaseProxy
+}
+
+// bindViewporter binds the wp_viewporter global
+func bindViewporter(r *wl.Registry, name uint32) *wpViewporter {
+	viewporter := &wpViewporter{}
+	r.Context().Register(viewporter)
+	_ = r.Bind(name, "wp_viewporter", 1, viewporter)
+	return viewporter
+}
+
+// GetViewport creates the viewport of surface
+func (v *wpViewporter) GetViewport(surface *wl.Surface) (*wpViewport, error) {
+	viewport := &wpViewport{}
+	v.Context().Register(viewport)
+	return viewport, v.Context().SendRequest(v, 1, viewport, surface)
+}
+
+// Dispatch implements wl.Dispatcher, wp_viewporter has no events
+func (v *wpViewporter) Dispatch(*wl.Event) {}
+
+// wpViewport is a wp_viewport object, it sets the size a surface has on
+// screen independently of its buffer
+type wpViewport struct {
+	wl.BaseProxy
+}
+
+// Destroy destroys the viewport
+func (v *wpViewport) Destroy() error {
+	return v.Context().SendRequest(v, 0)
+}
+
+// SetDestination sets the size of the surface in surface coordinates,
+// -1, -1 unsets it
+func (v *wpViewport) SetDestination(width, height int32) error {
+	return v.Context().SendRequest(v, 2, width, height)
+}
+
+// Dispatch implements wl.Dispatcher, wp_viewport has no events
+func (v *wpViewport) Dispatch(*wl.Event) {}
+
+// wpFractionalScaleManager is a wp_fractional_scale_manager_v1 object
+type wpFractionalScaleManager struct {
+	wl.BaseProxy
+}
+
+// bindFractionalScaleManager binds the wp_fractional_scale_manager_v1 global
+func bindFractionalScaleManager(r *wl.Registry, name uint32) *wpFractionalScaleManager {
+	manager := &wpFractionalScaleManager{}
+	r.Context().Register(manager)
+	_ = r.Bind(name, "wp_fractional_scale_manager_v1", 1, manager)
+	return manager
+}
+
+// GetFractionalScale creates the fractional scale object of surface
+func (m *wpFractionalScaleManager) GetFractionalScale(surface *wl.Surface) (*wpFractionalScale, error) {
+	scale := &wpFractionalScale{}
+	m.Context().Register(scale)
+	return scale, m.Context().SendRequest(m, 1, scale, surface)
+}
+
+// Dispatch implements wl.Dispatcher, wp_fractional_scale_manager_v1 has no events
+func (m *wpFractionalScaleManager) Dispatch(*wl.Event) {}
+
+// wpFractionalScale is a wp_fractional_scale_v1 object, which tells the
+// scale the compositor would like a surface to be drawn at
+type wpFractionalScale struct {
+	wl.BaseProxy
+	mu       sync.RWMutex
+	handlers []func(scale float64)
+}
+
+// Destroy destroys the fractional scale object
+func (s *wpFractionalScale) Destroy() error {
+	return s.Context().SendRequest(s, 0)
+}
+
+// AddPreferredScaleHandler calls handler with every preferred scale
+func (s *wpFractionalScale) AddPreferredScaleHandler(handler func(scale float64)) {
+	s.mu.Lock()
+	s.handlers = append(s.handlers, handler)
+	s.mu.Unlock()
+}
+
+// Dispatch implements wl.Dispatcher for the preferred_scale event
+func (s *wpFractionalScale) Dispatch(event *wl.Event) {
+	if event.Opcode != 0 {
+		return
+	}
+	scale := float64(event.Uint32()) / fractionalScaleDenominator
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, handler := range s.handlers {
+		handler(scale)
+	}
+}
+
+// trackSurfaceScale keeps the scale of buffers, which draw the lock surface
+// of output, in line with the output's scale and the compositor's preferred
+// fractional scale
+func (l *WaylandLocker) trackSurfaceScale(output *wl.Output, surface *wl.Surface, buffers *surfaceBuffers) {
+	if info, ok := l.registryHandler.outputGeometries[output]; ok {
+		buffers.outputScale = info.scale
+	}
+	output.AddScaleHandler(outputScaleHandlerFunc(func(ev wl.OutputScaleEvent) {
+		buffers.SetOutputScale(int(ev.Factor))
+	}))
+
+	// Fractional scales need a viewport to size the surface
+	if l.viewporter == nil {
+		return
+	}
+	viewport, err := l.viewporter.GetViewport(surface)
+	if err != nil {
+		Warn("Failed to create viewport, fractional scaling is off: %v", err)
+		return
+	}
+	buffers.viewport = viewport
+
+	if l.fractionalScale == nil {
+		return
+	}
+	fractional, err := l.fractionalScale.GetFractionalScale(surface)
+	if err != nil {
+		Warn("Failed to get fractional scale: %v", err)
+		return
+	}
+	fractional.AddPreferredScaleHandler(buffers.SetPreferredScale)
+	buffers.fractional = fractional
+}
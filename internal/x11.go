@@ -1,9 +1,11 @@
 package internal
 
 import (
-	_ "embed"
 	"fmt"
 	"image"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/xgb"
@@ -12,22 +14,16 @@ import (
 	"github.com/BurntSushi/xgb/screensaver"
 	"github.com/BurntSushi/xgb/xfixes"
 	"github.com/BurntSushi/xgb/xproto"
-	"github.com/BurntSushi/xgb/xtest"
-	"golang.org/x/image/font"
-	"golang.org/x/image/font/opentype"
-	"golang.org/x/image/math/fixed"
 )
 
-//go:embed fonts/DejaVuSans-Bold.ttf
-var x11FontBytes []byte
-
 // Init initializes the X11 connection and resources
 func (l *X11Locker) Init() error {
 	Info("Initializing X11 connection and resources")
 	var err error
 
 	Info("Attempting to connect to X server")
-	l.conn, err = xgb.NewConn()
+	l.synthetic = make(chan string, 16)
+	l.conn, err = newXConn(&xStream{onSynthetic: l.noteSyntheticEvent})
 	if err != nil {
 		Error("Failed to connect to X server: %v", err)
 		return fmt.Errorf("failed to connect to X server: %v", err)
@@ -55,19 +51,19 @@ func (l *X11Locker) Init() error {
 	}
 	Info("Successfully initialized XFixes extension")
 
-	Info("Initializing XTest extension")
-	if err := xtest.Init(l.conn); err != nil {
-		Error("Failed to initialize XTest extension: %v", err)
-		return fmt.Errorf("failed to initialize XTest extension: %v", err)
-	}
-	Info("Successfully initialized XTest extension")
-
 	setup := xproto.Setup(l.conn)
 	l.screen = setup.DefaultScreen(l.conn)
 	l.width = l.screen.WidthInPixels
 	l.height = l.screen.HeightInPixels
 	Info("Screen dimensions: %dx%d", l.width, l.height)
 
+	// Input faked through XTest looks like typing to core events
+	Info("Watching XInput raw events for injected input")
+	l.xinput, err = newXIInput(l.screen.Root)
+	if err != nil {
+		Warn("Input injected through XTest can't be detected: %v", err)
+	}
+
 	Info("Allocating window ID")
 	wid, err := xproto.NewWindowId(l.conn)
 	if err != nil {
@@ -108,7 +104,7 @@ func (l *X11Locker) Init() error {
 	xproto.ChangeProperty(l.conn, xproto.PropModeReplace, l.window,
 		xproto.AtomWmName, xproto.AtomString, 8, uint32(len(wmName)), []byte(wmName))
 
-	// Initialize GC for drawing password dots
+	// Initialize GC for uploading the rendered UI
 	Info("Initializing graphics context for drawing")
 	gcid, err := xproto.NewGcontextId(l.conn)
 	if err != nil {
@@ -130,61 +126,7 @@ func (l *X11Locker) Init() error {
 	}
 	Info("Graphics context initialized successfully")
 
-	// Create a graphics context for text with the embedded font
-	l.textGC, err = xproto.NewGcontextId(l.conn)
-	if err != nil {
-		return fmt.Errorf("failed to create text graphics context: %v", err)
-	}
-
-	// Set up the text graphics context with white foreground
-	err = xproto.CreateGCChecked(
-		l.conn,
-		l.textGC,
-		xproto.Drawable(l.screen.Root),
-		xproto.GcForeground|xproto.GcBackground,
-		[]uint32{l.screen.WhitePixel, l.screen.BlackPixel},
-	).Check()
-	if err != nil {
-		Error("Failed to create text graphics context: %v", err)
-		return fmt.Errorf("failed to create text graphics context: %v", err)
-	}
-
-	// Set font properties for larger text
-	fontName := "fixed" // Use the built-in fixed font which is guaranteed to exist
-
-	// Allocate a new font ID
-	fontID, err := xproto.NewFontId(l.conn)
-	if err != nil {
-		Error("Failed to allocate font ID: %v", err)
-		return fmt.Errorf("failed to allocate font ID: %v", err)
-	}
-
-	// Try to load the font
-	err = xproto.OpenFontChecked(
-		l.conn,
-		fontID,
-		uint16(len(fontName)),
-		fontName,
-	).Check()
-	if err != nil {
-		Error("Failed to open font: %v", err)
-		return fmt.Errorf("failed to open font: %v", err)
-	}
-	defer xproto.CloseFont(l.conn, fontID)
-
-	err = xproto.ChangeGCChecked(
-		l.conn,
-		l.textGC,
-		xproto.GcFont,
-		[]uint32{uint32(fontID)},
-	).Check()
-	if err != nil {
-		Error("Failed to set font: %v", err)
-		return fmt.Errorf("failed to set font: %v", err)
-	}
-
-	l.dotWindows = []xproto.Window{}
-	l.messageWindows = []xproto.Window{}
+	l.setupUIVisual()
 
 	Info("X11 initialization completed successfully")
 	return nil
@@ -210,6 +152,10 @@ func (l *X11Locker) detectMonitors() ([]Monitor, error) {
 
 	monitors := []Monitor{}
 
+	// Xft.dpi is what the desktop sets for HiDPI, it beats guessing from
+	// the physical size
+	xftScale := l.xftScale()
+
 	// Iterate through all outputs (monitors)
 	for _, output := range resources.Outputs {
 		// Get output info
@@ -241,16 +187,22 @@ func (l *X11Locker) detectMonitors() ([]Monitor, error) {
 		Debug("Found connected monitor: x=%d, y=%d, width=%d, height=%d",
 			crtcInfo.X, crtcInfo.Y, crtcInfo.Width, crtcInfo.Height)
 
+		scale := xftScale
+		if scale == 0 {
+			scale = physicalScale(int(crtcInfo.Width), outputInfo.MmWidth)
+		}
+
 		// Add to the list of monitors
 		monitors = append(monitors, Monitor{
 			X:      int(crtcInfo.X),
 			Y:      int(crtcInfo.Y),
 			Width:  int(crtcInfo.Width),
 			Height: int(crtcInfo.Height),
+			Scale:  scale,
 		})
 
-		Info("Added monitor: width=%d, height=%d, x=%d, y=%d",
-			crtcInfo.Width, crtcInfo.Height, crtcInfo.X, crtcInfo.Y)
+		Info("Added monitor: width=%d, height=%d, x=%d, y=%d, scale=%g",
+			crtcInfo.Width, crtcInfo.Height, crtcInfo.X, crtcInfo.Y, scale)
 	}
 
 	// If no monitors detected, fall back to single monitor
@@ -262,6 +214,7 @@ func (l *X11Locker) detectMonitors() ([]Monitor, error) {
 			Y:      0,
 			Width:  int(l.width),
 			Height: int(l.height),
+			Scale:  xftScale,
 		})
 	}
 
@@ -273,40 +226,103 @@ func (l *X11Locker) detectMonitors() ([]Monitor, error) {
 	return monitors, nil
 }
 
+// xftScale returns the UI scale that Xft.dpi in the X resources asks for, or
+// 0 if it isn't set
+func (l *X11Locker) xftScale() float64 {
+	reply, err := xproto.GetProperty(l.conn, false, l.screen.Root,
+		xproto.AtomResourceManager, xproto.AtomString, 0, 1<<16).Reply()
+	if err != nil {
+		Debug("Failed to read X resources: %v", err)
+		return 0
+	}
+	return parseXftScale(string(reply.Value))
+}
+
+// parseXftScale finds Xft.dpi in X resources and turns it into a scale,
+// 96 DPI being 1
+func parseXftScale(resources string) float64 {
+	for _, line := range strings.Split(resources, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) != "Xft.dpi" {
+			continue
+		}
+		dpi, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || dpi <= 0 {
+			return 0
+		}
+		return dpi / 96
+	}
+	return 0
+}
+
+// physicalScale guesses the UI scale of a monitor from its width in pixels
+// and millimeters, in steps of a quarter and never below 1. Sizes too small
+// to be real, which some EDIDs report, mean 1.
+func physicalScale(pixels int, millimeters uint32) float64 {
+	if millimeters < 100 {
+		return 1
+	}
+	dpi := float64(pixels) * 25.4 / float64(millimeters)
+	return max(1, math.Round(dpi/96*4)/4)
+}
+
 // NewX11Locker creates a new X11-based screen locker
 func NewX11Locker(config Configuration) *X11Locker {
-	Info("Creating new X11Locker with config: %+v", config)
+	Info("Creating new X11Locker with config: %+v", config.redacted())
 	return &X11Locker{
 		config:         config,
 		helper:         NewLockHelper(config),
 		mediaPlayer:    NewMediaPlayer(config),
-		passwordBuf:    "",
+		securePassword: NewSecurePassword(),
+		switchUser:     NewSwitchUserPrompt(),
 		isLocked:       false,
 		passwordDots:   make([]bool, 0),
-		maxDots:        20, // Maximum number of password dots to display
 		lockoutManager: NewLockoutManager(config),
+		renderer:       NewRenderer(nil, ThemeFor(config)), // The UI is drawn over the media
 	}
 }
 
-// Lock immediately locks the screen
+// Lock immediately locks the screen and blocks until it is unlocked
 func (l *X11Locker) Lock() error {
 	// Check if already locked
 	if l.isLocked {
 		return nil
 	}
+	defer l.helper.Close()
 
-	// Run pre-lock command if configured
-	if err := l.helper.RunPreLockCommand(); err != nil {
-		Error("Failed to run pre-lock command: %v", err)
-	}
+	// Run on_lock hooks before anything is put on screen
+	l.helper.RunHook(HookOnLock, HookEnv{})
 
 	// Pause media if enabled
 	if err := l.helper.PauseMediaIfEnabled(); err != nil {
 		Error("Failed to pause media: %v", err)
 	}
 
+	if err := l.Init(); err != nil {
+		return err
+	}
+	l.renderer.SetUser(l.helper.SessionUserProfile())
+
+	// Play media and show the UI on every monitor
+	monitors, err := l.detectMonitors()
+	if err != nil {
+		Warn("Failed to detect monitors: %v", err)
+		monitors = []Monitor{{Width: int(l.width), Height: int(l.height), Scale: l.xftScale()}}
+	} else {
+		l.mediaPlayer.SetMonitors(monitors)
+	}
+	l.outputs = make([]x11Output, len(monitors))
+	for i, monitor := range monitors {
+		l.outputs[i].monitor = monitor
+	}
+
 	// Set locked state
 	l.isLocked = true
+	l.injectedEvents = 0
+	l.helper.AuditLockStart()
+	if l.xinput == nil {
+		l.helper.AuditInputUnchecked("Input injected through XTest can't be detected")
+	}
 
 	// Start media playback if configured
 	if l.mediaPlayer != nil {
@@ -315,14 +331,363 @@ func (l *X11Locker) Lock() error {
 		}
 	}
 
-	// Run post-lock command if configured
-	if err := l.helper.RunPostLockCommand(); err != nil {
-		Error("Failed to run post-lock command: %v", err)
+	// Put the input window on top and take the keyboard and pointer
+	xproto.MapWindow(l.conn, l.window)
+	xproto.ConfigureWindow(l.conn, l.window, xproto.ConfigWindowStackMode, []uint32{xproto.StackModeAbove})
+	if err := l.grabInput(); err != nil {
+		Error("Failed to grab input: %v", err)
+		l.isLocked = false
+		l.cleanup()
+		return err
+	}
+
+	if err := l.hideCursor(); err != nil {
+		Warn("Failed to hide cursor: %v", err)
 	}
 
+	// Find out when other windows map or restack so they can't cover the lock
+	if err := l.watchStacking(); err != nil {
+		Warn("Failed to watch window stacking: %v", err)
+	}
+
+	// The lock is in place now
+	l.helper.StartHook(HookOnLocked, HookEnv{})
+	l.helper.StartSessionWatchers()
+
+	// Draw the prompt, or the countdown of a lockout carried over from a previous run
+	l.drawUI()
+
+	l.eventLoop()
+	l.cleanup()
+
+	// Run on_unlock hooks now that the screen is actually unlocked, and
+	// let the ones still running finish
+	l.helper.RunHook(HookOnUnlock, HookEnv{User: l.unlockedBy})
+	l.helper.WaitHooks()
+
 	return nil
 }
 
+// watchStacking subscribes to SubstructureNotify on the root window, which
+// reports every top-level window that maps or restacks
+func (l *X11Locker) watchStacking() error {
+	err := xproto.ChangeWindowAttributesChecked(l.conn, l.screen.Root, xproto.CwEventMask,
+		[]uint32{xproto.EventMaskSubstructureNotify}).Check()
+	if err != nil {
+		return fmt.Errorf("failed to select root window events: %v", err)
+	}
+	return nil
+}
+
+// isOwnWindow reports whether a window belongs to the lock screen
+func (l *X11Locker) isOwnWindow(window xproto.Window) bool {
+	if window == l.window {
+		return true
+	}
+	for _, output := range l.outputs {
+		for _, own := range output.windows {
+			if window == own {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restackWindow keeps a window that mapped or restacked from covering the
+// lock. Override-redirect windows are pushed below it. The window manager
+// owns the stacking of the others and would just get a request to lower
+// them, so the lock screen's windows are raised over them instead.
+func (l *X11Locker) restackWindow(window xproto.Window, overrideRedirect bool) {
+	if !l.isAboveLock(window) {
+		return
+	}
+	if overrideRedirect {
+		l.lowerWindow(window)
+		return
+	}
+	Debug("Raising the lock over managed window 0x%x", window)
+	l.raiseOwnWindows()
+}
+
+// isAboveLock reports whether a top-level window is stacked above the lock
+// window. If the stack can't be read, the window is assumed to be above.
+func (l *X11Locker) isAboveLock(window xproto.Window) bool {
+	tree, err := xproto.QueryTree(l.conn, l.screen.Root).Reply()
+	if err != nil {
+		Debug("Failed to read the window stack: %v", err)
+		return true
+	}
+
+	// Children are listed from the bottom of the stack to the top
+	lockSeen := false
+	for _, child := range tree.Children {
+		switch child {
+		case l.window:
+			lockSeen = true
+		case window:
+			return lockSeen
+		}
+	}
+	return false
+}
+
+// lowerWindow pushes an override-redirect window that showed up above the
+// lock, like a notification or tooltip, to the bottom of the stack and
+// raises the lock screen's windows again. The window goes back on top on
+// unlock.
+func (l *X11Locker) lowerWindow(window xproto.Window) {
+	Debug("Lowering window 0x%x that appeared above the lock", window)
+	xproto.ConfigureWindow(l.conn, window, xproto.ConfigWindowStackMode, []uint32{xproto.StackModeBelow})
+
+	known := false
+	for _, lowered := range l.loweredWindows {
+		if lowered == window {
+			known = true
+			break
+		}
+	}
+	if !known {
+		l.loweredWindows = append(l.loweredWindows, window)
+	}
+
+	l.raiseOwnWindows()
+}
+
+// raiseOwnWindows puts the lock screen's windows back on top
+func (l *X11Locker) raiseOwnWindows() {
+	raise := func(window xproto.Window) {
+		xproto.ConfigureWindow(l.conn, window, xproto.ConfigWindowStackMode, []uint32{xproto.StackModeAbove})
+	}
+
+	raise(l.window)
+	for _, output := range l.outputs {
+		for _, window := range output.windows {
+			raise(window)
+		}
+	}
+}
+
+// restoreLoweredWindows raises the windows lowerWindow pushed down. Those
+// that were destroyed meanwhile just produce an ignored error.
+func (l *X11Locker) restoreLoweredWindows() {
+	for _, window := range l.loweredWindows {
+		xproto.ConfigureWindow(l.conn, window, xproto.ConfigWindowStackMode, []uint32{xproto.StackModeAbove})
+	}
+	l.loweredWindows = nil
+}
+
+// grabInput grabs the keyboard and pointer, retrying for a while in case
+// another client (e.g. an open menu) is still holding them
+func (l *X11Locker) grabInput() error {
+	var lastErr error
+	for attempt := 0; attempt < 20; attempt++ {
+		kbd, err := xproto.GrabKeyboard(l.conn, false, l.window, xproto.TimeCurrentTime,
+			xproto.GrabModeAsync, xproto.GrabModeAsync).Reply()
+		if err != nil {
+			lastErr = err
+		} else if kbd.Status != xproto.GrabStatusSuccess {
+			lastErr = fmt.Errorf("keyboard grab status %d", kbd.Status)
+		} else {
+			ptr, err := xproto.GrabPointer(l.conn, false, l.window, xproto.EventMaskButtonPress,
+				xproto.GrabModeAsync, xproto.GrabModeAsync, xproto.WindowNone, xproto.CursorNone,
+				xproto.TimeCurrentTime).Reply()
+			if err == nil && ptr.Status == xproto.GrabStatusSuccess {
+				Debug("Grabbed keyboard and pointer after %d attempts", attempt+1)
+				return nil
+			}
+			if err != nil {
+				lastErr = err
+			} else {
+				lastErr = fmt.Errorf("pointer grab status %d", ptr.Status)
+			}
+			xproto.UngrabKeyboard(l.conn, xproto.TimeCurrentTime)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return fmt.Errorf("failed to grab keyboard and pointer: %v", lastErr)
+}
+
+// eventLoop handles X events and fingerprint results until the screen is unlocked
+func (l *X11Locker) eventLoop() {
+	// Read X events on their own goroutine so fingerprint results can be
+	// handled on this one
+	events := make(chan xgb.Event, 16)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(events)
+		for {
+			ev, err := l.conn.WaitForEvent()
+			if ev == nil && err == nil {
+				return
+			}
+			if err != nil {
+				Debug("X error: %v", err)
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Claiming the fingerprint reader waits on fprintd, so it's done on
+	// another goroutine while X events are handled
+	var fingerprints <-chan FingerprintEvent
+	fingerprintStarted := make(chan (<-chan FingerprintEvent), 1)
+	go func() { fingerprintStarted <- l.helper.StartFingerprint() }()
+	unlockDevices := l.helper.StartUnlockDeviceWatch()
+
+	// Tick the lockout countdown
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Redraw whenever the clock changes
+	var clock <-chan time.Time
+	scheduleClock := func() {
+		if wait, ok := l.renderer.UntilClockChanges(time.Now()); ok {
+			clock = time.After(wait)
+		}
+	}
+	scheduleClock()
+
+	for l.isLocked {
+		select {
+		case what := <-l.synthetic:
+			l.rejectInjectedInput(what, "Synthetic input event sent by another X client")
+		case ev, ok := <-events:
+			if !ok {
+				Error("X server connection closed")
+				return
+			}
+			switch e := ev.(type) {
+			case xproto.KeyPressEvent:
+				if l.xinput != nil && l.xinput.Injected(xiRawKeyPress, e.Time, uint32(e.Detail)) {
+					l.rejectInjectedInput(fmt.Sprintf("key press %d from XTest", e.Detail), "Input injected through XTest by another X client")
+					continue
+				}
+				l.helper.NoteActivity()
+				l.handleKeyPress(e)
+			case xproto.ButtonPressEvent:
+				if l.xinput != nil && l.xinput.Injected(xiRawButtonPress, e.Time, uint32(e.Detail)) {
+					l.rejectInjectedInput(fmt.Sprintf("button press %d from XTest", e.Detail), "Input injected through XTest by another X client")
+					continue
+				}
+				l.helper.NoteActivity()
+				continue
+			case xproto.ExposeEvent:
+				// Redraw once the last exposed area of a UI window is reported
+				if e.Count > 0 {
+					continue
+				}
+			case xproto.MapNotifyEvent:
+				if l.isOwnWindow(e.Window) {
+					continue
+				}
+				l.restackWindow(e.Window, e.OverrideRedirect)
+			case xproto.ConfigureNotifyEvent:
+				// AboveSibling is None once the window is at the bottom,
+				// which is also where lowerWindow puts it
+				if l.isOwnWindow(e.Window) || e.AboveSibling == 0 {
+					continue
+				}
+				l.restackWindow(e.Window, e.OverrideRedirect)
+			case xproto.CirculateNotifyEvent:
+				if l.isOwnWindow(e.Window) || e.Place != xproto.PlaceOnTop {
+					continue
+				}
+				attrs, err := xproto.GetWindowAttributes(l.conn, e.Window).Reply()
+				if err != nil {
+					continue
+				}
+				l.restackWindow(e.Window, attrs.OverrideRedirect)
+			default:
+				continue
+			}
+		case fingerprints = <-fingerprintStarted:
+			continue
+		case event := <-fingerprints:
+			l.handleFingerprint(event)
+		case <-unlockDevices:
+			// Redraw to show or hide the "insert security key" hint
+		case <-ticker.C:
+			if !l.lockoutManager.IsLockedOut() && !l.lockoutShown {
+				continue
+			}
+		case <-clock:
+			scheduleClock()
+		}
+
+		if l.isLocked {
+			l.drawUI()
+		}
+	}
+}
+
+// noteSyntheticEvent passes an input event another client sent with
+// SendEvent to the event loop. It's called by xgb's reading goroutine, and
+// drops the event when the loop is behind.
+func (l *X11Locker) noteSyntheticEvent(buf []byte) {
+	what := "synthetic event"
+	if newEvent, ok := xgb.NewEventFuncs[int(buf[0]&0x7f)]; ok {
+		what = "synthetic " + newEvent(buf).String()
+	}
+	select {
+	case l.synthetic <- what:
+	default:
+	}
+}
+
+// rejectInjectedInput drops input sent or faked by another client. Only the
+// first one of a lock is audited so a flood can't fill the log.
+func (l *X11Locker) rejectInjectedInput(what, message string) {
+	l.injectedEvents++
+	if l.injectedEvents > 1 {
+		Debug("Dropped %s", what)
+		return
+	}
+
+	Warn("Dropped %s, another client is injecting input", what)
+	l.helper.AuditTampering(message)
+}
+
+// handleFingerprint shows a fingerprint result and unlocks on a match
+func (l *X11Locker) handleFingerprint(event FingerprintEvent) {
+	Debug("Fingerprint result: %s", event.Result)
+
+	if l.lockoutManager.IsLockedOut() || l.awaitingCode {
+		Debug("Ignoring fingerprint during lockout or code entry")
+		return
+	}
+
+	if event.Matched {
+		if !l.helper.UnlockDevicePresent() {
+			Info("Fingerprint matched but no trusted USB device is plugged in")
+			return
+		}
+		if l.helper.SecondFactorEnabled() {
+			l.awaitingCode = true
+			l.securePassword.Clear()
+			l.passwordDots = make([]bool, 0)
+			l.statusMessage = "Enter authentication code"
+			return
+		}
+		Info("Fingerprint matched, unlocking screen")
+		l.unlock("")
+		return
+	}
+
+	if event.Failed {
+		l.helper.AuditFingerprintFailure(event)
+	}
+	l.statusMessage = event.Message
+}
+
 // hideCursor hides the mouse cursor
 func (l *X11Locker) hideCursor() error {
 	Info("Hiding mouse cursor")
@@ -429,7 +794,7 @@ func (l *X11Locker) handleKeyPress(e xproto.KeyPressEvent) {
 			// For regular Escape during lockout, just clear password
 			if keySym == 0xff1b { // Escape key
 				Debug("Escape pressed during lockout, clearing password")
-				l.passwordBuf = ""
+				l.securePassword.Clear()
 				l.passwordDots = make([]bool, 0)
 			}
 		}
@@ -461,15 +826,32 @@ func (l *X11Locker) handleKeyPress(e xproto.KeyPressEvent) {
 		// Regular key handling
 		switch keySym {
 		case 0xff0d, 0xff8d: // Return, KP_Enter
+			if l.switchUser.IsEditing() {
+				Debug("Enter key pressed, confirming switch user prompt")
+				l.switchUser.Confirm()
+				return
+			}
 			Debug("Enter key pressed, attempting authentication")
 			// Try to authenticate
 			l.authenticate()
 
+		case 0xff09: // Tab
+			if l.helper.SwitchUserEnabled() && !l.switchUser.IsActive() && !l.awaitingCode {
+				Debug("Tab pressed, opening switch user prompt")
+				l.securePassword.Clear()
+				l.passwordDots = make([]bool, 0)
+				l.switchUser.Start()
+			}
+
 		case 0xff08: // BackSpace
+			if l.switchUser.IsEditing() {
+				l.switchUser.RemoveLast()
+				return
+			}
 			Debug("Backspace pressed, removing last character")
 			// Delete last character
-			if len(l.passwordBuf) > 0 {
-				l.passwordBuf = l.passwordBuf[:len(l.passwordBuf)-1]
+			if l.securePassword.Length() > 0 {
+				l.securePassword.RemoveLast()
 				if len(l.passwordDots) > 0 {
 					l.passwordDots = l.passwordDots[:len(l.passwordDots)-1]
 				}
@@ -478,18 +860,33 @@ func (l *X11Locker) handleKeyPress(e xproto.KeyPressEvent) {
 		case 0xff1b: // Escape
 			Debug("Escape pressed, clearing password")
 			// Clear password
-			l.passwordBuf = ""
+			l.securePassword.Clear()
 			l.passwordDots = make([]bool, 0)
+			if l.awaitingCode {
+				// Go back to asking for the password
+				l.awaitingCode = false
+				l.statusMessage = ""
+				return
+			}
+			l.switchUser.Cancel()
 
 		default:
+			// Typed characters go to the username while switching user
+			if l.switchUser.IsEditing() {
+				if keySym >= 0x20 && keySym <= 0x7e {
+					l.switchUser.AppendChar(rune(keySym))
+				}
+				return
+			}
+
 			// Only add printable characters
 			if keySym >= 0x20 && keySym <= 0x7e {
 				Debug("Adding character to password (keysym: 0x%x)", keySym)
 				// Regular ASCII character
-				l.passwordBuf += string(rune(keySym))
+				l.securePassword.Append(byte(keySym))
 
 				// Add a new dot
-				if len(l.passwordDots) < l.maxDots {
+				if len(l.passwordDots) < maxDots {
 					l.passwordDots = append(l.passwordDots, true)
 				}
 			}
@@ -505,587 +902,394 @@ func (l *X11Locker) authenticate() {
 		// Still in lockout period, don't even attempt authentication
 		remainingTime := l.lockoutManager.GetRemainingTime().Round(time.Second)
 		Info("Authentication locked out for another %v", remainingTime)
-		l.passwordBuf = ""
+		l.securePassword.Clear()
 
 		// Keep the dots for shake animation
 		// We'll clear them after the animation
 
 		// Shake the password field to indicate lockout
-		go l.shakePasswordField()
+		l.shakePasswordField()
 		return
 	}
 
-	// Add debug log for password attempt (don't log actual password)
-	Info("Attempting authentication with password of length: %d", len(l.passwordBuf))
+	// Ignore an empty Enter unless the policy counts it as a failure
+	if l.securePassword.Length() == 0 && !l.lockoutManager.CountsEmptyAttempts() {
+		Debug("Empty password submitted, ignoring")
+		return
+	}
 
-	// Try to authenticate using PAM
-	result := l.helper.authenticator.Authenticate(l.passwordBuf)
+	// Add debug log for password attempt (don't log actual password)
+	Info("Attempting authentication with password of length: %d", l.securePassword.Length())
+
+	// Try to authenticate using PAM, showing that the password is being
+	// checked while it takes
+	username := l.switchUser.Username()
+	var result AuthResult
+	l.verifying = true
+	l.drawUI()
+	l.securePassword.WithBytes(func(secret []byte) {
+		if l.awaitingCode {
+			result = l.helper.VerifySecondFactor(secret)
+		} else {
+			result = l.helper.AuthenticateUser(username, secret)
+		}
+	})
+	l.verifying = false
 
 	// Detailed logging of authentication result
 	Info("Authentication result: success=%v, message=%s", result.Success, result.Message)
 
-	if result.Success {
-		// Authentication successful, unlock and reset counters
-		l.isLocked = false
-		l.lockoutManager.ResetLockout()
-
-		// Unpause media if enabled
-		if err := l.helper.UnpauseMediaIfEnabled(); err != nil {
-			Warn("Failed to unpause media: %v", err)
-		}
+	// The password was right, ask for the TOTP code next
+	if result.SecondFactor {
+		l.awaitingCode = true
+		l.statusMessage = result.Message
+		l.securePassword.Clear()
+		l.passwordDots = make([]bool, 0)
+		return
+	}
+	l.awaitingCode = false
 
+	if result.Success {
 		Info("Authentication successful, unlocking screen")
+		l.unlock(username)
 	} else {
 		// Authentication failed, use the lockout manager to handle the failed attempt
-		lockoutActive, lockoutDuration, _ := l.lockoutManager.HandleFailedAttempt()
+		lockoutActive, lockoutDuration, remainingAttempts := l.lockoutManager.HandleFailedAttempt()
 		Info("lockOutDuration: %d", lockoutDuration)
+		l.helper.AuditAuthFailure(username, result)
+		if lockoutActive {
+			l.helper.AuditLockout(lockoutDuration, l.lockoutManager.LockoutReason())
+		}
+		l.helper.StartFailureHooks(username, lockoutActive, lockoutDuration)
+
+		// Tell the user how many attempts the policy has left
+		if lockoutActive {
+			l.statusMessage = ""
+		} else {
+			l.statusMessage = FormatRemainingAttempts(remainingAttempts)
+		}
 
 		// Clear password
-		l.passwordBuf = ""
+		l.securePassword.Clear()
 
-		// If lockout was activated, update the UI
 		if lockoutActive {
-			// Make sure the lockout message is displayed
 			Info("Lockout activated until: %v", l.lockoutManager.GetLockoutUntil())
-			l.drawLockoutMessage()
 		}
 
-		// Shake the password field to indicate failure
-		go l.shakePasswordField()
+		// Shake the password field to indicate failure, the lockout
+		// countdown replaces it when it's done
+		l.shakePasswordField()
+	}
+}
+
+// unlock ends the lock session on behalf of username, "" for the owner. The
+// event loop exits once it sees the session is no longer locked.
+func (l *X11Locker) unlock(username string) {
+	l.isLocked = false
+	l.lockoutManager.ResetLockout()
+	l.securePassword.Clear()
+	l.statusMessage = ""
+	l.unlockedBy = username
+	l.helper.StopFingerprint()
+	l.helper.StopUnlockDeviceWatch()
+	l.helper.AuditLockEnd(username)
+	l.helper.NotifyAwaySummary()
+
+	// Unpause media if enabled
+	if err := l.helper.UnpauseMediaIfEnabled(); err != nil {
+		Warn("Failed to unpause media: %v", err)
 	}
 }
 
 // shakePasswordField animates the password field to indicate failed authentication
 func (l *X11Locker) shakePasswordField() {
 	Debug("Starting password field shake animation")
-	// Number of shake iterations
-	iterations := 5
-	// Shake distance in pixels
-	distance := int16(10)
-	// Time between movements in milliseconds
-	delay := 50 * time.Millisecond
-
-	// Get current position info for dots
-	centerX := int16(l.width / 2)
-	dotSpacing := int16(20)
-	dotRadius := uint16(6)
-	totalDots := len(l.passwordDots)
-
-	Debug("Shake animation parameters: centerX=%d, totalDots=%d, dotSpacing=%d", centerX, totalDots, dotSpacing)
-
-	// Calculate starting X position to center the dots
-	startX := centerX - (int16(totalDots) * dotSpacing / 2)
-
-	// Perform the shake animation
-	for i := 0; i < iterations; i++ {
-		Debug("Shake iteration %d of %d", i+1, iterations)
-		// Move right
-		for j, dotWid := range l.dotWindows {
-			x := startX + int16(j)*dotSpacing - int16(dotRadius) + distance
-			Debug("Moving dot %d right to x=%d", j, x)
-			xproto.ConfigureWindow(l.conn, dotWid, xproto.ConfigWindowX, []uint32{uint32(x)})
-		}
-		time.Sleep(delay)
-
-		// Move left
-		for j, dotWid := range l.dotWindows {
-			x := startX + int16(j)*dotSpacing - int16(dotRadius) - distance
-			Debug("Moving dot %d left to x=%d", j, x)
-			xproto.ConfigureWindow(l.conn, dotWid, xproto.ConfigWindowX, []uint32{uint32(x)})
-		}
-		time.Sleep(delay)
-
-		// Move back to center
-		for j, dotWid := range l.dotWindows {
-			x := startX + int16(j)*dotSpacing - int16(dotRadius)
-			Debug("Moving dot %d back to center x=%d", j, x)
-			xproto.ConfigureWindow(l.conn, dotWid, xproto.ConfigWindowX, []uint32{uint32(x)})
-		}
-		time.Sleep(delay)
+	l.failed = true
+	for _, offset := range shakeOffsets() {
+		l.shakeOffset = offset
+		l.drawUI()
+		time.Sleep(shakeDelay)
 	}
+	l.shakeOffset = 0
+	l.failed = false
 
 	// Clear password dots after animation
 	Debug("Shake animation complete, clearing password dots")
 	l.passwordDots = make([]bool, 0)
-	l.clearPasswordDots()
 }
 
-// drawUI draws the user interface
-func (l *X11Locker) drawUI() {
-	Debug("Drawing UI")
-	// Check if we're in lockout mode using the lockout manager
+// uiState collects what the lock screen shows
+func (l *X11Locker) uiState() UIState {
+	state := UIState{
+		Dots:        len(l.passwordDots),
+		ShakeOffset: l.shakeOffset,
+		Label:       l.switchUser.Label(),
+		Status:      l.statusMessage,
+		Hint:        l.helper.UnlockDeviceMessage(),
+		Verifying:   l.verifying,
+		Failed:      l.failed,
+		Now:         time.Now(),
+		LockedSince: l.helper.LockedAt(),
+	}
 	if l.lockoutManager.IsLockedOut() {
-		Debug("In lockout mode, drawing lockout message")
-		// Draw lockout message
-		l.drawLockoutMessage()
+		state.Lockout = true
+		state.LockoutTime = l.lockoutManager.FormatRemainingTime()
+		state.LockoutReason = l.lockoutManager.LockoutReason()
 	}
+	return state
+}
 
-	// Draw the password UI
-	Debug("Drawing password UI")
-	l.drawPasswordUI()
+// drawUI renders the user interface and shows it on every monitor
+func (l *X11Locker) drawUI() {
+	state := l.uiState()
+	l.lockoutShown = state.Lockout
+	for i := range l.outputs {
+		l.presentOutput(&l.outputs[i], state)
+	}
 }
 
-// drawLockoutMessage displays a message indicating the system is locked out
-func (l *X11Locker) drawLockoutMessage() {
-	Info("Drawing lockout message")
-	// Get the list of monitors
-	monitors, err := l.detectMonitors()
-	if err != nil {
-		Error("Failed to detect monitors: %v", err)
-		return
+// presentOutput renders state for one monitor. Each part of the UI gets a
+// window covering only the area the renderer drew it on, so the media stays
+// visible around and between them.
+func (l *X11Locker) presentOutput(output *x11Output, state UIState) {
+	monitor := output.monitor
+	if output.frame == nil {
+		output.frame = image.NewRGBA(image.Rect(0, 0, monitor.Width, monitor.Height))
 	}
 
-	// If we don't already have message windows, create them
-	if len(l.messageWindows) == 0 {
-		Debug("Creating new message windows for lockout")
-		// Create a window for each monitor
-		for _, monitor := range monitors {
-			wid, err := xproto.NewWindowId(l.conn)
-			if err != nil {
-				Error("Failed to create message window ID: %v", err)
-				continue
-			}
-			l.messageWindows = append(l.messageWindows, wid)
-			Debug("Allocated message window ID: %d", wid)
-
-			// Create a window for this monitor with a semi-transparent background
-			err = xproto.CreateWindowChecked(
-				l.conn,
-				l.screen.RootDepth,
-				wid,
-				l.screen.Root,
-				int16(monitor.X), int16(monitor.Y),
-				uint16(monitor.Width), uint16(monitor.Height),
-				0, // No border
-				xproto.WindowClassInputOutput,
-				l.screen.RootVisual,
-				xproto.CwOverrideRedirect|xproto.CwBackingStore|xproto.CwEventMask,
-				[]uint32{
-					1, // Override redirect
-					1, // Backing store
-					xproto.EventMaskExposure | xproto.EventMaskVisibilityChange,
-				},
-			).Check()
+	regions := l.renderer.RenderRegions(output.frame, state, monitor.Scale)
+	for len(output.windows) < len(regions) {
+		window, err := l.createUIWindow()
+		if err != nil {
+			Error("Failed to create UI window: %v", err)
+			regions = regions[:len(output.windows)]
+			break
+		}
+		output.windows = append(output.windows, window)
+	}
 
-			if err != nil {
-				Error("Failed to create message window: %v", err)
-				continue
-			}
+	for i, window := range output.windows {
+		if i >= len(regions) {
+			xproto.UnmapWindow(l.conn, window)
+			continue
+		}
 
-			// Set window properties to keep it on top and make it fullscreen
-			// First, set the window type to be a dialog
-			atomName := "_NET_WM_WINDOW_TYPE"
-			Debug("Interning atom: %s", atomName)
-			windowTypeAtom, err := xproto.InternAtom(l.conn, false, uint16(len(atomName)), atomName).Reply()
-			if err == nil && windowTypeAtom != nil {
-				atomName = "_NET_WM_WINDOW_TYPE_DIALOG"
-				Debug("Interning atom: %s", atomName)
-				dialogAtom, err := xproto.InternAtom(l.conn, false, uint16(len(atomName)), atomName).Reply()
-				if err == nil && dialogAtom != nil {
-					Debug("Setting window type to dialog")
-					xproto.ChangeProperty(l.conn, xproto.PropModeReplace, wid,
-						windowTypeAtom.Atom, xproto.AtomAtom, 32, 1, []byte{
-							byte(dialogAtom.Atom),
-							byte(dialogAtom.Atom >> 8),
-							byte(dialogAtom.Atom >> 16),
-							byte(dialogAtom.Atom >> 24),
-						})
-				}
-			}
+		area := regions[i]
+		xproto.ConfigureWindow(l.conn, window,
+			xproto.ConfigWindowX|xproto.ConfigWindowY|xproto.ConfigWindowWidth|xproto.ConfigWindowHeight|xproto.ConfigWindowStackMode,
+			[]uint32{
+				uint32(monitor.X + area.Min.X), uint32(monitor.Y + area.Min.Y),
+				uint32(area.Dx()), uint32(area.Dy()),
+				xproto.StackModeAbove,
+			})
+		xproto.MapWindow(l.conn, window)
+		l.putImage(window, output.frame, area)
+	}
+}
 
-			// Set the window state to be always on top
-			atomName = "_NET_WM_STATE"
-			Debug("Interning atom: %s", atomName)
-			stateAtom, err := xproto.InternAtom(l.conn, false, uint16(len(atomName)), atomName).Reply()
-			if err == nil && stateAtom != nil {
-				atomName = "_NET_WM_STATE_ABOVE"
-				Debug("Interning atom: %s", atomName)
-				aboveAtom, err := xproto.InternAtom(l.conn, false, uint16(len(atomName)), atomName).Reply()
-				if err == nil && aboveAtom != nil {
-					Debug("Setting window state to always on top")
-					xproto.ChangeProperty(l.conn, xproto.PropModeReplace, wid,
-						stateAtom.Atom, xproto.AtomAtom, 32, 1, []byte{
-							byte(aboveAtom.Atom),
-							byte(aboveAtom.Atom >> 8),
-							byte(aboveAtom.Atom >> 16),
-							byte(aboveAtom.Atom >> 24),
-						})
-				}
-			}
-		}
+// createUIWindow creates an override-redirect window for the rendered UI
+func (l *X11Locker) createUIWindow() (xproto.Window, error) {
+	window, err := xproto.NewWindowId(l.conn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate window ID: %v", err)
 	}
 
-	// Get remaining lockout time using the lockout manager
-	timeString := l.lockoutManager.FormatRemainingTime()
-	Debug("Lockout remaining time: %s", timeString)
+	mask := uint32(xproto.CwBackPixel | xproto.CwOverrideRedirect | xproto.CwEventMask)
+	values := []uint32{
+		l.screen.BlackPixel,
+		1, // Override redirect
+		xproto.EventMaskExposure,
+	}
+	if l.uiColormap != 0 {
+		// Start out transparent. The border pixel and colormap must be
+		// given because the visual differs from the root window's.
+		mask = xproto.CwBackPixel | xproto.CwBorderPixel | xproto.CwOverrideRedirect |
+			xproto.CwEventMask | xproto.CwColormap
+		values = []uint32{
+			0, // Transparent background
+			0, // Border pixel
+			1, // Override redirect
+			xproto.EventMaskExposure,
+			uint32(l.uiColormap),
+		}
+	}
 
-	// Parse the embedded font
-	ttf, err := opentype.Parse(x11FontBytes)
+	err = xproto.CreateWindowChecked(
+		l.conn,
+		l.uiDepth,
+		window,
+		l.screen.Root,
+		0, 0, 1, 1,
+		0, // No border
+		xproto.WindowClassInputOutput,
+		l.uiVisual,
+		mask,
+		values,
+	).Check()
 	if err != nil {
-		Error("Failed to parse embedded font: %v", err)
+		return 0, fmt.Errorf("failed to create window: %v", err)
+	}
+
+	return window, nil
+}
+
+// setupUIVisual picks the visual the UI windows are created with. With a
+// compositor running, a 32-bit ARGB visual lets anti-aliased edges blend
+// with the media behind them. Without one nothing would blend the alpha, so
+// the windows keep the root visual and the UI is drawn over black.
+func (l *X11Locker) setupUIVisual() {
+	l.uiDepth = l.screen.RootDepth
+	l.uiVisual = l.screen.RootVisual
+	l.uiColormap = 0
+	l.uiGC = l.gc
+
+	if !l.compositorRunning() {
+		Info("No compositor running, drawing the UI over black")
+		return
+	}
+	visual, ok := l.argbVisual()
+	if !ok {
+		Warn("Compositor running but the screen has no 32-bit visual, drawing the UI over black")
 		return
 	}
 
-	// Create a large font face for the title
-	titleFace, err := opentype.NewFace(ttf, &opentype.FaceOptions{
-		Size:    96,
-		DPI:     72,
-		Hinting: font.HintingFull,
-	})
+	// Windows with a visual other than their parent's need their own
+	// colormap, and a GC only draws on drawables of the depth it was
+	// created for. The server frees both when the connection closes.
+	colormap, err := xproto.NewColormapId(l.conn)
 	if err != nil {
-		Error("Failed to create title font face: %v", err)
+		Warn("Failed to allocate colormap ID: %v", err)
 		return
 	}
-	defer titleFace.Close()
-
-	// Create a medium font face for the subtitle
-	subtitleFace, err := opentype.NewFace(ttf, &opentype.FaceOptions{
-		Size:    36,
-		DPI:     72,
-		Hinting: font.HintingFull,
-	})
+	err = xproto.CreateColormapChecked(l.conn, xproto.ColormapAllocNone, colormap, l.screen.Root, visual).Check()
 	if err != nil {
-		Error("Failed to create subtitle font face: %v", err)
+		Warn("Failed to create colormap for the ARGB visual: %v", err)
 		return
 	}
-	defer subtitleFace.Close()
-
-	// Draw on each monitor
-	for i, monitor := range monitors {
-		if i >= len(l.messageWindows) {
-			Error("No message window for monitor %d", i)
-			continue
-		}
-
-		messageWindow := l.messageWindows[i]
-		Debug("Drawing on monitor %d: x=%d, y=%d, width=%d, height=%d", i, monitor.X, monitor.Y, monitor.Width, monitor.Height)
-
-		// Show the window
-		Debug("Mapping lockout message window")
-		xproto.MapWindow(l.conn, messageWindow)
-
-		// Create an image to render the text
-		img := image.NewRGBA(image.Rect(0, 0, monitor.Width, monitor.Height))
-
-		// Draw "INTRUDER ALERT" at the center with large font
-		title := "INTRUDER ALERT"
-		titleBounds := font.MeasureString(titleFace, title)
-		titleX := (monitor.Width - titleBounds.Round()) / 2
-		titleY := monitor.Height/2 - 100
-
-		d := &font.Drawer{
-			Dst:  img,
-			Src:  image.White,
-			Face: titleFace,
-			Dot:  fixed.P(titleX, titleY),
-		}
-		d.DrawString(title)
-
-		// Draw "Security cooldown engaged" below with medium font
-		subtitle := "Security cooldown engaged"
-		subtitleBounds := font.MeasureString(subtitleFace, subtitle)
-		subtitleX := (monitor.Width - subtitleBounds.Round()) / 2
-		subtitleY := monitor.Height / 2
-
-		d.Face = subtitleFace
-		d.Dot = fixed.P(subtitleX, subtitleY)
-		d.DrawString(subtitle)
-
-		// Draw the timer below with large font
-		timerBounds := font.MeasureString(titleFace, timeString)
-		timerX := (monitor.Width - timerBounds.Round()) / 2
-		timerY := monitor.Height/2 + 100
-
-		d.Face = titleFace
-		d.Dot = fixed.P(timerX, timerY)
-		d.DrawString(timeString)
-
-		// Create a pixmap to hold the rendered text
-		pixmap, err := xproto.NewPixmapId(l.conn)
-		if err != nil {
-			Error("Failed to create pixmap: %v", err)
-			continue
-		}
-
-		err = xproto.CreatePixmapChecked(
-			l.conn,
-			l.screen.RootDepth,
-			pixmap,
-			xproto.Drawable(messageWindow),
-			uint16(monitor.Width), uint16(monitor.Height),
-		).Check()
-		if err != nil {
-			Error("Failed to create pixmap: %v", err)
-			continue
-		}
-
-		// Create a graphics context for the pixmap
-		gc, err := xproto.NewGcontextId(l.conn)
-		if err != nil {
-			Error("Failed to create graphics context: %v", err)
-			continue
-		}
-
-		err = xproto.CreateGCChecked(
-			l.conn,
-			gc,
-			xproto.Drawable(pixmap),
-			xproto.GcForeground|xproto.GcBackground,
-			[]uint32{l.screen.WhitePixel, l.screen.BlackPixel},
-		).Check()
-		if err != nil {
-			Error("Failed to create graphics context: %v", err)
-			continue
-		}
-
-		// Copy the rendered image to the pixmap
-		for y := 0; y < monitor.Height; y++ {
-			for x := 0; x < monitor.Width; x++ {
-				_, _, _, a := img.At(x, y).RGBA()
-				if a > 0 {
-					// Only draw non-transparent pixels
-					xproto.PolyPoint(
-						l.conn,
-						xproto.CoordModeOrigin,
-						xproto.Drawable(pixmap),
-						gc,
-						[]xproto.Point{{X: int16(x), Y: int16(y)}},
-					)
-				}
-			}
-		}
-
-		// Copy the pixmap to the window
-		xproto.CopyArea(
-			l.conn,
-			xproto.Drawable(pixmap),
-			xproto.Drawable(messageWindow),
-			l.gc,
-			0, 0, 0, 0,
-			uint16(monitor.Width), uint16(monitor.Height),
-		)
-
-		// Clean up
-		xproto.FreePixmap(l.conn, pixmap)
-		xproto.FreeGC(l.conn, gc)
-
-		// Force window to be visible and on top
-		Debug("Raising message window to top")
-		xproto.ConfigureWindow(
-			l.conn,
-			messageWindow,
-			xproto.ConfigWindowStackMode,
-			[]uint32{xproto.StackModeAbove},
-		)
-	}
-
-	// Start a timer to update the countdown if not already running
-	if !l.lockoutManager.IsTimerRunning() {
-		Debug("Starting timer for lockout countdown")
-		l.lockoutManager.SetTimerRunning(true)
-
-		go func() {
-			Info("Starting lockout countdown timer")
-			ticker := time.NewTicker(1 * time.Second)
-			defer ticker.Stop()
-
-			for l.lockoutManager.IsLockedOut() && l.isLocked {
-				select {
-				case <-ticker.C:
-					Debug("Updating lockout timer display")
-					// Only update the timer text, not recreate the whole window
-					l.drawLockoutMessage()
-				}
-			}
 
-			l.lockoutManager.SetTimerRunning(false)
-			Info("Lockout countdown timer stopped")
+	pixmap, err := xproto.NewPixmapId(l.conn)
+	if err != nil {
+		Warn("Failed to allocate pixmap ID: %v", err)
+		return
+	}
+	err = xproto.CreatePixmapChecked(l.conn, 32, pixmap, xproto.Drawable(l.screen.Root), 1, 1).Check()
+	if err != nil {
+		Warn("Failed to create 32-bit pixmap: %v", err)
+		return
+	}
+	defer xproto.FreePixmap(l.conn, pixmap)
 
-			// When lockout is over, hide the windows if we're still locked
-			if l.isLocked {
-				Debug("Lockout ended, hiding message windows")
-				for _, window := range l.messageWindows {
-					xproto.UnmapWindow(l.conn, window)
-				}
-			}
-		}()
+	gc, err := xproto.NewGcontextId(l.conn)
+	if err != nil {
+		Warn("Failed to allocate graphics context ID: %v", err)
+		return
+	}
+	err = xproto.CreateGCChecked(l.conn, gc, xproto.Drawable(pixmap), 0, nil).Check()
+	if err != nil {
+		Warn("Failed to create 32-bit graphics context: %v", err)
+		return
 	}
-}
 
-// drawPasswordUI draws the password entry UI
-func (l *X11Locker) drawPasswordUI() {
-	Debug("Drawing password entry UI")
-	// Draw only the password dots
-	l.drawPasswordDots()
+	Info("Compositor running, using ARGB visual 0x%x for the UI", visual)
+	l.uiDepth = 32
+	l.uiVisual = visual
+	l.uiColormap = colormap
+	l.uiGC = gc
 }
 
-// drawPasswordDots draws dots representing password characters
-func (l *X11Locker) drawPasswordDots() {
-	Debug("Drawing password dots: %d dots", len(l.passwordDots))
-	// Calculate dot positions
-	centerX := int16(l.width / 2)
-	centerY := int16(l.height/2) + 70 // Below the center
-	dotRadius := uint16(6)
-	dotSpacing := int16(20)
-	maxDots := l.maxDots
-
-	// Calculate starting X position to center all potential dots
-	startX := centerX - (int16(maxDots) * dotSpacing / 2)
-	Debug("Dot layout: centerX=%d, centerY=%d, startX=%d, spacing=%d", centerX, centerY, startX, dotSpacing)
-
-	// Make sure we have enough dot windows pre-created
-	if len(l.dotWindows) < maxDots {
-		Debug("Not enough dot windows, creating %d windows", maxDots)
-		// We need to create more dot windows
-		l.clearPasswordDots() // Clear existing ones first
-
-		// Create all potential dot windows
-		for i := 0; i < maxDots; i++ {
-			x := startX + int16(i)*dotSpacing - int16(dotRadius)
-			y := centerY - int16(dotRadius)
-			Debug("Creating dot window %d at position x=%d, y=%d", i, x, y)
-
-			// Create a new window ID for this dot
-			dotWid, err := xproto.NewWindowId(l.conn)
-			if err != nil {
-				Error("Failed to create dot window: %v", err)
-				continue
-			}
-
-			// Store the dot window ID
-			l.dotWindows = append(l.dotWindows, dotWid)
-
-			// Create a small window with white background for the dot
-			mask := uint32(
-				xproto.CwBackPixel |
-					xproto.CwBorderPixel |
-					xproto.CwOverrideRedirect)
-
-			values := []uint32{
-				l.screen.WhitePixel, // White background for the dot
-				0x00000000,          // Black border
-				1,                   // override redirect
-			}
-
-			err = xproto.CreateWindowChecked(
-				l.conn,
-				l.screen.RootDepth,
-				dotWid,
-				l.screen.Root,
-				x, y,
-				dotRadius*2, dotRadius*2,
-				0, // No border width
-				xproto.WindowClassInputOutput,
-				l.screen.RootVisual,
-				mask,
-				values,
-			).Check()
-
-			if err != nil {
-				Error("Failed to create dot window %d: %v", i, err)
-				continue
-			}
-			Debug("Dot window %d created successfully", i)
-
-			// Try to make the window stay on top
-			atomName := "_NET_WM_STATE"
-			atom, err := xproto.InternAtom(l.conn, false, uint16(len(atomName)), atomName).Reply()
-			if err == nil && atom != nil {
-				atomName = "_NET_WM_STATE_ABOVE"
-				aboveAtom, err := xproto.InternAtom(l.conn, false, uint16(len(atomName)), atomName).Reply()
-				if err == nil && aboveAtom != nil {
-					Debug("Setting dot window %d to stay on top", i)
-					xproto.ChangeProperty(l.conn, xproto.PropModeReplace, dotWid,
-						atom.Atom, xproto.AtomAtom, 32, 1, []byte{
-							byte(aboveAtom.Atom),
-							byte(aboveAtom.Atom >> 8),
-							byte(aboveAtom.Atom >> 16),
-							byte(aboveAtom.Atom >> 24),
-						})
-				}
-			}
-		}
+// compositorRunning reports whether a compositing manager owns the
+// _NET_WM_CM_Sn selection of the screen
+func (l *X11Locker) compositorRunning() bool {
+	name := fmt.Sprintf("_NET_WM_CM_S%d", l.conn.DefaultScreen)
+	atom, err := xproto.InternAtom(l.conn, true, uint16(len(name)), name).Reply()
+	if err != nil || atom.Atom == xproto.AtomNone {
+		return false
 	}
+	owner, err := xproto.GetSelectionOwner(l.conn, atom.Atom).Reply()
+	return err == nil && owner.Owner != xproto.WindowNone
+}
 
-	// Now just show/hide the appropriate windows rather than recreating them
-	currentDots := len(l.passwordDots)
-	Debug("Showing %d of %d dot windows", currentDots, len(l.dotWindows))
-
-	// Show/hide windows based on current password length
-	for i, dotWid := range l.dotWindows {
-		if i < currentDots {
-			// This dot should be visible
-			Debug("Mapping dot window %d", i)
-			xproto.MapWindow(l.conn, dotWid)
-
-			// Make sure it's raised to the top
-			Debug("Raising dot window %d to top", i)
-			xproto.ConfigureWindow(
-				l.conn,
-				dotWid,
-				xproto.ConfigWindowStackMode,
-				[]uint32{xproto.StackModeAbove},
-			)
-		} else {
-			// This dot should be hidden
-			Debug("Unmapping dot window %d", i)
-			xproto.UnmapWindow(l.conn, dotWid)
+// argbVisual finds a 32-bit TrueColor visual of the screen
+func (l *X11Locker) argbVisual() (xproto.Visualid, bool) {
+	for _, depth := range l.screen.AllowedDepths {
+		if depth.Depth != 32 {
+			continue
+		}
+		for _, visual := range depth.Visuals {
+			if visual.Class == xproto.VisualClassTrueColor {
+				return visual.VisualId, true
+			}
 		}
 	}
+	return 0, false
 }
 
-// clearPasswordDots removes any password dot windows
-func (l *X11Locker) clearPasswordDots() {
-	Info("Clearing all password dot windows: %d windows", len(l.dotWindows))
-	for i, dotWid := range l.dotWindows {
-		// Destroy the dot window
-		Debug("Destroying dot window %d (ID: %d)", i, dotWid)
-		xproto.DestroyWindow(l.conn, dotWid)
+// putImage uploads the area of img to the window. The image goes in strips
+// so no request exceeds the server's maximum request length.
+func (l *X11Locker) putImage(window xproto.Window, img *image.RGBA, area image.Rectangle) {
+	stride := area.Dx() * 4
+
+	// The PutImage header takes 24 bytes of the request
+	maxBytes := int(xproto.Setup(l.conn).MaximumRequestLength)*4 - 24
+	rows := max(maxBytes/stride, 1)
+
+	// The pixels are premultiplied, which is what the compositor blends
+	// for an ARGB window. With the root visual the alpha is dropped and
+	// they come out composited over black.
+	data := make([]byte, stride*min(rows, area.Dy()))
+	for y := area.Min.Y; y < area.Max.Y; y += rows {
+		strip := image.Rect(area.Min.X, y, area.Max.X, min(y+rows, area.Max.Y))
+		copyToARGB(data, stride, img, strip)
+		xproto.PutImage(l.conn, xproto.ImageFormatZPixmap, xproto.Drawable(window), l.uiGC,
+			uint16(strip.Dx()), uint16(strip.Dy()), 0, int16(y-area.Min.Y), 0, l.uiDepth,
+			data[:stride*strip.Dy()])
 	}
-
-	// Clear the list
-	l.dotWindows = []xproto.Window{}
-	Debug("All dot windows cleared")
 }
 
 // cleanup releases resources when unlocking
 func (l *X11Locker) cleanup() {
 	Info("Cleaning up resources")
-	// Clear password dots
-	Debug("Clearing password dots")
-	l.clearPasswordDots()
-
-	// Clear message windows if they exist
-	if len(l.messageWindows) > 0 {
-		Debug("Destroying message windows")
-		for _, window := range l.messageWindows {
+	l.helper.StopSessionWatchers()
+	l.helper.StopFingerprint()
+	l.helper.StopUnlockDeviceWatch()
+
+	// Destroy the UI windows
+	Debug("Destroying UI windows")
+	for _, output := range l.outputs {
+		for _, window := range output.windows {
 			xproto.DestroyWindow(l.conn, window)
 		}
-		l.messageWindows = []xproto.Window{}
 	}
+	l.outputs = nil
 
 	// Stop media player
 	Debug("Stopping media player")
 	l.mediaPlayer.Stop()
 
+	// Wipe and release the password buffer
+	l.securePassword.Destroy()
+
 	// Ungrab keyboard and pointer
 	Debug("Ungrabbing keyboard")
 	xproto.UngrabKeyboard(l.conn, xproto.TimeCurrentTime)
 	Debug("Ungrabbing pointer")
 	xproto.UngrabPointer(l.conn, xproto.TimeCurrentTime)
 
+	// Stop watching the root window and give back what was pushed down
+	xproto.ChangeWindowAttributes(l.conn, l.screen.Root, xproto.CwEventMask, []uint32{0})
+	l.restoreLoweredWindows()
+
 	// Destroy window
 	Debug("Destroying main window")
 	xproto.DestroyWindow(l.conn, l.window)
 
-	// Close X connection
+	// Close X connections
 	Debug("Closing X connection")
-	l.conn.Close()
-
-	// Run post-lock command if configured
-	if err := l.helper.RunPostLockCommand(); err != nil {
-		Warn("Post-lock command error: %v", err)
+	if l.xinput != nil {
+		l.xinput.Close()
+		l.xinput = nil
 	}
+	l.conn.Close()
 
 	Info("Cleanup completed")
 }
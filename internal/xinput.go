@@ -0,0 +1,547 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// XInput 2 requests, events and devices
+const (
+	xiSelectEvents     = 46
+	xiQueryVersion     = 47
+	xiQueryDevice      = 48
+	xiHierarchyChanged = 11
+	xiRawKeyPress      = 13
+	xiRawButtonPress   = 15
+	xiAllDevices       = 0
+)
+
+// xiRecentInput is how many raw events are kept to match core events against
+const xiRecentInput = 64
+
+// xiRawInput is a key or button press seen as an XI2 raw event
+type xiRawInput struct {
+	evtype   uint16 // xiRawKeyPress or xiRawButtonPress
+	time     uint32
+	detail   uint32 // Keycode or button
+	sourceID uint16 // Slave device the input came from
+}
+
+// xiInput tells which device input came from. Core events don't say, so
+// input faked through XTest, as xdotool does, looks like typing. XI2 raw
+// events name the slave device, and XTest input comes from the XTest slave
+// devices of the server.
+//
+// The raw events are read on a connection of their own. xgb knows neither
+// XInput nor the GenericEvents XI2 sends, which are longer than the 32 bytes
+// it reads, so xStream takes them out of the stream before xgb sees it.
+type xiInput struct {
+	conn   *xgb.Conn
+	opcode byte
+
+	mu     sync.Mutex
+	xtest  map[uint16]bool // XTest slave devices
+	stale  bool            // Whether devices changed since xtest was filled
+	recent []xiRawInput    // Latest key and button presses, oldest first
+}
+
+// newXIInput connects to the X server and selects raw key and button
+// presses of all devices on root
+func newXIInput(root xproto.Window) (*xiInput, error) {
+	x := &xiInput{stale: true}
+
+	var err error
+	x.conn, err = newXConn(&xStream{onEvent: x.handleEvent})
+	if err != nil {
+		return nil, err
+	}
+	go x.drainEvents()
+
+	if err := x.init(root); err != nil {
+		x.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// init sets up XI2 on the connection
+func (x *xiInput) init(root xproto.Window) error {
+	const name = "XInputExtension"
+	ext, err := xproto.QueryExtension(x.conn, uint16(len(name)), name).Reply()
+	if err != nil {
+		return fmt.Errorf("failed to query XInput extension: %v", err)
+	}
+	if !ext.Present {
+		return fmt.Errorf("XInput extension not available")
+	}
+	x.mu.Lock()
+	x.opcode = ext.MajorOpcode
+	x.mu.Unlock()
+
+	// Raw events are only delivered during the lock's grab from XI 2.1 on
+	buf := make([]byte, 8)
+	buf[0], buf[1] = x.opcode, xiQueryVersion
+	xgb.Put16(buf[2:], 2)
+	xgb.Put16(buf[4:], 2)
+	xgb.Put16(buf[6:], 2)
+	reply, err := x.request(buf, true)
+	if err != nil {
+		return fmt.Errorf("failed to query XInput version: %v", err)
+	}
+	major, minor := xgb.Get16(reply[8:]), xgb.Get16(reply[10:])
+	if major < 2 || (major == 2 && minor < 1) {
+		return fmt.Errorf("XInput %d.%d is too old, 2.1 is needed", major, minor)
+	}
+
+	buf = make([]byte, 20)
+	buf[0], buf[1] = x.opcode, xiSelectEvents
+	xgb.Put16(buf[2:], 5)
+	xgb.Put32(buf[4:], uint32(root))
+	xgb.Put16(buf[8:], 1) // One mask
+	xgb.Put16(buf[12:], xiAllDevices)
+	xgb.Put16(buf[14:], 1) // Mask length in 4-byte units
+	xgb.Put32(buf[16:], 1<<xiHierarchyChanged|1<<xiRawKeyPress|1<<xiRawButtonPress)
+	if _, err := x.request(buf, false); err != nil {
+		return fmt.Errorf("failed to select XInput events: %v", err)
+	}
+
+	return x.updateDevices()
+}
+
+// request sends a request and waits for its reply, or only for errors
+func (x *xiInput) request(buf []byte, reply bool) ([]byte, error) {
+	cookie := x.conn.NewCookie(true, reply)
+	x.conn.NewRequest(buf, cookie)
+	if reply {
+		return cookie.Reply()
+	}
+	return nil, cookie.Check()
+}
+
+// drainEvents throws away the core events of the connection, which only
+// selects XI2 ones, so a stray event can't stall replies
+func (x *xiInput) drainEvents() {
+	for {
+		ev, err := x.conn.WaitForEvent()
+		if ev == nil && err == nil {
+			return
+		}
+		if err != nil {
+			Debug("XInput connection error: %v", err)
+		}
+	}
+}
+
+// updateDevices looks up which slave devices belong to XTest
+func (x *xiInput) updateDevices() error {
+	buf := make([]byte, 8)
+	buf[0], buf[1] = x.opcode, xiQueryDevice
+	xgb.Put16(buf[2:], 2)
+	xgb.Put16(buf[4:], xiAllDevices)
+	reply, err := x.request(buf, true)
+	if err != nil {
+		return fmt.Errorf("failed to query input devices: %v", err)
+	}
+
+	xtest, err := parseXTestDevices(reply)
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	x.xtest = xtest
+	x.stale = false
+	x.mu.Unlock()
+	return nil
+}
+
+// parseXTestDevices returns the XTest devices of an XIQueryDevice reply
+func parseXTestDevices(reply []byte) (map[uint16]bool, error) {
+	if len(reply) < 32 {
+		return nil, fmt.Errorf("short XIQueryDevice reply")
+	}
+	xtest := make(map[uint16]bool)
+	count := int(xgb.Get16(reply[8:]))
+
+	b := reply[32:]
+	for i := 0; i < count; i++ {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("truncated XIQueryDevice reply")
+		}
+		id := xgb.Get16(b[0:])
+		classes := int(xgb.Get16(b[6:]))
+		nameLen := int(xgb.Get16(b[8:]))
+		if len(b) < 12+xgb.Pad(nameLen) {
+			return nil, fmt.Errorf("truncated XIQueryDevice reply")
+		}
+
+		// The server names them "<master> XTEST keyboard" and "<master> XTEST pointer"
+		name := string(b[12 : 12+nameLen])
+		if strings.Contains(name, " XTEST ") {
+			xtest[id] = true
+		}
+
+		b = b[12+xgb.Pad(nameLen):]
+		for j := 0; j < classes; j++ {
+			if len(b) < 4 {
+				return nil, fmt.Errorf("truncated XIQueryDevice reply")
+			}
+			size := int(xgb.Get16(b[2:])) * 4
+			if size < 4 || len(b) < size {
+				return nil, fmt.Errorf("bad device class in XIQueryDevice reply")
+			}
+			b = b[size:]
+		}
+	}
+	return xtest, nil
+}
+
+// handleEvent records an XI2 event. It runs on xgb's reader, which must
+// not wait for replies, so changed devices are only looked up later.
+func (x *xiInput) handleEvent(buf []byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(buf) < 32 || buf[1] != x.opcode {
+		return
+	}
+
+	switch evtype := xgb.Get16(buf[8:]); evtype {
+	case xiHierarchyChanged:
+		x.stale = true
+	case xiRawKeyPress, xiRawButtonPress:
+		if len(x.recent) == xiRecentInput {
+			x.recent = x.recent[1:]
+		}
+		x.recent = append(x.recent, xiRawInput{
+			evtype:   evtype,
+			time:     xgb.Get32(buf[12:]),
+			detail:   xgb.Get32(buf[16:]),
+			sourceID: xgb.Get16(buf[20:]),
+		})
+	}
+}
+
+// Injected reports whether a core key press (evtype xiRawKeyPress) or button
+// press (xiRawButtonPress) came from an XTest device. The server queues the
+// raw event before the core one, so after a round trip its raw event has
+// been read. If that fails, input is let through rather than locking out
+// the keyboard.
+func (x *xiInput) Injected(evtype uint16, time xproto.Timestamp, detail uint32) bool {
+	if _, err := xproto.GetInputFocus(x.conn).Reply(); err != nil {
+		Error("Failed to sync XInput events: %v", err)
+		return false
+	}
+
+	// A new XTest device announced itself before its first input
+	x.mu.Lock()
+	stale := x.stale
+	x.mu.Unlock()
+	if stale {
+		if err := x.updateDevices(); err != nil {
+			Error("Failed to update XTest devices: %v", err)
+		}
+	}
+
+	return x.fromXTest(evtype, uint32(time), detail)
+}
+
+// fromXTest reports whether a recent raw event matching a core event came
+// from an XTest device
+func (x *xiInput) fromXTest(evtype uint16, time, detail uint32) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, input := range x.recent {
+		if input.evtype == evtype && input.time == time && input.detail == detail && x.xtest[input.sourceID] {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the connection
+func (x *xiInput) Close() {
+	x.conn.Close()
+}
+
+// newXConn connects to the X server of DISPLAY through stream
+func newXConn(stream *xStream) (*xgb.Conn, error) {
+	display := os.Getenv("DISPLAY")
+	netConn, host, number, err := dialX11(display)
+	if err != nil {
+		return nil, err
+	}
+	stream.Conn = netConn
+	stream.reader = bufio.NewReader(netConn)
+
+	var addr net.IP
+	if tcp, ok := netConn.RemoteAddr().(*net.TCPAddr); ok {
+		addr = tcp.IP
+	}
+	if name, data, err := readXauthority(host, number, addr); err == nil {
+		stream.setup = x11SetupRequest(name, data)
+	} else {
+		Debug("No X authority for %s: %v", display, err)
+	}
+
+	conn, err := xgb.NewConnNet(stream)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("failed to connect to X server: %v", err)
+	}
+	conn.DefaultScreen = displayScreen(display)
+	return conn, nil
+}
+
+// displayScreen returns the screen number of a display like ":0.1"
+func displayScreen(display string) int {
+	colon := strings.LastIndex(display, ":")
+	dot := strings.LastIndex(display, ".")
+	if dot < colon {
+		return 0
+	}
+	screen, err := strconv.Atoi(display[dot+1:])
+	if err != nil || screen < 0 {
+		return 0
+	}
+	return screen
+}
+
+// xStream sits between xgb and the X server. It sends the connection setup
+// with the authorization xgb can't find for a connection it didn't dial, and
+// takes out of what xgb reads the messages xgb can't tell apart:
+// GenericEvents, which it doesn't know, go to onEvent, and input events
+// another client sent with SendEvent go to onSynthetic. The server marks
+// those by setting the top bit of the event code, which xgb masks off.
+// Either callback may be nil to drop the events.
+type xStream struct {
+	net.Conn
+	reader      *bufio.Reader
+	setup       []byte // Setup request to send instead of xgb's, nil to keep it
+	onEvent     func(event []byte)
+	onSynthetic func(event []byte)
+
+	wroteSetup bool
+	readSetup  bool
+	pending    []byte // Read from the server, not yet passed to xgb
+}
+
+// Write sends what xgb writes, replacing its setup request
+func (s *xStream) Write(p []byte) (int, error) {
+	if !s.wroteSetup {
+		s.wroteSetup = true
+		if s.setup != nil {
+			if _, err := s.Conn.Write(s.setup); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}
+	}
+	return s.Conn.Write(p)
+}
+
+// Read passes on everything the server sends but GenericEvents
+func (s *xStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// next reads the next message from the server
+func (s *xStream) next() error {
+	if !s.readSetup {
+		// The setup reply has its length in 4-byte units at offset 6
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(s.reader, head); err != nil {
+			return err
+		}
+		msg := make([]byte, 8+int(xgb.Get16(head[6:]))*4)
+		copy(msg, head)
+		if _, err := io.ReadFull(s.reader, msg[8:]); err != nil {
+			return err
+		}
+		s.readSetup = true
+		s.pending = msg
+		return nil
+	}
+
+	head := make([]byte, 32)
+	if _, err := io.ReadFull(s.reader, head); err != nil {
+		return err
+	}
+	switch head[0] & 0x7f {
+	case 1, xproto.GeGeneric:
+		// Replies and GenericEvents have more in 4-byte units at offset 4
+		msg := make([]byte, 32+int(xgb.Get32(head[4:]))*4)
+		copy(msg, head)
+		if _, err := io.ReadFull(s.reader, msg[32:]); err != nil {
+			return err
+		}
+		if head[0]&0x7f == xproto.GeGeneric {
+			if s.onEvent != nil {
+				s.onEvent(msg)
+			}
+			return nil
+		}
+		s.pending = msg
+	case xproto.KeyPress, xproto.KeyRelease, xproto.ButtonPress, xproto.ButtonRelease, xproto.MotionNotify:
+		if head[0]&0x80 == 0 {
+			s.pending = head
+		} else if s.onSynthetic != nil {
+			s.onSynthetic(head)
+		}
+	default:
+		s.pending = head
+	}
+	return nil
+}
+
+// dialX11 connects to the X server of display like xgb does, returning the
+// host and display number its authorization is looked up by
+func dialX11(display string) (conn net.Conn, host, number string, err error) {
+	if display == "" {
+		return nil, "", "", errors.New("DISPLAY is not set")
+	}
+	colon := strings.LastIndex(display, ":")
+	if colon < 0 {
+		return nil, "", "", fmt.Errorf("bad display %q", display)
+	}
+
+	number = display[colon+1:]
+	if dot := strings.LastIndex(number, "."); dot >= 0 {
+		number = number[:dot]
+	}
+	if n, err := strconv.Atoi(number); err != nil || n < 0 {
+		return nil, "", "", fmt.Errorf("bad display %q", display)
+	}
+
+	var socket, protocol string
+	if display[0] == '/' {
+		socket = display[:colon]
+	} else if slash := strings.LastIndex(display[:colon], "/"); slash >= 0 {
+		protocol = display[:slash]
+		host = display[slash+1 : colon]
+	} else {
+		host = display[:colon]
+	}
+
+	n, _ := strconv.Atoi(number)
+	switch {
+	case socket != "":
+		conn, err = net.Dial("unix", socket+":"+number)
+	case host != "" && host != "unix":
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		conn, err = net.Dial(protocol, host+":"+strconv.Itoa(6000+n))
+	default:
+		host = ""
+		conn, err = net.Dial("unix", "/tmp/.X11-unix/X"+number)
+	}
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to connect to %s: %v", display, err)
+	}
+	return conn, host, number, nil
+}
+
+// readXauthority finds the authorization for a display in the Xauthority
+// file. Local and forwarded displays are looked up by host name, and
+// displays reached over TCP also by addr, the address of the server.
+func readXauthority(host, display string, addr net.IP) (string, []byte, error) {
+	// Xauthority address families, as in Xauth.h
+	const familyInternet = 0
+	const familyInternet6 = 6
+	const familyLocal = 256
+	const familyWild = 65535
+
+	// Like Xlib, displays on this machine are under its host name, also
+	// when reached over TCP as a forwarded display is
+	if host == "" || host == "localhost" || addr.IsLoopback() {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	path := os.Getenv("XAUTHORITY")
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil, err
+		}
+		path = homeDir + "/.Xauthority"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	field := func() ([]byte, error) {
+		var size uint16
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		_, err := io.ReadFull(r, data)
+		return data, err
+	}
+
+	for {
+		var family uint16
+		if err := binary.Read(r, binary.BigEndian, &family); err != nil {
+			return "", nil, fmt.Errorf("no authorization for display %s in %s", display, path)
+		}
+		var fields [4][]byte // Address, display, name and data
+		for i := range fields {
+			if fields[i], err = field(); err != nil {
+				return "", nil, fmt.Errorf("failed to read %s: %v", path, err)
+			}
+		}
+
+		var hostMatches bool
+		switch family {
+		case familyWild:
+			hostMatches = true
+		case familyLocal:
+			hostMatches = string(fields[0]) == host
+		case familyInternet:
+			hostMatches = addr.To4() != nil && net.IP(fields[0]).Equal(addr)
+		case familyInternet6:
+			hostMatches = len(fields[0]) == net.IPv6len && net.IP(fields[0]).Equal(addr)
+		}
+		displayMatches := len(fields[1]) == 0 || string(fields[1]) == display
+		if hostMatches && displayMatches {
+			return string(fields[2]), fields[3], nil
+		}
+	}
+}
+
+// x11SetupRequest builds the connection setup request xgb sends, with the
+// given authorization
+func x11SetupRequest(authName string, authData []byte) []byte {
+	buf := make([]byte, 12+xgb.Pad(len(authName))+xgb.Pad(len(authData)))
+	buf[0] = 'l' // Little endian, like xgb
+	xgb.Put16(buf[2:], 11)
+	xgb.Put16(buf[6:], uint16(len(authName)))
+	xgb.Put16(buf[8:], uint16(len(authData)))
+	copy(buf[12:], authName)
+	copy(buf[12+xgb.Pad(len(authName)):], authData)
+	return buf
+}
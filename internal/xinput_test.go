@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/xgb"
+)
+
+// xMessage builds a server message of 32 bytes plus extra 4-byte units,
+// with the unit count at offset 4 like replies and GenericEvents have
+func xMessage(code byte, extra int) []byte {
+	msg := make([]byte, 32+extra*4)
+	msg[0] = code
+	xgb.Put32(msg[4:], uint32(extra))
+	for i := 8; i < len(msg); i++ {
+		msg[i] = byte(i)
+	}
+	return msg
+}
+
+func TestXStreamFiltersEvents(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var events, synthetic [][]byte
+	setup := x11SetupRequest("MIT-MAGIC-COOKIE-1", bytes.Repeat([]byte{7}, 16))
+	stream := &xStream{
+		Conn:        client,
+		reader:      bufio.NewReader(client),
+		setup:       setup,
+		onEvent:     func(event []byte) { events = append(events, event) },
+		onSynthetic: func(event []byte) { synthetic = append(synthetic, event) },
+	}
+
+	setupReply := make([]byte, 8+2*4)
+	setupReply[0] = 1
+	xgb.Put16(setupReply[6:], 2)
+	generic := xMessage(35, 2)
+	generic[1] = 131
+	reply := xMessage(1, 1)
+	event := xMessage(xgbKeyPress, 0)
+	sent := xMessage(xgbKeyPress|0x80, 0)
+	sentExpose := xMessage(12|0x80, 0)
+
+	received := make(chan []byte, 1)
+	go func() {
+		got := make([]byte, len(setup))
+		io.ReadFull(server, got)
+		received <- got
+		for _, msg := range [][]byte{setupReply, generic, reply, sent, sentExpose, event} {
+			server.Write(msg)
+		}
+	}()
+
+	// xgb's setup request is replaced by the one with the authorization
+	if _, err := stream.Write([]byte("xgb setup without auth")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, setup) {
+		t.Errorf("server got setup %x, want %x", got, setup)
+	}
+
+	for _, want := range [][]byte{setupReply, reply, sentExpose, event} {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(stream, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("read %x, want %x", got, want)
+		}
+	}
+	if len(events) != 1 || !bytes.Equal(events[0], generic) {
+		t.Errorf("GenericEvents = %x, want %x", events, generic)
+	}
+	if len(synthetic) != 1 || !bytes.Equal(synthetic[0], sent) {
+		t.Errorf("synthetic input = %x, want %x", synthetic, sent)
+	}
+}
+
+// xgbKeyPress is the core KeyPress event code
+const xgbKeyPress = 2
+
+// xiDeviceInfo builds an XIDeviceInfo of an XIQueryDevice reply with
+// classes of the given sizes in 4-byte units
+func xiDeviceInfo(id uint16, name string, classes ...int) []byte {
+	info := make([]byte, 12+xgb.Pad(len(name)))
+	xgb.Put16(info[0:], id)
+	xgb.Put16(info[6:], uint16(len(classes)))
+	xgb.Put16(info[8:], uint16(len(name)))
+	copy(info[12:], name)
+	for _, size := range classes {
+		class := make([]byte, size*4)
+		xgb.Put16(class[2:], uint16(size))
+		info = append(info, class...)
+	}
+	return info
+}
+
+func TestParseXTestDevices(t *testing.T) {
+	devices := [][]byte{
+		xiDeviceInfo(2, "Virtual core pointer", 3, 6, 6),
+		xiDeviceInfo(3, "Virtual core keyboard", 2),
+		xiDeviceInfo(4, "Virtual core XTEST pointer", 3),
+		xiDeviceInfo(5, "Virtual core XTEST keyboard", 2),
+		xiDeviceInfo(10, "AT Translated Set 2 keyboard", 2),
+	}
+	reply := make([]byte, 32)
+	reply[0] = 1
+	xgb.Put16(reply[8:], uint16(len(devices)))
+	for _, device := range devices {
+		reply = append(reply, device...)
+	}
+
+	xtest, err := parseXTestDevices(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xtest) != 2 || !xtest[4] || !xtest[5] {
+		t.Errorf("XTest devices = %v, want 4 and 5", xtest)
+	}
+
+	if _, err := parseXTestDevices(reply[:len(reply)-4]); err == nil {
+		t.Error("truncated reply parsed")
+	}
+}
+
+// xiRawEvent builds an XI2 raw event as it arrives in a GenericEvent
+func xiRawEvent(opcode byte, evtype uint16, time, detail uint32, source uint16) []byte {
+	event := make([]byte, 32)
+	event[0] = 35
+	event[1] = opcode
+	xgb.Put16(event[8:], evtype)
+	xgb.Put32(event[12:], time)
+	xgb.Put32(event[16:], detail)
+	xgb.Put16(event[20:], source)
+	return event
+}
+
+func TestXIInputFindsXTestInput(t *testing.T) {
+	const opcode = 131
+	x := &xiInput{opcode: opcode, xtest: map[uint16]bool{4: true, 5: true}}
+
+	x.handleEvent(xiRawEvent(opcode, xiRawKeyPress, 1000, 38, 5))
+	x.handleEvent(xiRawEvent(opcode, xiRawKeyPress, 1001, 39, 10))
+	x.handleEvent(xiRawEvent(opcode, xiRawButtonPress, 1002, 1, 4))
+	x.handleEvent(xiRawEvent(opcode+1, xiRawKeyPress, 1003, 40, 5))
+
+	tests := []struct {
+		name   string
+		evtype uint16
+		time   uint32
+		detail uint32
+		want   bool
+	}{
+		{"XTest key", xiRawKeyPress, 1000, 38, true},
+		{"keyboard key", xiRawKeyPress, 1001, 39, false},
+		{"XTest button", xiRawButtonPress, 1002, 1, true},
+		{"key with a button's time", xiRawKeyPress, 1002, 1, false},
+		{"other time", xiRawKeyPress, 999, 38, false},
+		{"other extension", xiRawKeyPress, 1003, 40, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := x.fromXTest(tt.evtype, tt.time, tt.detail); got != tt.want {
+				t.Errorf("fromXTest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Only the latest input is kept
+	for i := 0; i < xiRecentInput; i++ {
+		x.handleEvent(xiRawEvent(opcode, xiRawKeyPress, 2000+uint32(i), 38, 10))
+	}
+	if len(x.recent) != xiRecentInput || x.fromXTest(xiRawKeyPress, 1000, 38) {
+		t.Errorf("kept %d events including the oldest", len(x.recent))
+	}
+
+	x.handleEvent(xiRawEvent(opcode, xiHierarchyChanged, 3000, 0, 0))
+	if !x.stale {
+		t.Error("hierarchy change didn't mark the devices stale")
+	}
+}
+
+func TestReadXauthority(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	entry := func(family uint16, fields ...string) {
+		binary.Write(&buf, binary.BigEndian, family)
+		for _, field := range fields {
+			binary.Write(&buf, binary.BigEndian, uint16(len(field)))
+			buf.WriteString(field)
+		}
+	}
+	entry(256, "otherhost", "1", "MIT-MAGIC-COOKIE-1", "other host cookie")
+	entry(256, hostname, "0", "MIT-MAGIC-COOKIE-1", "display 0 cookie")
+	entry(256, hostname, "1", "MIT-MAGIC-COOKIE-1", "display 1 cookie")
+	entry(0, string([]byte{192, 168, 1, 5}), "0", "MIT-MAGIC-COOKIE-1", "IPv4 cookie")
+	entry(6, string(net.ParseIP("fd00::5")), "0", "MIT-MAGIC-COOKIE-1", "IPv6 cookie")
+
+	path := filepath.Join(t.TempDir(), "Xauthority")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XAUTHORITY", path)
+
+	tests := []struct {
+		name    string
+		host    string
+		display string
+		addr    net.IP
+		want    string
+	}{
+		{"local display", "", "1", nil, "display 1 cookie"},
+		{"forwarded display", "localhost", "0", net.ParseIP("127.0.0.1"), "display 0 cookie"},
+		{"IPv4 display", "xserver", "0", net.ParseIP("192.168.1.5"), "IPv4 cookie"},
+		{"IPv6 display", "xserver", "0", net.ParseIP("fd00::5"), "IPv6 cookie"},
+		{"display without a cookie", "", "2", nil, ""},
+		{"other address", "xserver", "0", net.ParseIP("192.168.1.6"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, data, err := readXauthority(tt.host, tt.display, tt.addr)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("found cookie %q, want none", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != "MIT-MAGIC-COOKIE-1" || string(data) != tt.want {
+				t.Errorf("got %s %q, want %q", name, data, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialX11(t *testing.T) {
+	dir := t.TempDir()
+	listener, err := net.Listen("unix", filepath.Join(dir, "x11")+":3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, host, number, err := dialX11(filepath.Join(dir, "x11") + ":3.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if host != "" || number != "3" {
+		t.Errorf("host %q display %q, want local display 3", host, number)
+	}
+
+	for _, display := range []string{"", "nocolon", ":x", ":-1"} {
+		if _, _, _, err := dialX11(display); err == nil {
+			t.Errorf("dialed bad display %q", display)
+		}
+	}
+}
+
+func TestDisplayScreen(t *testing.T) {
+	for display, want := range map[string]int{
+		":0":            0,
+		":0.1":          1,
+		"host.lan:0":    0,
+		"host.lan:1.2":  2,
+		"/tmp/x.y/:0.3": 3,
+		":0.x":          0,
+	} {
+		if got := displayScreen(display); got != want {
+			t.Errorf("displayScreen(%q) = %d, want %d", display, got, want)
+		}
+	}
+}
@@ -5,12 +5,44 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 
 	il "github.com/tuxx/fancylock/internal"
 )
 
 func main() {
+	// Keep password memory out of core dumps and away from ptrace before
+	// anything, subcommands read secrets too
+	if err := il.DisableCoreDumps(); err != nil {
+		fmt.Fprintf(os.Stderr, "fancylock: failed to harden process: %v\n", err)
+	}
+
+	// Handle subcommands before the lock flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "audit":
+			il.InitLogger(il.LevelError, false)
+			if err := il.RunAuditCommand(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "fancylock audit: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "totp":
+			il.InitLogger(il.LevelError, false)
+			if err := il.RunTOTPCommand(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "fancylock totp: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "duress-hash":
+			il.InitLogger(il.LevelError, false)
+			if err := il.RunDuressHashCommand(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "fancylock duress-hash: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Parse command-line flags
 	configPath := flag.String("c", "", "Path to configuration file")
 	flag.StringVar(configPath, "config", "", "Path to configuration file")
@@ -18,6 +50,9 @@ func main() {
 	lockScreen := flag.Bool("l", false, "Lock the screen immediately")
 	flag.BoolVar(lockScreen, "lock", false, "Lock the screen immediately")
 
+	daemonMode := flag.Bool("d", false, "Stay in the background and lock when a trigger fires")
+	flag.BoolVar(daemonMode, "daemon", false, "Stay in the background and lock when a trigger fires")
+
 	helpFlag := flag.Bool("h", false, "Display help information")
 	flag.BoolVar(helpFlag, "help", false, "Display help information")
 
@@ -29,10 +64,14 @@ func main() {
 	// Set custom usage output
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "FancyLock: A media-playing screen locker\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s audit [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s totp enroll [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s duress-hash\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		fmt.Fprintf(os.Stderr, "  -c, --config string\n    	Path to configuration file\n")
 		fmt.Fprintf(os.Stderr, "  -l, --lock\n    	Lock the screen immediately\n")
+		fmt.Fprintf(os.Stderr, "  -d, --daemon\n    	Stay in the background and lock when a trigger fires\n")
 		fmt.Fprintf(os.Stderr, "  -h, --help\n    	Display help information\n")
 		fmt.Fprintf(os.Stderr, "  --debug-exit\n    	Enable exit with ESC or Q key (for debugging)\n")
 		fmt.Fprintf(os.Stderr, "  --log\n    	Enable debug logging\n")
@@ -40,6 +79,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s -l                   # Lock screen immediately\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -c /path/to/config   # Use specific config file\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d                   # Lock when a USB device is removed\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s audit --since 24h    # Show recent unlock attempts\n", os.Args[0])
 	}
 
 	flag.Parse()
@@ -71,14 +112,10 @@ func main() {
 	// Try to find and load config file
 	if *configPath == "" {
 		// Try default locations
-		homeDir, err := os.UserHomeDir()
-		if err == nil {
-			defaultConfigPath := filepath.Join(homeDir, ".config", "fancylock", "config.json")
-			if _, err := os.Stat(defaultConfigPath); err == nil {
-				// Default config exists, use it
-				log.Printf("Using default config file: %s", defaultConfigPath)
-				*configPath = defaultConfigPath
-			}
+		if defaultConfigPath := il.DefaultConfigPath(); defaultConfigPath != "" {
+			// Default config exists, use it
+			log.Printf("Using default config file: %s", defaultConfigPath)
+			*configPath = defaultConfigPath
 		}
 	}
 
@@ -91,28 +128,42 @@ func main() {
 		}
 	}
 
+	// Refuse to lock with a second factor nobody could enter
+	if err := il.CheckSecondFactor(config); err != nil {
+		log.Fatalf("Refusing to lock: %v", err)
+	}
+
 	// Initialize display server detection
 	displayServer := DetectDisplayServer()
 	fmt.Printf("Detected display server: %s\n", displayServer)
 
 	// Initialize the screen locker based on display server
-	var locker il.ScreenLocker
+	var newLocker func() il.ScreenLocker
 
 	switch displayServer {
 	case "hyprland":
 		log.Printf("Using Hyprland-specific Wayland locker")
-		locker = il.NewWaylandLocker(config)
+		newLocker = func() il.ScreenLocker { return il.NewWaylandLocker(config) }
 	case "wayland":
 		// We'll implement Wayland support later
 		log.Fatalf("Wayland support not yet implemented")
 	case "x11":
-		locker = il.NewX11Locker(config)
+		newLocker = func() il.ScreenLocker { return il.NewX11Locker(config) }
 	default:
 		log.Fatalf("Unsupported display server: %s", displayServer)
 	}
 
+	// In daemon mode every lock gets a fresh locker
+	if *daemonMode {
+		if err := il.NewDaemon(config, newLocker).Run(); err != nil {
+			log.Fatalf("Daemon failed: %v", err)
+		}
+		return
+	}
+
 	// If -l/--lock flag is set, lock immediately
 	if config.LockScreen {
+		locker := newLocker()
 		// Not a WaylandLocker, use the regular Lock method
 		if err := locker.Lock(); err != nil {
 			log.Fatalf("Failed to lock screen: %v", err)